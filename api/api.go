@@ -1,15 +1,75 @@
 package api
 
-import "github.com/yanpozka/airvet-jwt/dao"
+import (
+	"crypto"
+	"strings"
+	"time"
+
+	"github.com/square/go-jose/v3/jwt"
+	"github.com/yanpozka/airvet-jwt/dao"
+	"github.com/yanpozka/airvet-jwt/signer"
+)
+
+// Config holds the API settings
+type Config struct {
+	// Issuer is the base URL of the server, it's the `iss` claim of the tokens
+	// and every endpoint URL in the discovery document starts with it
+	Issuer string
+	// Audience is the `aud` claim of the tokens of clients without their own audience,
+	// the issuer when empty. This API only accepts tokens for this audience
+	Audience string
+	// Leeway is the clock skew allowed validating `exp`, `nbf` and `iat`, jwt.DefaultLeeway when zero
+	Leeway time.Duration
+	// Signer signs with the keys whose private key is held by an external signer
+	Signer signer.Backend
+	// KeyCacheTTL is how long the key set is cached, DefaultKeyCacheTTL when zero.
+	// Keys changed by another process are picked up after it
+	KeyCacheTTL time.Duration
+	// JWKSMaxAge is how long relying parties can cache the JWKS, they must revalidate it when zero.
+	// It can't outlive the pre-publication of the keys or caches won't know a new key when it signs
+	JWKSMaxAge time.Duration
+	// EncryptionKey decrypts the access tokens for Audience, they're encrypted to its public key,
+	// published in the JWKS with `use` enc. Tokens are only signed when nil
+	EncryptionKey crypto.Signer
+}
 
 // API represents the whole api
 type API struct {
 	db *dao.DAO
+	// keys holds the signing keys, they may be stored apart from the rest of the data
+	keys     dao.KeyStore
+	keyCache keyCache
+	cfg      Config
 }
 
-// NewAPI creates a new API
-func NewAPI(db *dao.DAO) *API {
+// NewAPI creates a new API signing with the keys in the key store
+func NewAPI(db *dao.DAO, keys dao.KeyStore, cfg Config) *API {
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if cfg.Audience == "" {
+		cfg.Audience = cfg.Issuer
+	}
+	if cfg.Leeway == 0 {
+		cfg.Leeway = jwt.DefaultLeeway
+	}
+	if cfg.KeyCacheTTL == 0 {
+		cfg.KeyCacheTTL = DefaultKeyCacheTTL
+	}
 	return &API{
-		db: db,
+		db:   db,
+		keys: keys,
+		cfg:  cfg,
+	}
+}
+
+// endpointURL returns the absolute URL of a route
+func (a *API) endpointURL(path string) string {
+	return a.cfg.Issuer + path
+}
+
+// audience returns the `aud` claim of the access tokens issued to the client, nil for first party logins
+func (a *API) audience(client *dao.Client) jwt.Audience {
+	if client != nil && client.Audience != "" {
+		return jwt.Audience{client.Audience}
 	}
+	return jwt.Audience{a.cfg.Audience}
 }
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+// testIssuer is the issuer of the test APIs
+const testIssuer = "https://auth.airvet.test"
+
+// newTestAPI returns an API over a fresh migrated database
+func newTestAPI(t testing.TB) (*API, *dao.DAO) {
+	t.Helper()
+
+	d, err := dao.NewDAO(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	if err := d.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return NewAPI(d, d, Config{Issuer: testIssuer}), d
+}
+
+// serve runs a request through the API routes
+func serve(a *API, method, target, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return serveRequest(a, req)
+}
+
+// serveRequest runs the request through the API routes
+func serveRequest(a *API, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	a.GetRoutes().ServeHTTP(rec, req)
+	return rec
+}
+
+// serveForm posts the form to the target authenticated as the client, if any
+func serveForm(a *API, target, clientID, secret string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientID != "" {
+		req.SetBasicAuth(clientID, secret)
+	}
+	return serveRequest(a, req)
+}
+
+// login gets the tokens of a first party login
+func login(t *testing.T, a *API, email, password string) *tokenOut {
+	t.Helper()
+
+	rec := serve(a, http.MethodPost, "/auth", "application/json", fmt.Sprintf(`{"email": %q, "password": %q}`, email, password))
+	assertStatus(t, rec, http.StatusOK)
+	out := new(tokenOut)
+	if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+		t.Fatal(err)
+	}
+	if out.JWT == "" || out.RefreshToken == "" {
+		t.Fatalf("got tokens %s, want a JWT and a refresh token", rec.Body.Bytes())
+	}
+	return out
+}
+
+// assertStatus fails the test when the response doesn't have the status
+func assertStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Fatalf("got status %d %s, want %d %s", rec.Code, strings.TrimSpace(rec.Body.String()), status, http.StatusText(status))
+	}
+}
+
+// activateTestKey adds a new key to the DB and activates it
+func activateTestKey(t *testing.T, d *dao.DAO) *dao.JWK {
+	t.Helper()
+
+	return activateTestKeyWithAlg(t, d, dao.DefaultAlgorithm)
+}
+
+// activateTestKeyWithAlg adds a new key for the signing algorithm to the key store and activates it
+func activateTestKeyWithAlg(t testing.TB, keys dao.KeyStore, alg string) *dao.JWK {
+	t.Helper()
+
+	jwk, err := dao.NewJWK(dao.KeySpec{Algorithm: alg}, time.Now().Add(dao.JWKExpiration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.InsertJWK(context.Background(), jwk); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.UpdateJWKState(context.Background(), jwk.KID, dao.KeyStateActive); err != nil {
+		t.Fatal(err)
+	}
+	return jwk
+}
+
+// insertTestUser adds a user with the password
+func insertTestUser(t testing.TB, d *dao.DAO, email, password string) *dao.User {
+	t.Helper()
+
+	hash, err := d.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &dao.User{Email: email, Name: "Test", PasswordHash: hash}
+	if err := d.InsertUser(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// insertTestClient registers a client with the secret, a public client without it
+func insertTestClient(t *testing.T, d *dao.DAO, c *dao.Client, secret string) *dao.Client {
+	t.Helper()
+
+	if secret != "" {
+		hash, err := d.HashPassword(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SecretHash = hash
+	}
+	if err := d.InsertClient(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -1,7 +1,6 @@
 package api
 
 import (
-	"encoding/json"
 	"log"
 	"net/http"
 	"time"
@@ -10,15 +9,23 @@ import (
 )
 
 const (
-	jwtExpiration = 30 * 24 * time.Hour // 1 month
+	// JWTExpiration defines how long a signed access JWT is valid
+	JWTExpiration = 15 * time.Minute
 
-	authorizationHeader = "Authorization"
+	// RefreshTokenExpiration defines how long a refresh token can be exchanged for new tokens
+	RefreshTokenExpiration = 30 * 24 * time.Hour // 1 month
 )
 
+type tokenOut struct {
+	JWT          string `json:"jwt"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
 func (a *API) auth(w http.ResponseWriter, req *http.Request) {
 	u, err := readUserIn(req)
 	if err != nil {
-		log.Println("Error reading user input: %v", err)
+		log.Printf("Error reading user input: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -34,32 +41,23 @@ func (a *API) auth(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	jwks, err := a.db.GetJWKS(req.Context())
-	if len(jwks) == 0 || err != nil {
-		log.Printf("We don't have a JWKS, error?: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-	}
-
-	jwk := jwks[0] // always get the first one
-	rsaKey, err := jwk.GetRSAPrivateKey()
+	jwt, err := a.newAccessToken(req.Context(), user, nil, "")
 	if err != nil {
-		log.Printf("Error decoding private key: %v", err)
+		log.Printf("Error generating jwt: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	jwt, err := newJWT(user.Email, rsaKey, time.Now().Add(jwtExpiration))
+	refreshToken, err := a.db.IssueRefreshToken(req.Context(), &dao.RefreshToken{UserID: user.ID}, time.Now().Add(RefreshTokenExpiration))
 	if err != nil {
-		log.Printf("Error generating jwt: %v", err)
+		log.Printf("Error generating refresh token: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Add("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	resp := map[string]string{
-		"jwt": jwt,
-	}
-	json.NewEncoder(w).Encode(resp)
+	writeJSON(w, http.StatusOK, tokenOut{
+		JWT:          jwt,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(JWTExpiration / time.Second),
+	})
 }
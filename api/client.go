@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/square/go-jose/v3/jwt"
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+// clientAssertionType is the RFC 7523 client_assertion_type of private_key_jwt authentication
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionAlgs are the signature algorithms accepted in client assertions
+var clientAssertionAlgs = []string{"RS256", "PS256", "ES256", "ES384", "EdDSA"}
+
+// authenticateClient checks the client credentials sent with HTTP Basic authentication
+// (client_secret_basic), in the form body (client_secret_post) or a signed assertion (private_key_jwt)
+func (a *API) authenticateClient(req *http.Request) (*dao.Client, error) {
+	if req.PostFormValue("client_assertion_type") != "" {
+		return a.authenticateClientAssertion(req)
+	}
+
+	id, secret, ok := req.BasicAuth()
+	if ok {
+		// RFC 6749 section 2.3.1: the credentials are form url-encoded before going in the header
+		var errID, errSecret error
+		id, errID = url.QueryUnescape(id)
+		secret, errSecret = url.QueryUnescape(secret)
+		if errID != nil || errSecret != nil {
+			return nil, dao.ErrInvalidClient
+		}
+	} else {
+		id, secret = req.PostFormValue("client_id"), req.PostFormValue("client_secret")
+	}
+	if id == "" || secret == "" {
+		return nil, dao.ErrInvalidClient
+	}
+	return a.db.AuthenticateClient(req.Context(), id, secret)
+}
+
+// tokenClient authenticates confidential clients, public clients only send their client_id
+func (a *API) tokenClient(req *http.Request) (*dao.Client, error) {
+	if _, _, ok := req.BasicAuth(); ok || req.PostFormValue("client_secret") != "" ||
+		req.PostFormValue("client_assertion_type") != "" {
+		return a.authenticateClient(req)
+	}
+
+	c, err := a.db.GetClient(req.Context(), req.PostFormValue("client_id"))
+	if err == dao.ErrClientNotFound {
+		return nil, dao.ErrInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !c.IsPublic() {
+		return nil, dao.ErrInvalidClient
+	}
+	return c, nil
+}
+
+// issuedTo reports whether a token issued to clientID belongs to the client, the tokens
+// of first party logins have no client ID and belong to the first party clients
+func issuedTo(client *dao.Client, clientID string) bool {
+	if clientID == "" {
+		return client.FirstParty
+	}
+	return clientID == client.ID
+}
+
+// authenticateClientAssertion verifies the JWT signed by the client with its registered key,
+// every assertion can be used only once
+func (a *API) authenticateClientAssertion(req *http.Request) (*dao.Client, error) {
+	if req.PostFormValue("client_assertion_type") != clientAssertionType {
+		return nil, dao.ErrInvalidClient
+	}
+	token, err := jwt.ParseSigned(req.PostFormValue("client_assertion"))
+	if err != nil || len(token.Headers) != 1 || !containsString(clientAssertionAlgs, token.Headers[0].Algorithm) {
+		return nil, dao.ErrInvalidClient
+	}
+
+	// the issuer tells which client signed it, it's verified with the client key below
+	claims := new(jwt.Claims)
+	if err := token.UnsafeClaimsWithoutVerification(claims); err != nil {
+		return nil, dao.ErrInvalidClient
+	}
+	if id := req.PostFormValue("client_id"); id != "" && id != claims.Issuer {
+		return nil, dao.ErrInvalidClient
+	}
+
+	c, err := a.db.GetClient(req.Context(), claims.Issuer)
+	if err == dao.ErrClientNotFound {
+		return nil, dao.ErrInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := c.GetPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if pubKey == nil {
+		return nil, dao.ErrInvalidClient
+	}
+
+	claims = new(jwt.Claims)
+	if err := token.Claims(pubKey, claims); err != nil {
+		return nil, dao.ErrInvalidClient
+	}
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:  c.ID,
+		Subject: c.ID,
+		Time:    time.Now(),
+	}, a.cfg.Leeway)
+	if err != nil || claims.Expiry == nil || claims.ID == "" {
+		return nil, dao.ErrInvalidClient
+	}
+	if !claims.Audience.Contains(a.cfg.Issuer) && !claims.Audience.Contains(a.endpointURL(req.URL.Path)) {
+		return nil, dao.ErrInvalidClient
+	}
+
+	// used assertions are kept until they can't be accepted anymore, so they can't be replayed
+	err = a.db.UseClientAssertion(req.Context(), c.ID, claims.ID, claims.Expiry.Time().Add(a.cfg.Leeway))
+	if err == dao.ErrAssertionReplayed {
+		return nil, dao.ErrInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// writeInvalidClient asks the client to authenticate again
+func writeInvalidClient(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="airvet"`)
+	auth.WriteError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+}
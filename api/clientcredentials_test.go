@@ -0,0 +1,164 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose/v3"
+	"github.com/square/go-jose/v3/jwt"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+// clientCredentials posts a client_credentials grant and returns the response
+func clientCredentials(t *testing.T, a *API, clientID, secret string, form url.Values) (int, *oauthTokenOut) {
+	t.Helper()
+
+	form.Set("grant_type", grantClientCredentials)
+	rec := serveForm(a, tokenPath, clientID, secret, form)
+	out := new(oauthTokenOut)
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, out
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	a, d := newTestAPI(t)
+	activateTestKey(t, d)
+	insertTestClient(t, d, &dao.Client{ID: "reports-service", Scopes: []string{"users:read", "appointments:read"}}, "Reports-secret")
+	insertTestClient(t, d, &dao.Client{ID: "clinic-app", RedirectURIs: []string{testRedirectURI}}, "")
+
+	code, out := clientCredentials(t, a, "reports-service", "Reports-secret", url.Values{"scope": {"users:read"}})
+	if code != http.StatusOK || out.RefreshToken != "" || out.Scope != "users:read" {
+		t.Fatalf("got %d %+v, want an access token without refresh token", code, out)
+	}
+	jwks, err := d.GetJWKS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseJWT(out.AccessToken, jwks, expectTestIssuer(), jwt.DefaultLeeway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "reports-service" || claims.ClientID != "reports-service" || claims.Email != "" {
+		t.Fatalf("got claims %+v, want the client as the subject and no email", claims)
+	}
+	if id, ok := claims.UserID(); ok {
+		t.Fatalf("got user %d for a client token, want none", id)
+	}
+
+	// all the allowed scopes when the scope is missing
+	if code, out := clientCredentials(t, a, "reports-service", "Reports-secret", url.Values{}); code != http.StatusOK ||
+		out.Scope != "users:read appointments:read" {
+		t.Fatalf("got %d %+v, want all the allowed scopes", code, out)
+	}
+	if code, _ := clientCredentials(t, a, "reports-service", "Reports-secret", url.Values{"scope": {"users:write"}}); code != http.StatusBadRequest {
+		t.Fatalf("got %d for a scope not allowed, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := clientCredentials(t, a, "reports-service", "wrong", url.Values{}); code != http.StatusUnauthorized {
+		t.Fatalf("got %d with the wrong secret, want %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := clientCredentials(t, a, "", "", url.Values{"client_id": {"clinic-app"}}); code != http.StatusBadRequest {
+		t.Fatalf("got %d for a public client, want %d", code, http.StatusBadRequest)
+	}
+
+	// the token is active while its client exists, and the client can revoke it
+	rec := serveForm(a, introspectPath, "reports-service", "Reports-secret", url.Values{"token": {out.AccessToken}})
+	assertStatus(t, rec, http.StatusOK)
+	introspection := new(introspectionOut)
+	if err := json.Unmarshal(rec.Body.Bytes(), introspection); err != nil {
+		t.Fatal(err)
+	}
+	if !introspection.Active || introspection.Sub != "reports-service" || introspection.Username != "" {
+		t.Fatalf("got %+v for a client token, want it active without a username", introspection)
+	}
+	rec = serveForm(a, revokePath, "reports-service", "Reports-secret", url.Values{"token": {out.AccessToken}})
+	assertStatus(t, rec, http.StatusOK)
+	rec = serveForm(a, introspectPath, "reports-service", "Reports-secret", url.Values{"token": {out.AccessToken}})
+	if err := json.Unmarshal(rec.Body.Bytes(), introspection); err != nil {
+		t.Fatal(err)
+	}
+	if introspection.Active {
+		t.Fatalf("got %+v for a revoked client token, want it inactive", introspection)
+	}
+}
+
+func TestPrivateKeyJWT(t *testing.T) {
+	a, d := newTestAPI(t)
+	activateTestKey(t, d)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	insertTestClient(t, d, &dao.Client{ID: "reports-service", Scopes: []string{"users:read"}, PublicKey: publicKey}, "")
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion := func(claims jwt.Claims) url.Values {
+		t.Helper()
+
+		signed, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return url.Values{"client_assertion_type": {clientAssertionType}, "client_assertion": {signed}}
+	}
+	valid := jwt.Claims{
+		Issuer:   "reports-service",
+		Subject:  "reports-service",
+		Audience: jwt.Audience{testIssuer + tokenPath},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		ID:       "assertion-1",
+	}
+
+	form := assertion(valid)
+	if code, out := clientCredentials(t, a, "", "", form); code != http.StatusOK || out.Scope != "users:read" {
+		t.Fatalf("got %d %+v with a valid assertion, want an access token", code, out)
+	}
+	if code, _ := clientCredentials(t, a, "", "", form); code != http.StatusUnauthorized {
+		t.Fatalf("got %d replaying the assertion, want %d", code, http.StatusUnauthorized)
+	}
+
+	expired, otherAudience, noJTI := valid, valid, valid
+	expired.ID, expired.Expiry = "assertion-2", jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	otherAudience.ID, otherAudience.Audience = "assertion-3", jwt.Audience{"https://other.test"}
+	noJTI.ID = ""
+	for name, claims := range map[string]jwt.Claims{"expired": expired, "other audience": otherAudience, "no jti": noJTI} {
+		if code, _ := clientCredentials(t, a, "", "", assertion(claims)); code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d, want %d", name, code, http.StatusUnauthorized)
+		}
+	}
+
+	// signed by another key
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err = jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: otherKey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid.ID = "assertion-4"
+	if code, _ := clientCredentials(t, a, "", "", assertion(valid)); code != http.StatusUnauthorized {
+		t.Fatalf("got %d with an assertion signed by another key, want %d", code, http.StatusUnauthorized)
+	}
+}
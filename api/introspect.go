@@ -0,0 +1,148 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/square/go-jose/v3/jwt"
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+// introspectionOut is the RFC 7662 introspection response
+type introspectionOut struct {
+	Active    bool         `json:"active"`
+	Scope     string       `json:"scope,omitempty"`
+	ClientID  string       `json:"client_id,omitempty"`
+	Username  string       `json:"username,omitempty"`
+	TokenType string       `json:"token_type,omitempty"`
+	Exp       int64        `json:"exp,omitempty"`
+	Iat       int64        `json:"iat,omitempty"`
+	Nbf       int64        `json:"nbf,omitempty"`
+	Sub       string       `json:"sub,omitempty"`
+	Aud       jwt.Audience `json:"aud,omitempty"`
+	Iss       string       `json:"iss,omitempty"`
+	Jti       string       `json:"jti,omitempty"`
+}
+
+// introspect tells authenticated clients whether a token is active and what it stands for
+func (a *API) introspect(w http.ResponseWriter, req *http.Request) {
+	_, err := a.authenticateClient(req)
+	if err == dao.ErrInvalidClient {
+		writeInvalidClient(w)
+		return
+	}
+	if err != nil {
+		log.Printf("Error authenticating client: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	token := req.PostFormValue("token")
+	if token == "" {
+		auth.WriteError(w, http.StatusBadRequest, "invalid_request", "missing token")
+		return
+	}
+
+	var out *introspectionOut
+	if req.PostFormValue("token_type_hint") == refreshTokenHint {
+		if out, err = a.introspectRefreshToken(req, token); err == nil && !out.Active {
+			out, err = a.introspectJWT(req, token)
+		}
+	} else {
+		if out, err = a.introspectJWT(req, token); err == nil && !out.Active {
+			out, err = a.introspectRefreshToken(req, token)
+		}
+	}
+	if err != nil {
+		log.Printf("Error introspecting token: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (a *API) introspectJWT(req *http.Request, signedJWT string) (*introspectionOut, error) {
+	// resource servers introspect tokens of any audience, `aud` is in the response
+	claims, err := a.verifyJWT(req.Context(), signedJWT, "")
+	if err == auth.ErrInvalidToken {
+		return &introspectionOut{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the token is only as good as its user, or its client for client_credentials tokens
+	var username string
+	if userID, ok := claims.UserID(); ok {
+		user, err := a.db.GetUserByID(req.Context(), userID)
+		if err == dao.ErrUserNotFound {
+			return &introspectionOut{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		username = user.Email
+	} else {
+		_, err = a.db.GetClient(req.Context(), claims.Subject)
+		if err == dao.ErrClientNotFound {
+			return &introspectionOut{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &introspectionOut{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		Username:  username,
+		TokenType: "Bearer",
+		Exp:       numericDate(claims.Expiry),
+		Iat:       numericDate(claims.IssuedAt),
+		Nbf:       numericDate(claims.NotBefore),
+		Sub:       claims.Subject,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		Jti:       claims.ID,
+	}, nil
+}
+
+func (a *API) introspectRefreshToken(req *http.Request, token string) (*introspectionOut, error) {
+	rt, err := a.db.GetRefreshToken(req.Context(), token)
+	if err == dao.ErrInvalidRefreshToken {
+		return &introspectionOut{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := a.db.GetUserByID(req.Context(), rt.UserID)
+	if err == dao.ErrUserNotFound {
+		return &introspectionOut{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &introspectionOut{
+		Active:    true,
+		Scope:     rt.Scope,
+		ClientID:  rt.ClientID,
+		Username:  user.Email,
+		TokenType: refreshTokenHint,
+		Exp:       rt.ExpiresAt,
+		Iat:       rt.CreatedAt,
+		Iss:       a.cfg.Issuer,
+	}, nil
+}
+
+func numericDate(d *jwt.NumericDate) int64 {
+	if d == nil {
+		return 0
+	}
+	return int64(*d)
+}
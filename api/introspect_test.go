@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+func TestIntrospect(t *testing.T) {
+	a, d := newTestAPI(t)
+	activateTestKey(t, d)
+	insertTestUser(t, d, "owner@example.com", "Dog-and-cat-1")
+	insertTestClient(t, d, &dao.Client{ID: "airvet-app", FirstParty: true}, "App-secret")
+	insertTestClient(t, d, &dao.Client{ID: "resource-server"}, "Resource-secret")
+
+	introspect := func(token, hint string) *introspectionOut {
+		t.Helper()
+
+		form := url.Values{"token": {token}}
+		if hint != "" {
+			form.Set("token_type_hint", hint)
+		}
+		rec := serveForm(a, "/introspect", "resource-server", "Resource-secret", form)
+		assertStatus(t, rec, http.StatusOK)
+		if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Fatalf("got Cache-Control %q, want no-store", cc)
+		}
+		out := new(introspectionOut)
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	tokens := login(t, a, "owner@example.com", "Dog-and-cat-1")
+	out := introspect(tokens.JWT, "")
+	if !out.Active || out.Username != "owner@example.com" || out.TokenType != "Bearer" || out.Jti == "" || out.Exp == 0 || out.Iss != testIssuer {
+		t.Fatalf("got %+v for a valid JWT, want it active with its claims", out)
+	}
+	// a wrong hint only changes the lookup order
+	for _, hint := range []string{"", refreshTokenHint} {
+		out := introspect(tokens.RefreshToken, hint)
+		if !out.Active || out.Username != "owner@example.com" || out.TokenType != refreshTokenHint {
+			t.Fatalf("got %+v for a valid refresh token with hint %q, want it active", out, hint)
+		}
+	}
+
+	refreshed := serve(a, http.MethodPost, "/token/refresh", "application/json", `{"refresh_token": "`+tokens.RefreshToken+`"}`)
+	assertStatus(t, refreshed, http.StatusOK)
+	revoked := serveForm(a, "/revoke", "airvet-app", "App-secret", url.Values{"token": {tokens.JWT}})
+	assertStatus(t, revoked, http.StatusOK)
+	for name, token := range map[string]string{
+		"revoked JWT":           tokens.JWT,
+		"rotated refresh token": tokens.RefreshToken,
+		"unknown token":         "not-a-token",
+	} {
+		if out := introspect(token, ""); out.Active || out.Username != "" {
+			t.Errorf("%s: got %+v, want only active false", name, out)
+		}
+	}
+
+	rec := serveForm(a, "/introspect", "", "", url.Values{"token": {tokens.JWT}})
+	assertStatus(t, rec, http.StatusUnauthorized)
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Fatal("got no WWW-Authenticate header for an unauthenticated client")
+	}
+	rec = serveForm(a, "/introspect", "resource-server", "App-secret", url.Values{"token": {tokens.JWT}})
+	assertStatus(t, rec, http.StatusUnauthorized)
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/square/go-jose/v3/jwt"
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+// audienceEncryptionKey returns the public key the access tokens issued to the client are
+// encrypted to: the one registered for its audience or, for the default audience, the API one.
+// It's nil when they're only signed
+func (a *API) audienceEncryptionKey(client *dao.Client) (crypto.PublicKey, error) {
+	if client != nil && client.Audience != "" {
+		return client.GetEncryptionKey()
+	}
+	if a.cfg.EncryptionKey != nil {
+		return a.cfg.EncryptionKey.Public(), nil
+	}
+	return nil, nil
+}
+
+// recordEncryptedToken keeps the claims of an access token encrypted to a client audience
+// until it expires, signedJWT is the JWT nested in the token
+func (a *API) recordEncryptedToken(ctx context.Context, token, signedJWT string, claims auth.Claims) error {
+	parsed, err := jwt.ParseSigned(signedJWT)
+	if err != nil {
+		return fmt.Errorf("failed to parse the signed JWT: %w", err)
+	}
+	if len(parsed.Headers) != 1 {
+		return errors.New("the signed JWT must have one signature")
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the claims: %w", err)
+	}
+
+	return a.db.InsertEncryptedToken(ctx, token, &dao.EncryptedToken{
+		JTI:       claims.ID,
+		KID:       parsed.Headers[0].KeyID,
+		Claims:    data,
+		ExpiresAt: claims.Expiry.Time().Unix(),
+	})
+}
+
+// encryptedTokenClaims returns the recorded claims of a token encrypted to a client audience,
+// validated like the signed ones. auth.ErrInvalidToken when the token wasn't recorded
+// or its signing key can't verify anymore
+func (a *API) encryptedTokenClaims(ctx context.Context, token string, expected jwt.Expected) (*auth.Claims, error) {
+	et, err := a.db.GetEncryptedToken(ctx, token)
+	if err == dao.ErrEncryptedTokenNotFound {
+		return nil, auth.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	set, err := a.keySet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(verificationKeys(set.jwks, et.KID)) == 0 {
+		return nil, auth.ErrInvalidToken
+	}
+
+	claims := new(auth.Claims)
+	if err := json.Unmarshal(et.Claims, claims); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the encrypted token claims: %w", err)
+	}
+	if err := claims.ValidateWithLeeway(expected, a.cfg.Leeway); err != nil {
+		return nil, auth.ErrInvalidToken
+	}
+	return claims, nil
+}
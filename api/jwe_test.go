@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+func TestRevokeTokenEncryptedToAudience(t *testing.T) {
+	ctx := context.Background()
+	a, d := newTestAPI(t)
+	activateTestKey(t, d)
+
+	// only the reports service holds the private key its tokens are encrypted to
+	audienceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(audienceKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := insertTestClient(t, d, &dao.Client{
+		ID:            "reports-service",
+		Name:          "Reports",
+		Scopes:        []string{"users:read"},
+		Audience:      "https://reports.airvet.test",
+		EncryptionKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}, "Reports-secret")
+
+	token, err := a.newClientAccessToken(ctx, client, "users:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.DecryptToken(token, audienceKey); err != nil {
+		t.Fatalf("got %v decrypting the token with the audience key", err)
+	}
+
+	introspect := func() *introspectionOut {
+		t.Helper()
+
+		rec := serveForm(a, introspectPath, client.ID, "Reports-secret", url.Values{"token": {token}})
+		assertStatus(t, rec, http.StatusOK)
+		out := new(introspectionOut)
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	if out := introspect(); !out.Active || out.ClientID != client.ID || len(out.Aud) != 1 || out.Aud[0] != client.Audience || out.Jti == "" {
+		t.Fatalf("got introspection %+v, want the active token of %s", out, client.ID)
+	}
+
+	rec := serveForm(a, revokePath, client.ID, "Reports-secret", url.Values{"token": {token}})
+	assertStatus(t, rec, http.StatusOK)
+	if out := introspect(); out.Active {
+		t.Fatalf("got introspection %+v of the revoked token, want inactive", out)
+	}
+}
+
+func TestVerifyTokenEncryptedToAPI(t *testing.T) {
+	ctx := context.Background()
+	_, d := newTestAPI(t)
+	activateTestKey(t, d)
+	encryptionKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAPI(d, d, Config{Issuer: testIssuer, EncryptionKey: encryptionKey})
+	client := insertTestClient(t, d, &dao.Client{ID: "reports-service", Scopes: []string{"users:read"}}, "Reports-secret")
+
+	// the tokens of the default audience are encrypted to the API key, it decrypts them
+	token, err := a.newClientAccessToken(ctx, client, "users:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.DecryptToken(token, nil); err != auth.ErrInvalidToken {
+		t.Fatalf("got %v decrypting the token without a key, want %v", err, auth.ErrInvalidToken)
+	}
+	claims, err := a.verifyJWT(ctx, token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.ClientID != client.ID {
+		t.Fatalf("got claims %+v, want the token of %s", claims, client.ID)
+	}
+
+	// the published encryption key comes along with the signing key
+	jwks := new(struct {
+		Keys []struct {
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+		} `json:"keys"`
+	})
+	if err := json.Unmarshal(getJWKSIfNoneMatch(a, "").Body.Bytes(), jwks); err != nil {
+		t.Fatal(err)
+	}
+	var encryptionKeys int
+	for _, key := range jwks.Keys {
+		if key.Use == "enc" && key.Alg == "ECDH-ES" {
+			encryptionKeys++
+		}
+	}
+	if len(jwks.Keys) != 2 || encryptionKeys != 1 {
+		t.Fatalf("got JWKS %+v, want the signing and the encryption keys", jwks.Keys)
+	}
+}
@@ -1,30 +1,71 @@
 package api
 
 import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/square/go-jose/v3"
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
 )
 
-// we could also use RS512
-const jwkAlgo = "RS256"
-
+// getJWKS serves the precomputed JWKS document, revalidated with its ETag
 func (a *API) getJWKS(w http.ResponseWriter, req *http.Request) {
-	jwksDB, err := a.db.GetJWKS(req.Context())
+	set, err := a.keySet(req.Context())
 	if err != nil {
-		log.Println("Error gettings JWKS: %v", err)
+		log.Printf("Error gettings JWKS: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("ETag", set.jwksETag)
+	w.Header().Set("Cache-Control", a.jwksCacheControl())
+	if etagMatches(req.Header.Get("If-None-Match"), set.jwksETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(set.jwksDocument)
+}
+
+// jwksCacheControl lets caches keep the JWKS for JWKSMaxAge, they must revalidate it when zero
+func (a *API) jwksCacheControl() string {
+	maxAge := int(a.cfg.JWKSMaxAge / time.Second)
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", maxAge)
+}
+
+// newJWKSDocument returns the canonical JWKS of the published keys and the encryption key,
+// sorted by key ID so every replica serves the same bytes, and its strong ETag: the hash of the document
+func newJWKSDocument(jwksDB []*dao.JWK, encryptionKey crypto.Signer) ([]byte, string, error) {
 	jwks := jose.JSONWebKeySet{
 		Keys: []jose.JSONWebKey{},
 	}
+	if encryptionKey != nil {
+		jwk, err := auth.EncryptionJWK(encryptionKey.Public())
+		if err != nil {
+			return nil, "", err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
 
 	for _, jwkDB := range jwksDB {
-		publicKey, err := jwkDB.GetRSAPublicKey()
+		if !jwkDB.IsPublished() {
+			continue
+		}
+		publicKey, err := jwkDB.GetPublicKey()
 		if err != nil {
 			log.Printf("Error gettings JWK public key: %v", err)
 			continue
@@ -32,14 +73,36 @@ func (a *API) getJWKS(w http.ResponseWriter, req *http.Request) {
 
 		jwk := jose.JSONWebKey{
 			Key:       publicKey,
-			Algorithm: jwkAlgo,
+			KeyID:     jwkDB.KID,
+			Algorithm: jwkDB.Algorithm,
 			Use:       "sig",
 		}
 
 		jwks.Keys = append(jwks.Keys, jwk)
 	}
+	sort.Slice(jwks.Keys, func(i, k int) bool {
+		return jwks.Keys[i].KeyID < jwks.Keys[k].KeyID
+	})
 
-	w.Header().Add("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(jwks)
+	document, err := json.Marshal(jwks)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode JWKS: %w", err)
+	}
+	sum := sha256.Sum256(document)
+	return document, `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`, nil
+}
+
+// etagMatches reports whether the If-None-Match header lists the ETag, using the weak
+// comparison RFC 7232 requires for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
 }
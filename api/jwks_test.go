@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+// getJWKSIfNoneMatch requests the JWKS with the If-None-Match header, when it's not empty
+func getJWKSIfNoneMatch(a *API, ifNoneMatch string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, jwksPath, nil)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	return serveRequest(a, req)
+}
+
+func TestJWKSETag(t *testing.T) {
+	_, d := newTestAPI(t)
+	activateTestKeyWithAlg(t, d, dao.AlgES256)
+	a := NewAPI(d, d, Config{Issuer: testIssuer, JWKSMaxAge: time.Hour})
+
+	first := getJWKSIfNoneMatch(a, "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || len(etag) < 3 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		t.Fatalf("got status %d and ETag %q, want the JWKS with a strong ETag", first.Code, etag)
+	}
+	if cacheControl := first.Header().Get("Cache-Control"); cacheControl != "public, max-age=3600" {
+		t.Fatalf("got Cache-Control %q, want the JWKS max-age", cacheControl)
+	}
+
+	// every matching If-None-Match is revalidated without the body
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		resp := getJWKSIfNoneMatch(a, ifNoneMatch)
+		if resp.Code != http.StatusNotModified || resp.Body.String() != "" || resp.Header().Get("ETag") != etag {
+			t.Fatalf("got status %d with If-None-Match %s, want %d with the ETag", resp.Code, ifNoneMatch, http.StatusNotModified)
+		}
+	}
+	if resp := getJWKSIfNoneMatch(a, `"other"`); resp.Code != http.StatusOK || resp.Body.String() != first.Body.String() {
+		t.Fatalf("got status %d with another ETag, want the JWKS", resp.Code)
+	}
+
+	// another replica over the same keys serves the same document and ETag
+	replica := getJWKSIfNoneMatch(NewAPI(d, d, Config{Issuer: testIssuer}), "")
+	if replica.Body.String() != first.Body.String() || replica.Header().Get("ETag") != etag {
+		t.Fatal("got another JWKS document from a replica, want the same bytes and ETag")
+	}
+	if cacheControl := replica.Header().Get("Cache-Control"); cacheControl != "no-cache" {
+		t.Fatalf("got Cache-Control %q without a max-age, want it revalidated every time", cacheControl)
+	}
+
+	// a new key changes the ETag, the cached JWKS is fetched again
+	activateTestKeyWithAlg(t, d, dao.AlgES256)
+	a.InvalidateKeys()
+	resp := getJWKSIfNoneMatch(a, etag)
+	if resp.Code != http.StatusOK || resp.Header().Get("ETag") == etag {
+		t.Fatalf("got status %d and ETag %q after a rotation, want the new JWKS", resp.Code, resp.Header().Get("ETag"))
+	}
+}
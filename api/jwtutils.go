@@ -1,78 +1,247 @@
 package api
 
 import (
-	"crypto/rsa"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/square/go-jose/v3"
 	"github.com/square/go-jose/v3/jwt"
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
 )
 
-const (
-	jwtIssuer    = "Secure Company"
-	jkuHeaderURL = "http://localhost:8080/.well-known/jwks.json"
-)
+// idTokenClaims are the claims of an OpenID Connect ID token
+type idTokenClaims struct {
+	jwt.Claims
+	Nonce string `json:"nonce,omitempty"`
+	Email string `json:"email,omitempty"`
+	Name  string `json:"name,omitempty"`
+}
 
-var (
-	errInvalidJWT error = fmt.Errorf("invalid jwt")
-)
+// newJWT signs the claims with the active key
+func (a *API) newJWT(ctx context.Context, claims interface{}) (string, error) {
+	set, err := a.keySet(ctx)
+	if err != nil {
+		return "", err
+	}
+	if set.signingKey == nil {
+		return "", errors.New("we don't have an active JWK")
+	}
+	if set.signerErr != nil {
+		return "", set.signerErr
+	}
+	jwsSigner, err := a.newSigner(ctx, set)
+	if err != nil {
+		return "", err
+	}
 
-type userClaims struct {
-	jwt.Claims
-	Email string `json:"email"`
+	return jwt.Signed(jwsSigner).
+		Claims(claims).
+		CompactSerialize()
 }
 
-func newJWT(email string, priKey *rsa.PrivateKey, expireAt time.Time) (string, error) {
-	claims := userClaims{
-		Email: email,
-		Claims: jwt.Claims{
-			Issuer: jwtIssuer,
-			Expiry: jwt.NewNumericDate(expireAt),
-		},
+// newAccessToken signs a JWT for the user issued to the client with the scope. client is nil for first party
+// logins, only their tokens have the user roles and every permission of them as scope. The email is only
+// in first party tokens and the ones granted the email scope
+func (a *API) newAccessToken(ctx context.Context, user *dao.User, client *dao.Client, scope string) (string, error) {
+	claims, err := a.registeredClaims(strconv.Itoa(user.ID), a.audience(client))
+	if err != nil {
+		return "", err
 	}
-	opts := jose.SignerOptions{}
-	opts.WithType("JWT")
-	// TODO: have a valid domain so jwt.io can verify our JWT :)
-	opts.WithHeader("jku", jkuHeaderURL)
+	uc := auth.Claims{Scope: scope, Claims: claims}
 
-	signKey := jose.SigningKey{
-		Algorithm: jose.RS256,
-		Key:       priKey,
+	if client != nil {
+		// third party clients act with the scope the user granted, never with the user roles
+		uc.ClientID = client.ID
+	} else {
+		if uc.Roles, err = a.db.GetUserRoles(ctx, user.ID); err != nil {
+			return "", err
+		}
+		permissions, err := a.db.GetUserPermissions(ctx, user.ID)
+		if err != nil {
+			return "", err
+		}
+		uc.Scope = strings.Join(permissions, " ")
+	}
+	if client == nil || auth.HasScope(scope, emailScope) {
+		uc.Email = user.Email
 	}
+	return a.newAccessJWT(ctx, client, uc)
+}
 
-	signer, err := jose.NewSigner(signKey, &opts)
+// newClientAccessToken signs a JWT for the client itself, its subject is the client ID
+func (a *API) newClientAccessToken(ctx context.Context, client *dao.Client, scope string) (string, error) {
+	claims, err := a.registeredClaims(client.ID, a.audience(client))
 	if err != nil {
 		return "", err
 	}
+	return a.newAccessJWT(ctx, client, auth.Claims{ClientID: client.ID, Scope: scope, Claims: claims})
+}
 
-	return jwt.Signed(signer).
-		Claims(claims).
-		CompactSerialize()
+// newAccessJWT signs the access token claims, then encrypts the JWT when the audience
+// of the client registered an encryption key
+func (a *API) newAccessJWT(ctx context.Context, client *dao.Client, claims auth.Claims) (string, error) {
+	signedJWT, err := a.newJWT(ctx, claims)
+	if err != nil {
+		return "", err
+	}
+	encryptionKey, err := a.audienceEncryptionKey(client)
+	if err != nil || encryptionKey == nil {
+		return signedJWT, err
+	}
+	token, err := auth.EncryptToken(signedJWT, encryptionKey)
+	if err != nil {
+		return "", err
+	}
+	if client != nil && client.Audience != "" {
+		// only the audience can decrypt it, we keep its claims to revoke and introspect it
+		if err := a.recordEncryptedToken(ctx, token, signedJWT, claims); err != nil {
+			return "", err
+		}
+	}
+	return token, nil
 }
 
-func parseJWT(signedJWT string, pubKey *rsa.PublicKey) (*userClaims, error) {
-	token, err := jwt.ParseSigned(signedJWT)
+// newIDToken signs an OpenID Connect ID token of the user for the client,
+// with the standard claims the scope releases
+func (a *API) newIDToken(ctx context.Context, user *dao.User, clientID, scope, nonce string) (string, error) {
+	claims, err := a.registeredClaims(strconv.Itoa(user.ID), jwt.Audience{clientID})
 	if err != nil {
-		return nil, errInvalidJWT
+		return "", err
+	}
+	idClaims := idTokenClaims{Nonce: nonce, Claims: claims}
+	if auth.HasScope(scope, emailScope) {
+		idClaims.Email = user.Email
 	}
+	if auth.HasScope(scope, profileScope) {
+		idClaims.Name = user.Name
+	}
+	return a.newJWT(ctx, idClaims)
+}
+
+// registeredClaims returns the RFC 7519 claims of a new token, valid from now for JWTExpiration
+func (a *API) registeredClaims(subject string, audience jwt.Audience) (jwt.Claims, error) {
+	jti, err := newJTI()
+	if err != nil {
+		return jwt.Claims{}, err
+	}
+	now := time.Now()
+	return jwt.Claims{
+		ID:        jti,
+		Issuer:    a.cfg.Issuer,
+		Subject:   subject,
+		Audience:  audience,
+		Expiry:    jwt.NewNumericDate(now.Add(JWTExpiration)),
+		NotBefore: jwt.NewNumericDate(now),
+		IssuedAt:  jwt.NewNumericDate(now),
+	}, nil
+}
+
+// newJTI returns a random unique token ID
+func newJTI() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate jti: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
 
-	claims := new(userClaims)
-	if err := token.Claims(pubKey, claims); err != nil {
-		return nil, errInvalidJWT
+// verifyJWT parses the signed JWT against the current key set and rejects revoked tokens,
+// an empty audience accepts tokens for any audience. Tokens encrypted to the API are decrypted first,
+// the ones encrypted to a client audience are checked from their record
+func (a *API) verifyJWT(ctx context.Context, token, audience string) (*auth.Claims, error) {
+	expected := jwt.Expected{Issuer: a.cfg.Issuer, Time: time.Now()}
+	if audience != "" {
+		expected.Audience = jwt.Audience{audience}
 	}
 
-	err = claims.Validate(jwt.Expected{
-		Issuer: jwtIssuer,
-		Time:   time.Now(),
-	})
+	var claims *auth.Claims
+	signedJWT, err := auth.DecryptToken(token, a.cfg.EncryptionKey)
+	switch {
+	case err == auth.ErrInvalidToken:
+		claims, err = a.encryptedTokenClaims(ctx, token, expected)
+	case err == nil:
+		var set *keySet
+		if set, err = a.keySet(ctx); err == nil {
+			claims, err = parseJWT(signedJWT, set.jwks, expected, a.cfg.Leeway)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := a.db.IsJTIRevoked(ctx, claims.ID)
 	if err != nil {
-		if err == jwt.ErrExpired {
-			return nil, errInvalidJWT
+		return nil, err
+	}
+	if revoked {
+		return nil, auth.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// parseJWT verifies the signed JWT against the key set, using the key referenced
+// by its `kid` header or trying every verifying key when the header is missing,
+// then validates the claims allowing leeway for clock skew
+func parseJWT(signedJWT string, jwks []*dao.JWK, expected jwt.Expected, leeway time.Duration) (*auth.Claims, error) {
+	token, err := jwt.ParseSigned(signedJWT)
+	if err != nil || len(token.Headers) != 1 {
+		return nil, auth.ErrInvalidToken
+	}
+
+	claims := new(auth.Claims)
+	verified := false
+	for _, jwk := range verificationKeys(jwks, token.Headers[0].KeyID) {
+		// never let the token choose how its signature is checked
+		if token.Headers[0].Algorithm != jwk.Algorithm {
+			continue
+		}
+		pubKey, err := jwk.GetPublicKey()
+		if err != nil {
+			return nil, err
 		}
+		if err := token.Claims(pubKey, claims); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, auth.ErrInvalidToken
+	}
 
-		return nil, errInvalidJWT
+	if err := claims.ValidateWithLeeway(expected, leeway); err != nil {
+		return nil, auth.ErrInvalidToken
 	}
 
 	return claims, nil
 }
+
+// signingKey returns the first active key, as they come ordered by expiration time
+func signingKey(jwks []*dao.JWK) *dao.JWK {
+	for _, jwk := range jwks {
+		if jwk.CanSign() {
+			return jwk
+		}
+	}
+	return nil
+}
+
+// verificationKeys returns the active and retiring keys matching kid, or all of them when kid is empty
+func verificationKeys(jwks []*dao.JWK, kid string) []*dao.JWK {
+	var keys []*dao.JWK
+	for _, jwk := range jwks {
+		if !jwk.CanVerify() {
+			continue
+		}
+		if kid != "" && jwk.KID != kid {
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return keys
+}
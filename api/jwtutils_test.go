@@ -0,0 +1,277 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose/v3"
+	"github.com/square/go-jose/v3/jwt"
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+	"github.com/yanpozka/airvet-jwt/signer"
+)
+
+// newTestJWK generates a key pair in state, its key ID is the thumbprint
+func newTestJWK(t *testing.T, state dao.KeyState) *dao.JWK {
+	t.Helper()
+
+	privateKey, publicKey, err := dao.GeneratePrivatePublicKeyPair(dao.DefaultRSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := &dao.JWK{PrivateKey: privateKey, PublicKey: publicKey, Algorithm: dao.AlgRS256, ExpiresAt: time.Now().Add(dao.JWKExpiration).Unix(), State: state}
+	if jwk.KID, err = jwk.Thumbprint(); err != nil {
+		t.Fatal(err)
+	}
+	return jwk
+}
+
+// newTestToken signs a JWT for email with the key
+func newTestToken(t *testing.T, jwk *dao.JWK, kid, email string) string {
+	t.Helper()
+
+	return signTestClaims(t, jwk, kid, auth.Claims{
+		Email: email,
+		Claims: jwt.Claims{
+			Issuer: testIssuer,
+			Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	})
+}
+
+// signTestClaims signs a JWT with the claims and the key
+func signTestClaims(t *testing.T, jwk *dao.JWK, kid string, claims auth.Claims) string {
+	t.Helper()
+
+	privateKey, err := jwk.GetPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(jwk.Algorithm),
+		Key:       jose.JSONWebKey{Key: privateKey, KeyID: kid},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// expectTestIssuer returns the claims expected now in the tokens of the test API
+func expectTestIssuer() jwt.Expected {
+	return jwt.Expected{Issuer: testIssuer, Time: time.Now()}
+}
+
+func TestParseJWTAfterRotation(t *testing.T) {
+	oldKey := newTestJWK(t, dao.KeyStateActive)
+	oldToken := newTestToken(t, oldKey, oldKey.KID, "old@airvet.test")
+
+	// the new key signs from now on, the old one only verifies while it's retiring
+	oldKey.State = dao.KeyStateRetiring
+	newKey := newTestJWK(t, dao.KeyStateActive)
+	newToken := newTestToken(t, newKey, newKey.KID, "new@airvet.test")
+	jwks := []*dao.JWK{newKey, oldKey}
+
+	tests := []struct {
+		name  string
+		token string
+		email string
+	}{
+		{name: "old key", token: oldToken, email: "old@airvet.test"},
+		{name: "new key", token: newToken, email: "new@airvet.test"},
+		{name: "old key without kid", token: newTestToken(t, oldKey, "", "nokid@airvet.test"), email: "nokid@airvet.test"},
+	}
+	for _, tt := range tests {
+		claims, err := parseJWT(tt.token, jwks, expectTestIssuer(), jwt.DefaultLeeway)
+		if err != nil {
+			t.Errorf("%s: got %v verifying the token", tt.name, err)
+			continue
+		}
+		if claims.Email != tt.email {
+			t.Errorf("%s: got email %q, want %q", tt.name, claims.Email, tt.email)
+		}
+	}
+}
+
+func TestParseJWTRevokedKey(t *testing.T) {
+	oldKey := newTestJWK(t, dao.KeyStateActive)
+	tokens := map[string]string{
+		"with kid":    newTestToken(t, oldKey, oldKey.KID, "old@airvet.test"),
+		"without kid": newTestToken(t, oldKey, "", "old@airvet.test"),
+	}
+
+	oldKey.State = dao.KeyStateRevoked
+	jwks := []*dao.JWK{newTestJWK(t, dao.KeyStateActive), oldKey}
+	for name, token := range tokens {
+		if _, err := parseJWT(token, jwks, expectTestIssuer(), jwt.DefaultLeeway); err != auth.ErrInvalidToken {
+			t.Errorf("%s: got %v verifying a token of a revoked key, want %v", name, err, auth.ErrInvalidToken)
+		}
+	}
+}
+
+func TestParseJWTOtherAlgorithm(t *testing.T) {
+	key := newTestJWK(t, dao.KeyStateActive)
+	jwks := []*dao.JWK{key}
+
+	// a valid signature of the key, but with an algorithm the key isn't for
+	forged := *key
+	forged.Algorithm = dao.AlgPS256
+	token := newTestToken(t, &forged, key.KID, "user@airvet.test")
+	if _, err := parseJWT(token, jwks, expectTestIssuer(), jwt.DefaultLeeway); err != auth.ErrInvalidToken {
+		t.Fatalf("got %v verifying a PS256 token of a RS256 key, want %v", err, auth.ErrInvalidToken)
+	}
+}
+
+func TestParseJWTAudienceAndLeeway(t *testing.T) {
+	key := newTestJWK(t, dao.KeyStateActive)
+	jwks := []*dao.JWK{key}
+	now := time.Now()
+	token := func(audience string, notBefore, expiry time.Time) string {
+		return signTestClaims(t, key, key.KID, auth.Claims{Claims: jwt.Claims{
+			Issuer:    testIssuer,
+			Subject:   "1",
+			Audience:  jwt.Audience{audience},
+			NotBefore: jwt.NewNumericDate(notBefore),
+			IssuedAt:  jwt.NewNumericDate(notBefore),
+			Expiry:    jwt.NewNumericDate(expiry),
+		}})
+	}
+	expected := expectTestIssuer()
+	expected.Audience = jwt.Audience{testIssuer}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "valid", token: token(testIssuer, now, now.Add(time.Hour)), valid: true},
+		{name: "other audience", token: token("https://clinic-api.test", now, now.Add(time.Hour))},
+		{name: "expired within the leeway", token: token(testIssuer, now.Add(-time.Hour), now.Add(-30*time.Second)), valid: true},
+		{name: "expired", token: token(testIssuer, now.Add(-time.Hour), now.Add(-2*time.Minute))},
+		{name: "not valid yet within the leeway", token: token(testIssuer, now.Add(30*time.Second), now.Add(time.Hour)), valid: true},
+		{name: "not valid yet", token: token(testIssuer, now.Add(2*time.Minute), now.Add(time.Hour))},
+	}
+	for _, tt := range tests {
+		_, err := parseJWT(tt.token, jwks, expected, time.Minute)
+		if tt.valid && err != nil {
+			t.Errorf("%s: got %v, want a valid token", tt.name, err)
+		}
+		if !tt.valid && err != auth.ErrInvalidToken {
+			t.Errorf("%s: got %v, want %v", tt.name, err, auth.ErrInvalidToken)
+		}
+	}
+
+	// without an expected audience any audience is fine
+	if _, err := parseJWT(token("https://clinic-api.test", now, now.Add(time.Hour)), jwks, expectTestIssuer(), time.Minute); err != nil {
+		t.Fatalf("got %v without an expected audience, want a valid token", err)
+	}
+}
+
+func TestSigningAlgorithms(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		alg string
+		kty string
+		crv string
+	}{
+		{alg: dao.AlgPS256, kty: "RSA"},
+		{alg: dao.AlgRS512, kty: "RSA"},
+		{alg: dao.AlgES256, kty: "EC", crv: "P-256"},
+		{alg: dao.AlgES384, kty: "EC", crv: "P-384"},
+		{alg: dao.AlgEdDSA, kty: "OKP", crv: "Ed25519"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alg, func(t *testing.T) {
+			a, d := newTestAPI(t)
+			jwk := activateTestKeyWithAlg(t, d, tt.alg)
+
+			token, err := a.newJWT(ctx, auth.Claims{Claims: jwt.Claims{
+				Issuer: testIssuer,
+				Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := jwt.ParseSigned(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header := parsed.Headers[0]; header.Algorithm != tt.alg || header.KeyID != jwk.KID {
+				t.Fatalf("got header %+v, want alg %s and kid %s", header, tt.alg, jwk.KID)
+			}
+			jwks, err := d.GetJWKS(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := parseJWT(token, jwks, expectTestIssuer(), jwt.DefaultLeeway); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := serve(a, http.MethodGet, jwksPath, "", "")
+			assertStatus(t, rec, http.StatusOK)
+			var out struct {
+				Keys []map[string]interface{} `json:"keys"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+				t.Fatal(err)
+			}
+			if len(out.Keys) != 1 {
+				t.Fatalf("got %d keys, want the active one", len(out.Keys))
+			}
+			key := out.Keys[0]
+			crv, _ := key["crv"].(string)
+			if key["kid"] != jwk.KID || key["alg"] != tt.alg || key["kty"] != tt.kty || crv != tt.crv || key["d"] != nil {
+				t.Fatalf("got key %v, want the %s %s public key", key, tt.kty, tt.crv)
+			}
+		})
+	}
+}
+
+func TestSigningWithExternalSigner(t *testing.T) {
+	ctx := context.Background()
+	_, d := newTestAPI(t)
+	fake := signer.NewFake()
+	keys := signer.NewKeyStore(d, fake)
+	a := NewAPI(d, keys, Config{Issuer: testIssuer, Signer: fake})
+
+	jwk, err := signer.NewJWK(ctx, fake, dao.KeySpec{Algorithm: dao.AlgES256}, time.Now().Add(dao.JWKExpiration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.InsertJWK(ctx, jwk); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.UpdateJWKState(ctx, jwk.KID, dao.KeyStateActive); err != nil {
+		t.Fatal(err)
+	}
+
+	claims := auth.Claims{Claims: jwt.Claims{Issuer: testIssuer, Expiry: jwt.NewNumericDate(time.Now().Add(time.Hour))}}
+	token, err := a.newJWT(ctx, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := d.GetJWKS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseJWT(token, jwks, expectTestIssuer(), jwt.DefaultLeeway); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Signatures() != 1 {
+		t.Fatalf("got %d signatures, want the token signed by the signer", fake.Signatures())
+	}
+
+	// no token is issued while the signer fails
+	fake.SetErr(errors.New("signer down"))
+	if _, err := a.newJWT(ctx, claims); err == nil {
+		t.Fatal("got a token while the signer is down, want an error")
+	}
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/square/go-jose/v3"
+	"github.com/yanpozka/airvet-jwt/dao"
+	"github.com/yanpozka/airvet-jwt/signer"
+)
+
+const (
+	// DefaultKeyCacheTTL is how long the key set is cached when Config.KeyCacheTTL is zero
+	DefaultKeyCacheTTL = time.Minute
+
+	// keyLoadRetryDelay is how long the expired key set is still used after the key store failed,
+	// so the requests don't all hit the failing store
+	keyLoadRetryDelay = 5 * time.Second
+
+	// keyLoadTimeout bounds a key set load, it isn't bound to the request starting it
+	keyLoadTimeout = 10 * time.Second
+)
+
+// keySet is a snapshot of the key store with the public keys parsed and the private key
+// of the active key parsed, it's read only so it's shared by concurrent requests
+type keySet struct {
+	// jwks are the keys whose public key could be parsed, ordered by expiration time
+	jwks []*dao.JWK
+	// signingKey is the active key, nil when there is none
+	signingKey *dao.JWK
+	// signer signs with the active key, signerErr is why it couldn't be built
+	signer    crypto.Signer
+	signerErr error
+
+	// jwksDocument is the JWKS served to relying parties, with the signing
+	// and the encryption keys, and jwksETag its strong ETag
+	jwksDocument []byte
+	jwksETag     string
+}
+
+// keyCache keeps the key set in memory, it's loaded again when it expires or is invalidated
+type keyCache struct {
+	// mu guards the cache, it's never held while the key store is read
+	mu        sync.Mutex
+	set       *keySet
+	expiresAt time.Time
+	// generation changes on every invalidation, a load started before it doesn't renew the cache
+	generation int
+	// loading is the load in progress, nil when there is none
+	loading *keyLoad
+}
+
+// keyLoad is a key set load shared by the requests waiting for it, done is closed once set or err is set
+type keyLoad struct {
+	done chan struct{}
+	set  *keySet
+	err  error
+}
+
+// InvalidateKeys drops the cached key set, the next request loads it again.
+// It's called when the keys rotate
+func (a *API) InvalidateKeys() {
+	a.keyCache.mu.Lock()
+	defer a.keyCache.mu.Unlock()
+
+	a.keyCache.expiresAt = time.Time{}
+	a.keyCache.generation++
+}
+
+// keySet returns the cached key set, loading it when it expired. Only one request loads it
+// at a time, the others wait for it. The expired one is still used when the key store fails,
+// so a database hiccup doesn't stop the tokens
+func (a *API) keySet(ctx context.Context) (*keySet, error) {
+	c := &a.keyCache
+
+	c.mu.Lock()
+	if c.set != nil && time.Now().Before(c.expiresAt) {
+		set := c.set
+		c.mu.Unlock()
+		return set, nil
+	}
+	l := c.loading
+	if l == nil {
+		l = a.startKeyLoad()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return l.set, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// startKeyLoad loads the key set in the background, with its own timeout as the requests
+// waiting for it may be cancelled. a.keyCache.mu must be held
+func (a *API) startKeyLoad() *keyLoad {
+	c := &a.keyCache
+	l := &keyLoad{done: make(chan struct{})}
+	c.loading = l
+	generation := c.generation
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), keyLoadTimeout)
+		defer cancel()
+		set, err := a.loadKeySet(ctx)
+
+		c.mu.Lock()
+		c.loading = nil
+		now := time.Now()
+		switch {
+		case err == nil:
+			c.set, l.set = set, set
+			if c.generation == generation {
+				c.expiresAt = now.Add(a.cfg.KeyCacheTTL)
+			}
+		case c.set != nil:
+			log.Printf("Error loading the key set, using the cached keys: %v", err)
+			l.set = c.set
+			retryDelay := keyLoadRetryDelay
+			if a.cfg.KeyCacheTTL < retryDelay {
+				retryDelay = a.cfg.KeyCacheTTL
+			}
+			if c.generation == generation {
+				c.expiresAt = now.Add(retryDelay)
+			}
+		default:
+			l.err = err
+		}
+		c.mu.Unlock()
+		close(l.done)
+	}()
+	return l
+}
+
+// loadKeySet reads the key store and prepares the keys, the keys that can't be parsed are skipped
+func (a *API) loadKeySet(ctx context.Context) (*keySet, error) {
+	jwks, err := a.keys.GetJWKS(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &keySet{}
+	for _, jwk := range jwks {
+		if _, err := jwk.GetPublicKey(); err != nil {
+			log.Printf("Skipping JWK: %v", err)
+			continue
+		}
+		set.jwks = append(set.jwks, jwk)
+	}
+
+	if set.jwksDocument, set.jwksETag, err = newJWKSDocument(set.jwks, a.cfg.EncryptionKey); err != nil {
+		return nil, err
+	}
+
+	set.signingKey = signingKey(set.jwks)
+	if set.signingKey != nil {
+		// the private key may be held by an external signer
+		set.signer, set.signerErr = signer.ForJWK(ctx, a.cfg.Signer, set.signingKey)
+		if set.signerErr != nil {
+			log.Printf("Error building the signer of the active JWK: %v", set.signerErr)
+		}
+	}
+	return set, nil
+}
+
+// newSigner builds the JWS signer of the active key, signing with the context of the request
+func (a *API) newSigner(ctx context.Context, set *keySet) (jose.Signer, error) {
+	opts := jose.SignerOptions{}
+	opts.WithType("JWT")
+	opts.WithHeader("jku", a.endpointURL(jwksPath))
+
+	jwk := set.signingKey
+	signKey := jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(jwk.Algorithm),
+		// the key ID will be set as `kid` header
+		Key: signer.NewOpaqueSigner(jwk.KID, jwk.Algorithm, signer.WithContext(ctx, set.signer)),
+	}
+	return jose.NewSigner(signKey, &opts)
+}
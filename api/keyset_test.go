@@ -0,0 +1,295 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+// testKeyStore is an in-memory key store whose listings can fail or be held, it counts them
+type testKeyStore struct {
+	*dao.MemoryKeyStore
+
+	mu    sync.Mutex
+	fail  bool
+	hold  chan struct{}
+	loads int
+}
+
+func (s *testKeyStore) GetJWKS(ctx context.Context) ([]*dao.JWK, error) {
+	s.mu.Lock()
+	s.loads++
+	fail, hold := s.fail, s.hold
+	s.mu.Unlock()
+
+	if hold != nil {
+		<-hold
+	}
+	if fail {
+		return nil, errors.New("key store unavailable")
+	}
+	return s.MemoryKeyStore.GetJWKS(ctx)
+}
+
+func (s *testKeyStore) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fail = fail
+}
+
+// holdLoads makes the listings wait until the returned function is called
+func (s *testKeyStore) holdLoads() func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hold := make(chan struct{})
+	s.hold = hold
+	return func() {
+		s.mu.Lock()
+		s.hold = nil
+		s.mu.Unlock()
+		close(hold)
+	}
+}
+
+func (s *testKeyStore) loadCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.loads
+}
+
+// newTestAPIWithKeys returns an API signing with an active alg key of the key store
+func newTestAPIWithKeys(t testing.TB, keys dao.KeyStore, alg string) *API {
+	t.Helper()
+
+	_, d := newTestAPI(t)
+	activateTestKeyWithAlg(t, keys, alg)
+	return NewAPI(d, keys, Config{Issuer: testIssuer})
+}
+
+func TestKeySetCached(t *testing.T) {
+	ctx := context.Background()
+	keys := &testKeyStore{MemoryKeyStore: dao.NewMemoryKeyStore()}
+	a := newTestAPIWithKeys(t, keys, dao.AlgES256)
+
+	cached, err := a.keySet(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set, err := a.keySet(ctx); err != nil || set != cached || keys.loadCount() != 1 {
+		t.Fatalf("got %v after %d loads, want the cached key set", err, keys.loadCount())
+	}
+
+	// a rotation is picked up right away
+	next := activateTestKeyWithAlg(t, keys, dao.AlgES256)
+	a.InvalidateKeys()
+	set, err := a.keySet(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.signingKey == nil || set.signingKey.KID != next.KID {
+		t.Fatalf("got signing key %+v, want %s", set.signingKey, next.KID)
+	}
+}
+
+func TestKeySetSingleFlight(t *testing.T) {
+	ctx := context.Background()
+	keys := &testKeyStore{MemoryKeyStore: dao.NewMemoryKeyStore()}
+	a := newTestAPIWithKeys(t, keys, dao.AlgES256)
+	release := keys.holdLoads()
+
+	const requests = 10
+	var wg sync.WaitGroup
+	sets := make(chan *keySet, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			set, err := a.keySet(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+			sets <- set
+		}()
+	}
+
+	// the cache isn't locked while the key store is read
+	for keys.loadCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	invalidated := make(chan struct{})
+	go func() {
+		a.InvalidateKeys()
+		close(invalidated)
+	}()
+	select {
+	case <-invalidated:
+	case <-time.After(time.Second):
+		t.Fatal("invalidating the keys blocked during a load")
+	}
+
+	// a waiting request can give up, the load goes on
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := a.keySet(cancelled); err != context.Canceled {
+		t.Fatalf("got %v for a cancelled request, want %v", err, context.Canceled)
+	}
+
+	release()
+	wg.Wait()
+	close(sets)
+	var first *keySet
+	for set := range sets {
+		if first == nil {
+			first = set
+		}
+		if set == nil || set != first {
+			t.Fatal("got different key sets, want the one load shared")
+		}
+	}
+	if keys.loadCount() != 1 {
+		t.Fatalf("got %d loads, want the concurrent requests sharing one", keys.loadCount())
+	}
+
+	// the keys were invalidated during the load, they're loaded again
+	if _, err := a.keySet(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys.loadCount() != 2 {
+		t.Fatalf("got %d loads, want the key set loaded again after the invalidation", keys.loadCount())
+	}
+}
+
+func TestKeySetRetryDelay(t *testing.T) {
+	ctx := context.Background()
+	keys := &testKeyStore{MemoryKeyStore: dao.NewMemoryKeyStore()}
+	a := newTestAPIWithKeys(t, keys, dao.AlgES256)
+
+	keys.setFail(true)
+	if _, err := a.keySet(ctx); err == nil {
+		t.Fatal("got a key set from a failing key store without a cached one, want an error")
+	}
+	keys.setFail(false)
+	cached, err := a.keySet(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.setFail(true)
+	a.InvalidateKeys()
+	loads := keys.loadCount()
+
+	for i := 0; i < 3; i++ {
+		set, err := a.keySet(ctx)
+		if err != nil {
+			t.Fatalf("got %v while the key store is down, want the cached keys", err)
+		}
+		if set != cached {
+			t.Fatal("got another key set while the key store is down, want the cached one")
+		}
+	}
+	if got := keys.loadCount() - loads; got != 1 {
+		t.Fatalf("got %d key store loads, want 1 until the retry delay passes", got)
+	}
+
+	// the retry delay passed and the key store is back
+	keys.setFail(false)
+	a.keyCache.mu.Lock()
+	a.keyCache.expiresAt = time.Now().Add(-time.Second)
+	a.keyCache.mu.Unlock()
+	set, err := a.keySet(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set == cached {
+		t.Fatal("got the stale key set after the retry delay, want it loaded again")
+	}
+	if got := keys.loadCount() - loads; got != 2 {
+		t.Fatalf("got %d key store loads, want 2 after the retry delay", got)
+	}
+}
+
+// benchmarkRoute serves the requests in parallel signing with RS256 and ES256 keys. Without the
+// key cache the key set is loaded on every request, like before it was cached
+func benchmarkRoute(b *testing.B, newRequest func(a *API) func() *http.Request) {
+	log.SetOutput(ioutil.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for _, alg := range []string{dao.AlgRS256, dao.AlgES256} {
+		for _, cached := range []bool{false, true} {
+			name := alg + "/uncached"
+			if cached {
+				name = alg + "/cached"
+			}
+
+			b.Run(name, func(b *testing.B) {
+				a := newTestAPIWithKeys(b, dao.NewMemoryKeyStore(), alg)
+				routes := a.GetRoutes()
+				next := newRequest(a)
+
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if !cached {
+							a.InvalidateKeys()
+						}
+						rec := httptest.NewRecorder()
+						routes.ServeHTTP(rec, next())
+						if rec.Code != http.StatusOK {
+							b.Errorf("got status %d: %s", rec.Code, rec.Body)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+func BenchmarkAuth(b *testing.B) {
+	benchmarkRoute(b, func(a *API) func() *http.Request {
+		const password = "Bench-passwd1"
+		u := insertTestUser(b, a.db, "vet@airvet.test", password)
+		body := fmt.Sprintf(`{ "email": %q, "password": %q }`, u.Email, password)
+
+		return func() *http.Request {
+			return httptest.NewRequest(http.MethodPost, authPath, strings.NewReader(body))
+		}
+	})
+}
+
+func BenchmarkUser(b *testing.B) {
+	benchmarkRoute(b, func(a *API) func() *http.Request {
+		u := insertTestUser(b, a.db, "vet@airvet.test", "Bench-passwd1")
+		token, err := a.newAccessToken(context.Background(), u, nil, "")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		return func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, userPath, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			return req
+		}
+	})
+}
+
+func BenchmarkJWKS(b *testing.B) {
+	benchmarkRoute(b, func(a *API) func() *http.Request {
+		return func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, jwksPath, nil)
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Sign in</title>
+</head>
+<body>
+	<h1>Sign in to {{.ClientName}}</h1>
+	{{with .Error}}<p role="alert">{{.}}</p>{{end}}
+	<form method="post" action="{{.Action}}">
+		<label>Email <input type="email" name="email" value="{{.Email}}" required autofocus></label>
+		<label>Password <input type="password" name="password" required></label>
+		{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+		{{end}}
+		<button type="submit">Sign in</button>
+	</form>
+</body>
+</html>
+`))
+
+type loginPage struct {
+	ClientName string
+	Action     string
+	Email      string
+	Error      string
+	// Params are the authorization request parameters, posted back with the credentials
+	Params map[string]string
+}
+
+func renderLoginPage(w http.ResponseWriter, status int, page *loginPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// the credentials must be typed in our page, never in a frame of another site
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+	if err := loginTemplate.Execute(w, page); err != nil {
+		log.Printf("Error rendering login page: %v", err)
+	}
+}
+
+// renderErrorPage is used when we can't redirect back to the client
+func renderErrorPage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, message, status)
+}
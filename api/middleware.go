@@ -0,0 +1,12 @@
+package api
+
+import (
+	"context"
+
+	"github.com/yanpozka/airvet-jwt/auth"
+)
+
+// VerifyToken implements auth.TokenVerifier, accepting the tokens for the API audience
+func (a *API) VerifyToken(ctx context.Context, token string) (*auth.Claims, error) {
+	return a.verifyJWT(ctx, token, a.cfg.Audience)
+}
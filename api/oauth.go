@@ -0,0 +1,384 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+// authCodeExpiration defines how long an authorization code can be exchanged
+const authCodeExpiration = 2 * time.Minute
+
+const (
+	grantAuthorizationCode = "authorization_code"
+	grantRefreshToken      = "refresh_token"
+	grantClientCredentials = "client_credentials"
+
+	pkceMethodS256 = "S256"
+	openIDScope    = "openid"
+	// the OpenID Connect scopes releasing the standard claims of the user
+	emailScope   = "email"
+	profileScope = "profile"
+	addressScope = "address"
+)
+
+// supportedScopes are the scopes clients can request
+var supportedScopes = []string{openIDScope, emailScope, profileScope, addressScope}
+
+// RFC 7636 section 4.1: 43 to 128 characters of [A-Z] / [a-z] / [0-9] / "-" / "." / "_" / "~"
+var codeVerifierRegexp = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// oauthTokenOut is the RFC 6749 access token response
+type oauthTokenOut struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// authorizeRequest holds the parameters of an authorization request
+type authorizeRequest struct {
+	client *dao.Client
+
+	responseType        string
+	redirectURI         string
+	scope               string
+	state               string
+	codeChallenge       string
+	codeChallengeMethod string
+	nonce               string
+}
+
+// authorize shows the login page of the authorization code flow (GET) and,
+// once the user signs in (POST), redirects back to the client with a code
+func (a *API) authorize(w http.ResponseWriter, req *http.Request) {
+	ar, ok := a.readAuthorizeRequest(w, req)
+	if !ok {
+		return
+	}
+
+	page := &loginPage{
+		ClientName: ar.client.Name,
+		Action:     authorizePath,
+		Params:     ar.params(),
+	}
+	if req.Method == http.MethodGet {
+		renderLoginPage(w, http.StatusOK, page)
+		return
+	}
+
+	page.Email = req.PostFormValue("email")
+	user, err := a.db.GetUserByEmailPasswd(req.Context(), page.Email, req.PostFormValue("password"))
+	if err == dao.ErrUserNotFound {
+		page.Error = "Wrong email or password"
+		renderLoginPage(w, http.StatusUnauthorized, page)
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting user from db: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	code, err := a.db.IssueAuthCode(req.Context(), &dao.AuthCode{
+		ClientID:      ar.client.ID,
+		UserID:        user.ID,
+		RedirectURI:   ar.redirectURI,
+		CodeChallenge: ar.codeChallenge,
+		Scope:         ar.scope,
+		Nonce:         ar.nonce,
+		ExpiresAt:     time.Now().Add(authCodeExpiration).Unix(),
+	})
+	if err != nil {
+		log.Printf("Error issuing auth code: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	a.redirectToClient(w, req, ar, url.Values{"code": {code}})
+}
+
+// readAuthorizeRequest validates the authorization request, the client and redirect URI
+// errors are shown to the user, the rest are sent back to the client
+func (a *API) readAuthorizeRequest(w http.ResponseWriter, req *http.Request) (*authorizeRequest, bool) {
+	ar := &authorizeRequest{
+		responseType:        req.FormValue("response_type"),
+		redirectURI:         req.FormValue("redirect_uri"),
+		scope:               req.FormValue("scope"),
+		state:               req.FormValue("state"),
+		codeChallenge:       req.FormValue("code_challenge"),
+		codeChallengeMethod: req.FormValue("code_challenge_method"),
+		nonce:               req.FormValue("nonce"),
+	}
+
+	client, err := a.db.GetClient(req.Context(), req.FormValue("client_id"))
+	if err == dao.ErrClientNotFound {
+		renderErrorPage(w, http.StatusBadRequest, "Unknown client")
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error getting client from db: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, false
+	}
+	ar.client = client
+
+	// never redirect to an URI the client didn't register
+	if !client.HasRedirectURI(ar.redirectURI) {
+		renderErrorPage(w, http.StatusBadRequest, "Invalid redirect_uri")
+		return nil, false
+	}
+
+	switch {
+	case ar.responseType != "code":
+		a.redirectError(w, req, ar, "unsupported_response_type", "only the code response type is supported")
+	case ar.codeChallenge == "" || ar.codeChallengeMethod != pkceMethodS256:
+		a.redirectError(w, req, ar, "invalid_request", "PKCE with the S256 code challenge method is required")
+	case !scopesSupported(ar.scope):
+		a.redirectError(w, req, ar, "invalid_scope", "the scope is not supported")
+	default:
+		return ar, true
+	}
+	return nil, false
+}
+
+// params returns the request parameters to post back from the login page
+func (ar *authorizeRequest) params() map[string]string {
+	return map[string]string{
+		"client_id":             ar.client.ID,
+		"response_type":         ar.responseType,
+		"redirect_uri":          ar.redirectURI,
+		"scope":                 ar.scope,
+		"state":                 ar.state,
+		"code_challenge":        ar.codeChallenge,
+		"code_challenge_method": ar.codeChallengeMethod,
+		"nonce":                 ar.nonce,
+	}
+}
+
+func (a *API) redirectError(w http.ResponseWriter, req *http.Request, ar *authorizeRequest, code, description string) {
+	a.redirectToClient(w, req, ar, url.Values{"error": {code}, "error_description": {description}})
+}
+
+// redirectToClient sends the user back to the client with the response parameters,
+// the state and the issuer (RFC 9207) are always added
+func (a *API) redirectToClient(w http.ResponseWriter, req *http.Request, ar *authorizeRequest, params url.Values) {
+	u, err := url.Parse(ar.redirectURI)
+	if err != nil {
+		renderErrorPage(w, http.StatusBadRequest, "Invalid redirect_uri")
+		return
+	}
+	q := u.Query()
+	for name, values := range params {
+		q[name] = values
+	}
+	if ar.state != "" {
+		q.Set("state", ar.state)
+	}
+	q.Set("iss", a.cfg.Issuer)
+	u.RawQuery = q.Encode()
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, req, u.String(), http.StatusFound)
+}
+
+// token is the OAuth 2.0 token endpoint
+func (a *API) token(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	client, err := a.tokenClient(req)
+	if err == dao.ErrInvalidClient {
+		writeInvalidClient(w)
+		return
+	}
+	if err != nil {
+		log.Printf("Error authenticating client: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.PostFormValue("grant_type") {
+	case grantAuthorizationCode:
+		a.authorizationCodeGrant(w, req, client)
+	case grantRefreshToken:
+		a.refreshTokenGrant(w, req, client)
+	case grantClientCredentials:
+		a.clientCredentialsGrant(w, req, client)
+	default:
+		auth.WriteError(w, http.StatusBadRequest, "unsupported_grant_type", "the grant type is not supported")
+	}
+}
+
+func (a *API) authorizationCodeGrant(w http.ResponseWriter, req *http.Request, client *dao.Client) {
+	ac, err := a.db.ConsumeAuthCode(req.Context(), req.PostFormValue("code"))
+	if err == dao.ErrInvalidAuthCode {
+		auth.WriteError(w, http.StatusBadRequest, "invalid_grant", "the code is invalid, expired or already used")
+		return
+	}
+	if err != nil {
+		log.Printf("Error consuming auth code: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if ac.ClientID != client.ID || ac.RedirectURI != req.PostFormValue("redirect_uri") {
+		auth.WriteError(w, http.StatusBadRequest, "invalid_grant", "the code was issued to another client or redirect_uri")
+		return
+	}
+	if !verifyPKCE(req.PostFormValue("code_verifier"), ac.CodeChallenge) {
+		auth.WriteError(w, http.StatusBadRequest, "invalid_grant", "the code_verifier doesn't match the code_challenge")
+		return
+	}
+
+	user, err := a.db.GetUserByID(req.Context(), ac.UserID)
+	if err == dao.ErrUserNotFound {
+		auth.WriteError(w, http.StatusBadRequest, "invalid_grant", "the user doesn't exist anymore")
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting user from db: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	grant := &dao.RefreshToken{UserID: user.ID, ClientID: client.ID, Scope: ac.Scope}
+	refreshToken, err := a.db.IssueRefreshToken(req.Context(), grant, time.Now().Add(RefreshTokenExpiration))
+	if err != nil {
+		log.Printf("Error generating refresh token: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	a.writeTokens(w, req, user, client, ac.Scope, ac.Nonce, refreshToken)
+}
+
+func (a *API) refreshTokenGrant(w http.ResponseWriter, req *http.Request, client *dao.Client) {
+	refreshToken, rt, err := a.db.RotateRefreshToken(req.Context(), req.PostFormValue("refresh_token"), client.ID,
+		time.Now().Add(RefreshTokenExpiration))
+	switch {
+	case err == dao.ErrRefreshTokenReused:
+		log.Printf("Refresh token of client %q reused, revoked its family", client.ID)
+		auth.WriteError(w, http.StatusBadRequest, "invalid_grant", "the refresh token was already used")
+		return
+	case err == dao.ErrInvalidRefreshToken:
+		auth.WriteError(w, http.StatusBadRequest, "invalid_grant", "the refresh token is invalid or expired")
+		return
+	case err != nil:
+		log.Printf("Error rotating refresh token: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := a.db.GetUserByID(req.Context(), rt.UserID)
+	if err == dao.ErrUserNotFound {
+		auth.WriteError(w, http.StatusBadRequest, "invalid_grant", "the user doesn't exist anymore")
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting user from db: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// ID tokens are only issued on login
+	a.writeTokens(w, req, user, client, rt.Scope, "", refreshToken)
+}
+
+// clientCredentialsGrant issues an access token for the client itself, limited to its allowed scopes,
+// no refresh token is needed as the client can always authenticate again
+func (a *API) clientCredentialsGrant(w http.ResponseWriter, req *http.Request, client *dao.Client) {
+	if client.IsPublic() {
+		auth.WriteError(w, http.StatusBadRequest, "unauthorized_client", "public clients can't use the client_credentials grant")
+		return
+	}
+
+	scope := req.PostFormValue("scope")
+	if scope == "" {
+		scope = strings.Join(client.Scopes, " ")
+	}
+	if !client.AllowsScope(scope) {
+		auth.WriteError(w, http.StatusBadRequest, "invalid_scope", "the scope isn't allowed to the client")
+		return
+	}
+
+	accessToken, err := a.newClientAccessToken(req.Context(), client, scope)
+	if err != nil {
+		log.Printf("Error generating jwt: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, oauthTokenOut{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(JWTExpiration / time.Second),
+		Scope:       scope,
+	})
+}
+
+// writeTokens signs the access token, and the ID token for the openid scope, of the user
+func (a *API) writeTokens(w http.ResponseWriter, req *http.Request, user *dao.User, client *dao.Client, scope, nonce, refreshToken string) {
+	accessToken, err := a.newAccessToken(req.Context(), user, client, scope)
+	if err != nil {
+		log.Printf("Error generating jwt: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	out := oauthTokenOut{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(JWTExpiration / time.Second),
+		RefreshToken: refreshToken,
+		Scope:        scope,
+	}
+	if auth.HasScope(scope, openIDScope) {
+		if out.IDToken, err = a.newIDToken(req.Context(), user, client.ID, scope, nonce); err != nil {
+			log.Printf("Error generating id token: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// verifyPKCE checks the S256 code challenge: BASE64URL(SHA256(code_verifier))
+func verifyPKCE(verifier, challenge string) bool {
+	if !codeVerifierRegexp.MatchString(verifier) {
+		return false
+	}
+	h := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(h[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// scopesSupported reports whether every requested scope is one of the supported scopes
+func scopesSupported(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		if !containsString(supportedScopes, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
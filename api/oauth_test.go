@@ -0,0 +1,317 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/square/go-jose/v3/jwt"
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+const (
+	testRedirectURI  = "http://localhost:3000/callback"
+	testCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// newOAuthTestAPI returns an API with an active key, a user, the confidential
+// clinic-integration client and the public clinic-app client
+func newOAuthTestAPI(t *testing.T) (*API, *dao.DAO, *dao.User) {
+	t.Helper()
+
+	a, d := newTestAPI(t)
+	activateTestKey(t, d)
+	user := insertTestUser(t, d, "owner@example.com", "Dog-and-cat-1")
+	insertTestClient(t, d, &dao.Client{ID: "clinic-integration", Name: "Clinic Integration", RedirectURIs: []string{testRedirectURI}}, "Clinic-secret")
+	insertTestClient(t, d, &dao.Client{ID: "clinic-app", Name: "Clinic App", RedirectURIs: []string{testRedirectURI}}, "")
+	return a, d, user
+}
+
+// authorizeParams returns the parameters of an authorization request with PKCE
+func authorizeParams(clientID, scope string) url.Values {
+	h := sha256.Sum256([]byte(testCodeVerifier))
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientID},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(h[:])},
+		"code_challenge_method": {pkceMethodS256},
+	}
+}
+
+// signIn posts the credentials to the login page and returns the redirection to the client
+func signIn(t *testing.T, a *API, params url.Values) url.Values {
+	t.Helper()
+
+	form := url.Values{"email": {"owner@example.com"}, "password": {"Dog-and-cat-1"}}
+	for name, values := range params {
+		form[name] = values
+	}
+	rec := serveForm(a, authorizePath, "", "", form)
+	assertStatus(t, rec, http.StatusFound)
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), testRedirectURI+"?") {
+		t.Fatalf("got redirection to %s, want %s", location, testRedirectURI)
+	}
+	q := location.Query()
+	if q.Get("state") != "xyz" || q.Get("iss") != testIssuer {
+		t.Fatalf("got redirection to %s, want the state and the issuer", location)
+	}
+	return q
+}
+
+// exchangeCode posts the authorization code to the token endpoint
+func exchangeCode(a *API, clientID, secret, code, verifier string) (int, *oauthTokenOut) {
+	form := url.Values{
+		"grant_type":    {grantAuthorizationCode},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}
+	if secret == "" {
+		form.Set("client_id", clientID)
+		clientID = ""
+	}
+	rec := serveForm(a, tokenPath, clientID, secret, form)
+	out := new(oauthTokenOut)
+	json.Unmarshal(rec.Body.Bytes(), out)
+	return rec.Code, out
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	a, d, user := newOAuthTestAPI(t)
+
+	authorizeURL := authorizePath + "?" + authorizeParams("clinic-integration", "openid email").Encode()
+	rec := serve(a, http.MethodGet, authorizeURL, "", "")
+	assertStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), "Clinic Integration") {
+		t.Fatal("got a login page without the client name")
+	}
+
+	code := signIn(t, a, authorizeParams("clinic-integration", "openid email")).Get("code")
+	status, out := exchangeCode(a, "clinic-integration", "Clinic-secret", code, testCodeVerifier)
+	if status != http.StatusOK || out.AccessToken == "" || out.RefreshToken == "" || out.IDToken == "" || out.Scope != "openid email" {
+		t.Fatalf("got status %d and tokens %+v, want an access, refresh and ID token", status, out)
+	}
+
+	jwks, err := d.GetJWKS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseJWT(out.AccessToken, jwks, expectTestIssuer(), jwt.DefaultLeeway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.ClientID != "clinic-integration" || claims.Subject != strconv.Itoa(user.ID) || claims.Email != user.Email {
+		t.Fatalf("got access token claims %+v, want the client, the user and the email of the email scope", claims)
+	}
+	idToken, err := jwt.ParseSigned(out.IDToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idClaims := new(idTokenClaims)
+	if err := idToken.UnsafeClaimsWithoutVerification(idClaims); err != nil {
+		t.Fatal(err)
+	}
+	if idClaims.Nonce != "n-0S6" || !idClaims.Audience.Contains("clinic-integration") || idClaims.Email != user.Email || idClaims.Name != "" {
+		t.Fatalf("got ID token claims %+v, want the nonce, the client audience and only the email", idClaims)
+	}
+
+	// codes can only be used once
+	if status, _ := exchangeCode(a, "clinic-integration", "Clinic-secret", code, testCodeVerifier); status != http.StatusBadRequest {
+		t.Fatalf("got status %d reusing the code, want 400", status)
+	}
+
+	// the refresh token is bound to the client
+	form := url.Values{"grant_type": {grantRefreshToken}, "refresh_token": {out.RefreshToken}}
+	assertStatus(t, serveForm(a, tokenPath, "clinic-integration", "Clinic-secret", form), http.StatusOK)
+}
+
+func TestAuthorizationCodePKCE(t *testing.T) {
+	a, d, _ := newOAuthTestAPI(t)
+
+	tests := []struct {
+		name     string
+		clientID string
+		secret   string
+		verifier string
+		status   int
+	}{
+		{name: "public client", clientID: "clinic-app", verifier: testCodeVerifier, status: http.StatusOK},
+		{name: "wrong verifier", clientID: "clinic-app", verifier: strings.Repeat("a", 43), status: http.StatusBadRequest},
+		{name: "short verifier", clientID: "clinic-app", verifier: "short", status: http.StatusBadRequest},
+		{name: "missing verifier", clientID: "clinic-app", status: http.StatusBadRequest},
+		{name: "confidential client without secret", clientID: "clinic-integration", verifier: testCodeVerifier, status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := signIn(t, a, authorizeParams(tt.clientID, "openid")).Get("code")
+			status, out := exchangeCode(a, tt.clientID, tt.secret, code, tt.verifier)
+			if status != tt.status {
+				t.Fatalf("got status %d, want %d", status, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			jwks, err := d.GetJWKS(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := parseJWT(out.AccessToken, jwks, expectTestIssuer(), jwt.DefaultLeeway)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Email != "" {
+				t.Fatalf("got email %q in a token without the email scope", claims.Email)
+			}
+		})
+	}
+
+	// a failed exchange still uses the code up
+	code := signIn(t, a, authorizeParams("clinic-app", "openid")).Get("code")
+	if status, _ := exchangeCode(a, "clinic-app", "", code, "short"); status != http.StatusBadRequest {
+		t.Fatalf("got status %d with the wrong verifier, want 400", status)
+	}
+	if status, _ := exchangeCode(a, "clinic-app", "", code, testCodeVerifier); status != http.StatusBadRequest {
+		t.Fatalf("got status %d with a code used by a failed exchange, want 400", status)
+	}
+}
+
+func TestAuthorizeRequestErrors(t *testing.T) {
+	a, _, _ := newOAuthTestAPI(t)
+
+	// errors about the client or the redirect URI are never redirected
+	for name, params := range map[string]url.Values{
+		"unknown client": authorizeParams("nobody", "openid"),
+		"unregistered redirect": func() url.Values {
+			p := authorizeParams("clinic-app", "openid")
+			p.Set("redirect_uri", "https://attacker.test/callback")
+			return p
+		}(),
+	} {
+		rec := serve(a, http.MethodGet, authorizePath+"?"+params.Encode(), "", "")
+		if rec.Code != http.StatusBadRequest || rec.Header().Get("Location") != "" {
+			t.Errorf("%s: got status %d redirecting to %q, want 400 without redirection", name, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+
+	for name, tt := range map[string]struct {
+		param, value, error string
+	}{
+		"no PKCE":       {param: "code_challenge_method", value: "plain", error: "invalid_request"},
+		"unknown scope": {param: "scope", value: "openid admin", error: "invalid_scope"},
+		"implicit flow": {param: "response_type", value: "token", error: "unsupported_response_type"},
+	} {
+		params := authorizeParams("clinic-app", "openid")
+		params.Set(tt.param, tt.value)
+		rec := serve(a, http.MethodGet, authorizePath+"?"+params.Encode(), "", "")
+		assertStatus(t, rec, http.StatusFound)
+		location, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := location.Query().Get("error"); got != tt.error {
+			t.Errorf("%s: got error %q, want %q", name, got, tt.error)
+		}
+	}
+}
+
+func TestUserinfoClaimsByScope(t *testing.T) {
+	user := &dao.User{ID: 7, Email: "vet@airvet.com", Name: "Vet", Location: "Clinic"}
+
+	tests := []struct {
+		name   string
+		claims *auth.Claims
+		want   string
+	}{
+		{
+			name:   "openid only",
+			claims: &auth.Claims{ClientID: "clinic-integration", Scope: "openid"},
+			want:   `{"sub":"7"}`,
+		},
+		{
+			name:   "email",
+			claims: &auth.Claims{ClientID: "clinic-integration", Scope: "openid email"},
+			want:   `{"sub":"7","email":"vet@airvet.com"}`,
+		},
+		{
+			name:   "profile and address",
+			claims: &auth.Claims{ClientID: "clinic-integration", Scope: "openid profile address"},
+			want:   `{"sub":"7","name":"Vet","address":{"formatted":"Clinic"}}`,
+		},
+		{
+			name:   "first party",
+			claims: &auth.Claims{},
+			want:   `{"sub":"7","email":"vet@airvet.com","name":"Vet","address":{"formatted":"Clinic"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(newUserinfoOut(user, userinfoScope(tt.claims)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessTokenAudience(t *testing.T) {
+	a, d, user := newOAuthTestAPI(t)
+	insertTestClient(t, d, &dao.Client{ID: "clinic-api-client", RedirectURIs: []string{testRedirectURI}, Audience: "https://clinic-api.test"}, "Api-secret")
+	jwks, err := d.GetJWKS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	getUser := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, userPath, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return serveRequest(a, req).Code
+	}
+
+	// first party tokens are for the API
+	tokens := login(t, a, "owner@example.com", "Dog-and-cat-1")
+	claims, err := parseJWT(tokens.JWT, jwks, expectTestIssuer(), jwt.DefaultLeeway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claims.Audience.Contains(testIssuer) || claims.Subject != strconv.Itoa(user.ID) ||
+		claims.IssuedAt == nil || claims.NotBefore == nil || claims.ID == "" {
+		t.Fatalf("got claims %+v, want the API audience, the user subject, iat, nbf and jti", claims)
+	}
+	if code := getUser(tokens.JWT); code != http.StatusOK {
+		t.Fatalf("got %d with a token for the API, want %d", code, http.StatusOK)
+	}
+
+	// the tokens of a client with its own audience are for its resource server
+	code := signIn(t, a, authorizeParams("clinic-api-client", "openid")).Get("code")
+	status, out := exchangeCode(a, "clinic-api-client", "Api-secret", code, testCodeVerifier)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d exchanging the code, want %d", status, http.StatusOK)
+	}
+	if claims, err = parseJWT(out.AccessToken, jwks, expectTestIssuer(), jwt.DefaultLeeway); err != nil {
+		t.Fatal(err)
+	}
+	if len(claims.Audience) != 1 || !claims.Audience.Contains("https://clinic-api.test") {
+		t.Fatalf("got audience %v, want the client audience", claims.Audience)
+	}
+	if code := getUser(out.AccessToken); code != http.StatusUnauthorized {
+		t.Fatalf("got %d with a token for another audience, want %d", code, http.StatusUnauthorized)
+	}
+}
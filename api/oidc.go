@@ -0,0 +1,127 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+// openIDConfigurationOut is the OpenID Connect discovery document
+type openIDConfigurationOut struct {
+	Issuer                                     string   `json:"issuer"`
+	AuthorizationEndpoint                      string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                              string   `json:"token_endpoint,omitempty"`
+	UserinfoEndpoint                           string   `json:"userinfo_endpoint"`
+	JWKSURI                                    string   `json:"jwks_uri"`
+	RevocationEndpoint                         string   `json:"revocation_endpoint"`
+	IntrospectionEndpoint                      string   `json:"introspection_endpoint"`
+	ScopesSupported                            []string `json:"scopes_supported"`
+	ResponseTypesSupported                     []string `json:"response_types_supported"`
+	GrantTypesSupported                        []string `json:"grant_types_supported,omitempty"`
+	SubjectTypesSupported                      []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                            []string `json:"claims_supported"`
+	RevocationEndpointAuthMethodsSupported     []string `json:"revocation_endpoint_auth_methods_supported"`
+	IntrospectionEndpointAuthMethodsSupported  []string `json:"introspection_endpoint_auth_methods_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported,omitempty"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported,omitempty"`
+}
+
+// userinfoOut holds the OpenID Connect standard claims of a user
+type userinfoOut struct {
+	Sub     string      `json:"sub"`
+	Email   string      `json:"email,omitempty"`
+	Name    string      `json:"name,omitempty"`
+	Address *addressOut `json:"address,omitempty"`
+}
+
+type addressOut struct {
+	Formatted string `json:"formatted"`
+}
+
+func (a *API) openIDConfiguration(w http.ResponseWriter, req *http.Request) {
+	set, err := a.keySet(req.Context())
+	if err != nil {
+		log.Printf("Error gettings JWKS: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	clientAuthMethods := []string{"client_secret_basic", "client_secret_post", "private_key_jwt"}
+	writeJSON(w, http.StatusOK, openIDConfigurationOut{
+		Issuer:                                     a.cfg.Issuer,
+		AuthorizationEndpoint:                      a.endpointURL(authorizePath),
+		TokenEndpoint:                              a.endpointURL(tokenPath),
+		UserinfoEndpoint:                           a.endpointURL(userinfoPath),
+		JWKSURI:                                    a.endpointURL(jwksPath),
+		RevocationEndpoint:                         a.endpointURL(revokePath),
+		IntrospectionEndpoint:                      a.endpointURL(introspectPath),
+		ScopesSupported:                            supportedScopes,
+		ResponseTypesSupported:                     []string{"code"},
+		GrantTypesSupported:                        []string{grantAuthorizationCode, grantRefreshToken, grantClientCredentials},
+		SubjectTypesSupported:                      []string{"public"},
+		IDTokenSigningAlgValuesSupported:           signingAlgorithms(set.jwks),
+		ClaimsSupported:                            []string{"iss", "sub", "aud", "exp", "iat", "nbf", "jti", "nonce", "email", "name", "address", "roles"},
+		RevocationEndpointAuthMethodsSupported:     clientAuthMethods,
+		IntrospectionEndpointAuthMethodsSupported:  clientAuthMethods,
+		TokenEndpointAuthMethodsSupported:          append(clientAuthMethods, "none"),
+		TokenEndpointAuthSigningAlgValuesSupported: clientAssertionAlgs,
+		CodeChallengeMethodsSupported:              []string{pkceMethodS256},
+	})
+}
+
+// userinfo returns the standard claims of the user of the bearer JWT released by its scope
+func (a *API) userinfo(w http.ResponseWriter, req *http.Request) {
+	user, claims, err := a.requestUser(req)
+	if err == auth.ErrInvalidToken {
+		auth.WriteInvalidToken(w)
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting request user: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newUserinfoOut(user, userinfoScope(claims)))
+}
+
+// userinfoScope returns the scope releasing the userinfo claims: the one granted to the client,
+// or every OpenID Connect scope for first party logins as the users signed in themselves
+func userinfoScope(claims *auth.Claims) string {
+	if claims.ClientID == "" {
+		return strings.Join(supportedScopes, " ")
+	}
+	return claims.Scope
+}
+
+// newUserinfoOut returns the `sub` of the user and the standard claims released by the scope
+func newUserinfoOut(user *dao.User, scope string) *userinfoOut {
+	out := &userinfoOut{Sub: strconv.Itoa(user.ID)}
+	if auth.HasScope(scope, emailScope) {
+		out.Email = user.Email
+	}
+	if auth.HasScope(scope, profileScope) {
+		out.Name = user.Name
+	}
+	if auth.HasScope(scope, addressScope) && user.Location != "" {
+		out.Address = &addressOut{Formatted: user.Location}
+	}
+	return out
+}
+
+// signingAlgorithms returns the algorithms of the keys that sign or verify tokens
+func signingAlgorithms(jwks []*dao.JWK) []string {
+	algs := []string{}
+	for _, jwk := range jwks {
+		if jwk.CanVerify() && !containsString(algs, jwk.Algorithm) {
+			algs = append(algs, jwk.Algorithm)
+		}
+	}
+	return algs
+}
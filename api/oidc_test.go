@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+func TestOpenIDConfiguration(t *testing.T) {
+	a, d := newTestAPI(t)
+	activateTestKey(t, d)
+
+	rec := serve(a, http.MethodGet, openIDConfigPath, "", "")
+	assertStatus(t, rec, http.StatusOK)
+	out := new(openIDConfigurationOut)
+	if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Issuer != testIssuer || out.JWKSURI != testIssuer+jwksPath || out.UserinfoEndpoint != testIssuer+userinfoPath ||
+		out.RevocationEndpoint != testIssuer+revokePath || out.IntrospectionEndpoint != testIssuer+introspectPath {
+		t.Fatalf("got %+v, want the endpoints under the issuer %s", out, testIssuer)
+	}
+	if !reflect.DeepEqual(out.IDTokenSigningAlgValuesSupported, []string{dao.AlgRS256}) {
+		t.Fatalf("got signing algorithms %v, want %s", out.IDTokenSigningAlgValuesSupported, dao.AlgRS256)
+	}
+	// both endpoints authenticate clients the same way
+	want := []string{"client_secret_basic", "client_secret_post", "private_key_jwt"}
+	if !reflect.DeepEqual(out.RevocationEndpointAuthMethodsSupported, want) ||
+		!reflect.DeepEqual(out.IntrospectionEndpointAuthMethodsSupported, want) {
+		t.Fatalf("got revocation %v and introspection %v auth methods, want %v",
+			out.RevocationEndpointAuthMethodsSupported, out.IntrospectionEndpointAuthMethodsSupported, want)
+	}
+}
+
+func TestUserinfo(t *testing.T) {
+	a, d := newTestAPI(t)
+	activateTestKey(t, d)
+	user := insertTestUser(t, d, "owner@example.com", "Dog-and-cat-1")
+	tokens := login(t, a, "owner@example.com", "Dog-and-cat-1")
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		req, _ := http.NewRequest(method, userinfoPath, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.JWT)
+		rec := serveRequest(a, req)
+		assertStatus(t, rec, http.StatusOK)
+		out := new(userinfoOut)
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Sub != strconv.Itoa(user.ID) || out.Email != user.Email || out.Name != user.Name {
+			t.Fatalf("%s: got %+v, want the claims of user %d", method, out, user.ID)
+		}
+	}
+
+	// a token of another issuer signed with our key
+	other := NewAPI(d, d, Config{Issuer: "https://other.airvet.test"})
+	otherJWT, err := other.newAccessToken(context.Background(), user, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, header := range map[string]string{"no token": "", "invalid token": "Bearer nope", "other issuer": "Bearer " + otherJWT} {
+		req, _ := http.NewRequest(http.MethodGet, userinfoPath, nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := serveRequest(a, req)
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: got status %d and WWW-Authenticate %q, want 401 with the header", name, rec.Code, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+type refreshIn struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refresh exchanges a refresh token for a new access JWT and a rotated refresh token
+func (a *API) refresh(w http.ResponseWriter, req *http.Request) {
+	in := new(refreshIn)
+	if err := json.NewDecoder(req.Body).Decode(in); err != nil || in.RefreshToken == "" {
+		auth.WriteError(w, http.StatusBadRequest, "invalid_request", "missing refresh_token")
+		return
+	}
+
+	refreshToken, rt, err := a.db.RotateRefreshToken(req.Context(), in.RefreshToken, "", time.Now().Add(RefreshTokenExpiration))
+	switch {
+	case err == dao.ErrRefreshTokenReused:
+		log.Printf("Refresh token reused, revoked its family")
+		auth.WriteError(w, http.StatusUnauthorized, "invalid_grant", "the refresh token was already used")
+		return
+	case err == dao.ErrInvalidRefreshToken:
+		auth.WriteError(w, http.StatusUnauthorized, "invalid_grant", "the refresh token is invalid or expired")
+		return
+	case err != nil:
+		log.Printf("Error rotating refresh token: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := a.db.GetUserByID(req.Context(), rt.UserID)
+	if err == dao.ErrUserNotFound {
+		auth.WriteError(w, http.StatusUnauthorized, "invalid_grant", "the user doesn't exist anymore")
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting user from db: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// refresh tokens of clients are rotated in the token endpoint, these are first party ones
+	jwt, err := a.newAccessToken(req.Context(), user, nil, "")
+	if err != nil {
+		log.Printf("Error generating jwt: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tokenOut{
+		JWT:          jwt,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(JWTExpiration / time.Second),
+	})
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/square/go-jose/v3/jwt"
+)
+
+func TestRefreshToken(t *testing.T) {
+	a, d := newTestAPI(t)
+	activateTestKey(t, d)
+	insertTestUser(t, d, "owner@example.com", "Dog-and-cat-1")
+
+	first := login(t, a, "owner@example.com", "Dog-and-cat-1")
+
+	refresh := func(token string) (int, *tokenOut) {
+		rec := serve(a, http.MethodPost, "/token/refresh", "application/json", fmt.Sprintf(`{"refresh_token": %q}`, token))
+		if rec.Code != http.StatusOK {
+			return rec.Code, nil
+		}
+		out := new(tokenOut)
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, out
+	}
+
+	status, rotated := refresh(first.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d refreshing, want 200", status)
+	}
+	if rotated.RefreshToken == first.RefreshToken {
+		t.Fatal("got the same refresh token back, want a rotated one")
+	}
+	jwks, err := d.GetJWKS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := parseJWT(rotated.JWT, jwks, expectTestIssuer(), jwt.DefaultLeeway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Email != "owner@example.com" {
+		t.Fatalf("got a refreshed JWT for %q, want owner@example.com", claims.Email)
+	}
+
+	// replaying the first refresh token revokes the rotated one too
+	if status, _ := refresh(first.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("got status %d reusing a refresh token, want 401", status)
+	}
+	if status, _ := refresh(rotated.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("got status %d after the family was revoked, want 401", status)
+	}
+
+	rec := serve(a, http.MethodPost, "/token/refresh", "application/json", `{}`)
+	assertStatus(t, rec, http.StatusBadRequest)
+}
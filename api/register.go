@@ -0,0 +1,106 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 128
+
+	// how many of lower case, upper case, digits and symbols a password needs
+	minPasswordCharClasses = 3
+)
+
+func (a *API) createUser(w http.ResponseWriter, req *http.Request) {
+	u, err := readUserIn(req)
+	if err != nil {
+		auth.WriteError(w, http.StatusBadRequest, "invalid_request", "malformed JSON body")
+		return
+	}
+
+	email := dao.NormalizeEmail(u.Email)
+	if err := checkEmail(email); err != nil {
+		auth.WriteError(w, http.StatusUnprocessableEntity, "invalid_email", err.Error())
+		return
+	}
+	if err := checkPasswordPolicy(email, u.Password); err != nil {
+		auth.WriteError(w, http.StatusUnprocessableEntity, "invalid_password", err.Error())
+		return
+	}
+
+	hash, err := a.db.HashPassword(u.Password)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	user := &dao.User{
+		Email:        email,
+		Name:         strings.TrimSpace(u.Name),
+		Location:     strings.TrimSpace(u.Location),
+		PasswordHash: hash,
+	}
+	err = a.db.InsertUser(req.Context(), user)
+	if err == dao.ErrUserExists {
+		auth.WriteError(w, http.StatusConflict, "email_taken", "a user with this email already exists")
+		return
+	}
+	if err != nil {
+		log.Printf("Error inserting user: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, user)
+}
+
+func checkEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	// reject display names and comments, we only want the bare address
+	if err != nil || addr.Address != email {
+		return fmt.Errorf("%q is not a valid email address", email)
+	}
+	return nil
+}
+
+// checkPasswordPolicy requires a long enough password, mixing character classes,
+// that doesn't contain the email user name
+func checkPasswordPolicy(email, password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < minPasswordLength || length > maxPasswordLength {
+		return fmt.Errorf("the password must have between %d and %d characters", minPasswordLength, maxPasswordLength)
+	}
+
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if lower+upper+digit+symbol < minPasswordCharClasses {
+		return fmt.Errorf("the password must mix at least %d of lower case, upper case, digits and symbols", minPasswordCharClasses)
+	}
+
+	name := email[:strings.LastIndex(email, "@")]
+	if len(name) >= 3 && strings.Contains(strings.ToLower(password), name) {
+		return fmt.Errorf("the password must not contain the email")
+	}
+	return nil
+}
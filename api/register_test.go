@@ -0,0 +1,59 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/yanpozka/airvet-jwt/auth"
+)
+
+func TestCreateUser(t *testing.T) {
+	a, d := newTestAPI(t)
+
+	rec := serve(a, http.MethodPost, "/users", "application/json",
+		`{"email": " Owner@Example.com ", "name": "Pet Owner", "password": "Dog-and-cat-1"}`)
+	assertStatus(t, rec, http.StatusCreated)
+	var created struct {
+		ID       int    `json:"id"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == 0 || created.Email != "owner@example.com" || created.Password != "" {
+		t.Fatalf("got user %+v, want a new ID, the normalized email and no password", created)
+	}
+	if _, err := d.GetUserByEmailPasswd(context.Background(), "owner@example.com", "Dog-and-cat-1"); err != nil {
+		t.Fatalf("got %v logging in as the new user", err)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{name: "email taken", body: `{"email": "OWNER@example.com", "password": "Dog-and-cat-2"}`, status: http.StatusConflict, code: "email_taken"},
+		{name: "invalid email", body: `{"email": "Owner <owner@example.com>", "password": "Dog-and-cat-1"}`, status: http.StatusUnprocessableEntity, code: "invalid_email"},
+		{name: "short password", body: `{"email": "vet@example.com", "password": "Dog-1"}`, status: http.StatusUnprocessableEntity, code: "invalid_password"},
+		{name: "one character class", body: `{"email": "vet@example.com", "password": "dogandcats"}`, status: http.StatusUnprocessableEntity, code: "invalid_password"},
+		{name: "password with email", body: `{"email": "vet@example.com", "password": "My-vet-pass-1"}`, status: http.StatusUnprocessableEntity, code: "invalid_password"},
+		{name: "malformed body", body: `{"email": `, status: http.StatusBadRequest, code: "invalid_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(a, http.MethodPost, "/users", "application/json", tt.body)
+			assertStatus(t, rec, tt.status)
+			var out auth.ErrorOut
+			if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+				t.Fatal(err)
+			}
+			if out.Error != tt.code {
+				t.Fatalf("got error %q, want %q", out.Error, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+const refreshTokenHint = "refresh_token"
+
+// errWrongClient is returned when a client tries to revoke a token issued to someone else
+var errWrongClient = errors.New("token issued to another client")
+
+// revoke implements the RFC 7009 token revocation for authenticated clients: refresh tokens
+// revoke their whole family and access JWTs are denied by `jti` until they expire.
+// Unknown, invalid or already revoked tokens also get a 200 response, as the client
+// can't do anything about them
+func (a *API) revoke(w http.ResponseWriter, req *http.Request) {
+	client, err := a.authenticateClient(req)
+	if err == dao.ErrInvalidClient {
+		writeInvalidClient(w)
+		return
+	}
+	if err != nil {
+		log.Printf("Error authenticating client: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	token := req.PostFormValue("token")
+	if token == "" {
+		auth.WriteError(w, http.StatusBadRequest, "invalid_request", "missing token")
+		return
+	}
+
+	switch req.PostFormValue("token_type_hint") {
+	case refreshTokenHint:
+		if err = a.revokeRefreshToken(req, client, token); err == dao.ErrInvalidRefreshToken {
+			err = a.revokeJWT(req, client, token)
+		}
+	default:
+		// the hint is optional, JWTs are easily told apart from our opaque refresh tokens
+		if err = a.revokeJWT(req, client, token); err == auth.ErrInvalidToken {
+			err = a.revokeRefreshToken(req, client, token)
+		}
+	}
+	switch {
+	case err == errWrongClient:
+		auth.WriteError(w, http.StatusBadRequest, "unauthorized_client", "the token was issued to another client")
+		return
+	case err != nil && err != auth.ErrInvalidToken && err != dao.ErrInvalidRefreshToken:
+		log.Printf("Error revoking token: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// revokeJWT denies a valid access JWT until it expires
+func (a *API) revokeJWT(req *http.Request, client *dao.Client, signedJWT string) error {
+	claims, err := a.verifyJWT(req.Context(), signedJWT, "")
+	if err != nil {
+		return err
+	}
+	if claims.ID == "" || claims.Expiry == nil {
+		return auth.ErrInvalidToken
+	}
+	if !issuedTo(client, claims.ClientID) {
+		return errWrongClient
+	}
+	return a.db.RevokeJTI(req.Context(), claims.ID, claims.Expiry.Time())
+}
+
+// revokeRefreshToken revokes the family of the refresh token
+func (a *API) revokeRefreshToken(req *http.Request, client *dao.Client, token string) error {
+	rt, err := a.db.FindRefreshToken(req.Context(), token)
+	if err != nil {
+		return err
+	}
+	if !issuedTo(client, rt.ClientID) {
+		return errWrongClient
+	}
+	return a.db.RevokeRefreshTokenFamily(req.Context(), rt.FamilyID)
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+func TestRevoke(t *testing.T) {
+	a, d := newTestAPI(t)
+	activateTestKey(t, d)
+	insertTestUser(t, d, "owner@example.com", "Dog-and-cat-1")
+	insertTestClient(t, d, &dao.Client{ID: "airvet-app", FirstParty: true}, "App-secret")
+	insertTestClient(t, d, &dao.Client{ID: "resource-server"}, "Resource-secret")
+
+	getUser := func(jwt string) int {
+		req, _ := http.NewRequest(http.MethodGet, "/user", nil)
+		req.Header.Set("Authorization", "Bearer "+jwt)
+		return serveRequest(a, req).Code
+	}
+	revoke := func(clientID, secret, token, hint string) int {
+		form := url.Values{"token": {token}}
+		if hint != "" {
+			form.Set("token_type_hint", hint)
+		}
+		return serveForm(a, "/revoke", clientID, secret, form).Code
+	}
+
+	tokens := login(t, a, "owner@example.com", "Dog-and-cat-1")
+	tests := []struct {
+		name     string
+		clientID string
+		secret   string
+		token    string
+		hint     string
+		status   int
+	}{
+		{name: "no client", token: tokens.JWT, status: http.StatusUnauthorized},
+		{name: "wrong secret", clientID: "airvet-app", secret: "Resource-secret", token: tokens.JWT, status: http.StatusUnauthorized},
+		{name: "JWT of another client", clientID: "resource-server", secret: "Resource-secret", token: tokens.JWT, status: http.StatusBadRequest},
+		{name: "refresh token of another client", clientID: "resource-server", secret: "Resource-secret", token: tokens.RefreshToken, hint: refreshTokenHint, status: http.StatusBadRequest},
+		{name: "unknown token", clientID: "airvet-app", secret: "App-secret", token: "not-a-token", status: http.StatusOK},
+		{name: "missing token", clientID: "airvet-app", secret: "App-secret", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if status := revoke(tt.clientID, tt.secret, tt.token, tt.hint); status != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+	if status := getUser(tokens.JWT); status != http.StatusOK {
+		t.Fatalf("got status %d after the failed revocations, want the JWT still valid", status)
+	}
+
+	// the JWT goes to the denylist, a second revocation is fine too
+	for i := 0; i < 2; i++ {
+		if status := revoke("airvet-app", "App-secret", tokens.JWT, ""); status != http.StatusOK {
+			t.Fatalf("got status %d revoking the JWT, want 200", status)
+		}
+	}
+	if status := getUser(tokens.JWT); status != http.StatusUnauthorized {
+		t.Fatalf("got status %d with a revoked JWT, want 401", status)
+	}
+
+	// the refresh token is found even without the hint, its whole family is revoked
+	if status := revoke("airvet-app", "App-secret", tokens.RefreshToken, ""); status != http.StatusOK {
+		t.Fatalf("got status %d revoking the refresh token, want 200", status)
+	}
+	rec := serve(a, http.MethodPost, "/token/refresh", "application/json", fmt.Sprintf(`{"refresh_token": %q}`, tokens.RefreshToken))
+	assertStatus(t, rec, http.StatusUnauthorized)
+}
+
+func TestRevokeClientTokens(t *testing.T) {
+	a, d, _ := newOAuthTestAPI(t)
+	insertTestClient(t, d, &dao.Client{ID: "airvet-app", FirstParty: true}, "App-secret")
+
+	code := signIn(t, a, authorizeParams("clinic-integration", "openid")).Get("code")
+	status, out := exchangeCode(a, "clinic-integration", "Clinic-secret", code, testCodeVerifier)
+	if status != http.StatusOK {
+		t.Fatalf("got status %d exchanging the code", status)
+	}
+	firstParty := login(t, a, "owner@example.com", "Dog-and-cat-1")
+
+	tests := []struct {
+		name     string
+		clientID string
+		secret   string
+		token    string
+		status   int
+	}{
+		{name: "client JWT by a first party client", clientID: "airvet-app", secret: "App-secret", token: out.AccessToken, status: http.StatusBadRequest},
+		{name: "client refresh token by a first party client", clientID: "airvet-app", secret: "App-secret", token: out.RefreshToken, status: http.StatusBadRequest},
+		{name: "first party JWT by a client", clientID: "clinic-integration", secret: "Clinic-secret", token: firstParty.JWT, status: http.StatusBadRequest},
+		{name: "first party refresh token by a client", clientID: "clinic-integration", secret: "Clinic-secret", token: firstParty.RefreshToken, status: http.StatusBadRequest},
+		{name: "own JWT", clientID: "clinic-integration", secret: "Clinic-secret", token: out.AccessToken, status: http.StatusOK},
+		{name: "own refresh token", clientID: "clinic-integration", secret: "Clinic-secret", token: out.RefreshToken, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := serveForm(a, revokePath, tt.clientID, tt.secret, url.Values{"token": {tt.token}})
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+
+	form := url.Values{"grant_type": {grantRefreshToken}, "refresh_token": {out.RefreshToken}}
+	assertStatus(t, serveForm(a, tokenPath, "clinic-integration", "Clinic-secret", form), http.StatusBadRequest)
+}
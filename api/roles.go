@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+const (
+	scopeRolesRead = "roles:read"
+	// scopeRolesWrite is only in first party tokens, clients can't get it from users
+	scopeRolesWrite = "roles:write"
+	adminRole       = "admin"
+)
+
+type userRoleIn struct {
+	UserID int    `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+type userRolesOut struct {
+	UserID int      `json:"user_id"`
+	Roles  []string `json:"roles"`
+}
+
+// getRoles lists every role with its permissions
+func (a *API) getRoles(w http.ResponseWriter, req *http.Request) {
+	roles, err := a.db.GetRoles(req.Context())
+	if err != nil {
+		log.Printf("Error getting roles: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, roles)
+}
+
+// userRoles lists (GET ?user_id=), assigns (POST) and unassigns (DELETE) the roles of a user
+func (a *API) userRoles(w http.ResponseWriter, req *http.Request) {
+	var userID int
+	if req.Method == http.MethodGet {
+		id, err := strconv.Atoi(req.URL.Query().Get("user_id"))
+		if err != nil {
+			auth.WriteError(w, http.StatusBadRequest, "invalid_request", "missing or invalid user_id")
+			return
+		}
+		userID = id
+	} else {
+		in := new(userRoleIn)
+		if err := json.NewDecoder(req.Body).Decode(in); err != nil || in.UserID == 0 || in.Role == "" {
+			auth.WriteError(w, http.StatusBadRequest, "invalid_request", "user_id and role are required")
+			return
+		}
+		userID = in.UserID
+
+		var err error
+		if req.Method == http.MethodPost {
+			err = a.db.AssignRole(req.Context(), in.UserID, in.Role)
+		} else {
+			_, err = a.db.UnassignRole(req.Context(), in.UserID, in.Role)
+		}
+		switch {
+		case err == dao.ErrUserNotFound:
+			auth.WriteError(w, http.StatusNotFound, "user_not_found", "the user doesn't exist")
+			return
+		case err == dao.ErrRoleNotFound:
+			auth.WriteError(w, http.StatusNotFound, "role_not_found", "the role doesn't exist")
+			return
+		case err != nil:
+			log.Printf("Error changing user roles: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("User %d roles changed with %s %q", in.UserID, req.Method, in.Role)
+	}
+
+	roles, err := a.db.GetUserRoles(req.Context(), userID)
+	if err != nil {
+		log.Printf("Error getting user roles: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// the roles of issued tokens change once they are refreshed
+	writeJSON(w, http.StatusOK, userRolesOut{UserID: userID, Roles: roles})
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+func TestUserRolesRequiresFirstPartyToken(t *testing.T) {
+	ctx := context.Background()
+	a, d := newTestAPI(t)
+	activateTestKey(t, d)
+
+	admin := insertTestUser(t, d, "admin@airvet.com", "Admin-pass-1")
+	if err := d.AssignRole(ctx, admin.ID, adminRole); err != nil {
+		t.Fatal(err)
+	}
+
+	// the admin signed in to a third party app granting it only openid
+	thirdParty, err := a.newAccessToken(ctx, admin, &dao.Client{ID: "clinic-integration"}, openIDScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstParty, err := a.newAccessToken(ctx, admin, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes := a.GetRoutes()
+	tests := []struct {
+		name      string
+		token     string
+		wantCode  int
+		wantRoles string
+	}{
+		{name: "third party", token: thirdParty, wantCode: http.StatusForbidden, wantRoles: "admin"},
+		{name: "first party", token: firstParty, wantCode: http.StatusOK, wantRoles: "admin vet"},
+	}
+	for _, tt := range tests {
+		body := fmt.Sprintf(`{ "user_id": %d, "role": "vet" }`, admin.ID)
+		req := httptest.NewRequest(http.MethodPost, userRolesPath, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: got status %d assigning a role, want %d: %s", tt.name, rec.Code, tt.wantCode, rec.Body)
+		}
+		roles, err := d.GetUserRoles(ctx, admin.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(roles, " "); got != tt.wantRoles {
+			t.Errorf("%s: got roles %q, want %q", tt.name, got, tt.wantRoles)
+		}
+	}
+}
+
+func TestClientTokensHaveNoRoles(t *testing.T) {
+	ctx := context.Background()
+	a, d := newTestAPI(t)
+	activateTestKey(t, d)
+
+	admin := insertTestUser(t, d, "admin@airvet.com", "Admin-pass-1")
+	if err := d.AssignRole(ctx, admin.ID, adminRole); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := a.newAccessToken(ctx, admin, &dao.Client{ID: "clinic-integration"}, openIDScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := a.verifyJWT(ctx, token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claims.Roles) != 0 || claims.Scope != openIDScope {
+		t.Fatalf("got roles %v and scope %q in a client token, want no roles and scope %q", claims.Roles, claims.Scope, openIDScope)
+	}
+}
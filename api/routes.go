@@ -5,18 +5,47 @@ import (
 	"net/http"
 	"runtime/debug"
 	"time"
+
+	"github.com/yanpozka/airvet-jwt/auth"
+)
+
+const (
+	authPath         = "/auth"
+	authorizePath    = "/authorize"
+	tokenPath        = "/token"
+	refreshPath      = "/token/refresh"
+	revokePath       = "/revoke"
+	introspectPath   = "/introspect"
+	userPath         = "/user"
+	usersPath        = "/users"
+	userinfoPath     = "/userinfo"
+	rolesPath        = "/roles"
+	userRolesPath    = "/user/roles"
+	jwksPath         = "/.well-known/jwks.json"
+	openIDConfigPath = "/.well-known/openid-configuration"
 )
 
 // GetRoutes returns a muxer with all the routes
 func (a *API) GetRoutes() http.Handler {
 	mux := http.NewServeMux()
 
-	mux.Handle("/auth", loggerPanic(httpMethod(http.MethodPost, http.HandlerFunc(a.auth))))
-	mux.Handle("/user", loggerPanic(httpMethod(http.MethodGet, http.HandlerFunc(a.getUser))))
+	mux.Handle(authPath, loggerPanic(httpMethod(http.MethodPost, http.HandlerFunc(a.auth))))
+	mux.Handle(authorizePath, loggerPanic(httpMethods([]string{http.MethodGet, http.MethodPost}, http.HandlerFunc(a.authorize))))
+	mux.Handle(tokenPath, loggerPanic(httpMethod(http.MethodPost, http.HandlerFunc(a.token))))
+	mux.Handle(refreshPath, loggerPanic(httpMethod(http.MethodPost, http.HandlerFunc(a.refresh))))
+	mux.Handle(revokePath, loggerPanic(httpMethod(http.MethodPost, http.HandlerFunc(a.revoke))))
+	mux.Handle(introspectPath, loggerPanic(httpMethod(http.MethodPost, http.HandlerFunc(a.introspect))))
+	mux.Handle(userPath, loggerPanic(httpMethod(http.MethodGet, auth.Authenticate(a, http.HandlerFunc(a.getUser)))))
+	mux.Handle(usersPath, loggerPanic(httpMethod(http.MethodPost, http.HandlerFunc(a.createUser))))
+	mux.Handle(rolesPath, loggerPanic(httpMethod(http.MethodGet, auth.Authenticate(a, auth.RequireScope(scopeRolesRead, http.HandlerFunc(a.getRoles))))))
+	mux.Handle(userRolesPath, loggerPanic(httpMethods([]string{http.MethodGet, http.MethodPost, http.MethodDelete},
+		auth.Authenticate(a, auth.RequireScope(scopeRolesWrite, auth.RequireRole(adminRole, http.HandlerFunc(a.userRoles)))))))
+	mux.Handle(userinfoPath, loggerPanic(httpMethods([]string{http.MethodGet, http.MethodPost}, auth.Authenticate(a, http.HandlerFunc(a.userinfo)))))
 
-	// special endpoint that should be in a different server
-	// and will be used as `jku` header
-	mux.Handle("/.well-known/jwks.json", loggerPanic(httpMethod(http.MethodGet, http.HandlerFunc(a.getJWKS))))
+	// special endpoints that should be in a different server
+	// the jwks one will be used as `jku` header
+	mux.Handle(jwksPath, loggerPanic(httpMethod(http.MethodGet, http.HandlerFunc(a.getJWKS))))
+	mux.Handle(openIDConfigPath, loggerPanic(httpMethod(http.MethodGet, http.HandlerFunc(a.openIDConfiguration))))
 
 	return mux
 }
@@ -43,14 +72,19 @@ func loggerPanic(next http.Handler) http.Handler {
 }
 
 func httpMethod(method string, next http.Handler) http.Handler {
+	return httpMethods([]string{method}, next)
+}
+
+func httpMethods(methods []string, next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != method {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
+		for _, method := range methods {
+			if r.Method == method {
+				next.ServeHTTP(w, r)
+				return
+			}
 		}
 
-		//
-		next.ServeHTTP(w, r)
+		w.WriteHeader(http.StatusMethodNotAllowed)
 	})
 }
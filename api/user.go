@@ -5,51 +5,55 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strings"
+
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
 )
 
 type userIn struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
 }
 
 func (a *API) getUser(w http.ResponseWriter, req *http.Request) {
-	authHeader := req.Header.Get(authorizationHeader)
-	parts := strings.Split(authHeader, " ")
-	if len(parts) < 2 {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	user, _, err := a.requestUser(req)
+	if err == auth.ErrInvalidToken {
+		auth.WriteInvalidToken(w)
 		return
 	}
-	signedJWT := parts[1]
-
-	jwks, err := a.db.GetJWKS(req.Context())
-	if len(jwks) == 0 || err != nil {
-		log.Printf("We don't have a JWKS, error?: %v", err)
+	if err != nil {
+		log.Printf("Error getting request user: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	jwk := jwks[0] // always get the first one as they come ordered by expiration time
-	rsaKey, err := jwk.GetRSAPrivateKey()
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+// requestUser returns the user and the claims verified by Authenticate, auth.ErrInvalidToken means
+// the token isn't from a user or its user doesn't exist anymore
+func (a *API) requestUser(req *http.Request) (*dao.User, *auth.Claims, error) {
+	claims, ok := auth.ClaimsFromContext(req.Context())
+	if !ok {
+		return nil, nil, auth.ErrInvalidToken
 	}
-	uc, err := parseJWT(signedJWT, &rsaKey.PublicKey)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	userID, ok := claims.UserID()
+	if !ok {
+		return nil, nil, auth.ErrInvalidToken
 	}
 
-	user, err := a.db.GetUserByEmail(req.Context(), uc.Email)
+	user, err := a.db.GetUserByID(req.Context(), userID)
+	if err == dao.ErrUserNotFound {
+		return nil, nil, auth.ErrInvalidToken
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, nil, err
 	}
-
-	w.Header().Add("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(user)
+	return user, claims, nil
 }
 
 func readUserIn(req *http.Request) (*userIn, error) {
@@ -0,0 +1,62 @@
+// Package auth has the claims of the airvet access tokens and the middlewares other
+// services need to accept them, without depending on the server storage
+package auth
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/square/go-jose/v3/jwt"
+)
+
+// ErrInvalidToken is returned when a token is missing, malformed, expired, revoked or not for us
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the claims of the access tokens we issue
+type Claims struct {
+	jwt.Claims
+	// Email is only in first party tokens and the tokens granted the email scope,
+	// never in the tokens of clients acting on their own behalf
+	Email string `json:"email,omitempty"`
+	// ClientID is the OAuth 2.0 client the token was issued to, empty for first party logins
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// Roles are the roles of the user when the token was issued, only in first party tokens
+	Roles []string `json:"roles,omitempty"`
+}
+
+// UserID returns the user the token was issued for, false for client_credentials tokens
+// where the client acts on its own behalf and is the subject
+func (c *Claims) UserID() (int, bool) {
+	if c.ClientID != "" && c.Subject == c.ClientID {
+		return 0, false
+	}
+	id, err := strconv.Atoi(c.Subject)
+	return id, err == nil
+}
+
+// HasScope reports whether the scope was granted to the token
+func (c *Claims) HasScope(scope string) bool {
+	return HasScope(c.Scope, scope)
+}
+
+// HasRole reports whether the user had the role when the token was issued
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the space separated scopes have the scope
+func HasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/square/go-jose/v3/jwt"
+)
+
+func TestClaimsUserID(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims Claims
+		wantID int
+		wantOK bool
+	}{
+		{name: "first party login", claims: Claims{Claims: jwt.Claims{Subject: "7"}, Email: "owner@example.com"}, wantID: 7, wantOK: true},
+		// the email is only there with the email scope, the user is still the subject
+		{name: "client without email scope", claims: Claims{Claims: jwt.Claims{Subject: "7"}, ClientID: "clinic-integration"}, wantID: 7, wantOK: true},
+		{name: "client credentials", claims: Claims{Claims: jwt.Claims{Subject: "reports-service"}, ClientID: "reports-service"}},
+		// a numeric client ID isn't taken for a user
+		{name: "numeric client credentials", claims: Claims{Claims: jwt.Claims{Subject: "42"}, ClientID: "42"}},
+		{name: "no subject", claims: Claims{}},
+	}
+	for _, tt := range tests {
+		id, ok := tt.claims.UserID()
+		if id != tt.wantID || ok != tt.wantOK {
+			t.Errorf("%s: got %d, %v, want %d, %v", tt.name, id, ok, tt.wantID, tt.wantOK)
+		}
+	}
+}
+
+func TestClaimsScopeAndRoles(t *testing.T) {
+	c := &Claims{Scope: "users:read  appointments:read", Roles: []string{"vet"}}
+	if !c.HasScope("users:read") || !c.HasScope("appointments:read") || c.HasScope("users") || c.HasScope("") {
+		t.Fatalf("got the wrong scopes from %q", c.Scope)
+	}
+	if !c.HasRole("vet") || c.HasRole("admin") {
+		t.Fatalf("got the wrong roles from %v", c.Roles)
+	}
+}
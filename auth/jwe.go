@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/square/go-jose/v3"
+)
+
+// tokenContentEncryption encrypts the nested JWTs
+const tokenContentEncryption = jose.A256GCM
+
+// ErrUnsupportedEncryptionKey is returned for encryption keys other than RSA and EC
+var ErrUnsupportedEncryptionKey = errors.New("unsupported encryption key, expected RSA or EC")
+
+// LoadEncryptionKey reads the PEM private key decrypting the tokens of an audience,
+// a PKCS1 RSA key, a SEC 1 EC key or a PKCS8 RSA or EC key
+func LoadEncryptionKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing the encryption key")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encryption key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedEncryptionKey, key)
+	}
+	if _, err := KeyEncryptionAlgorithm(signer.Public()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// KeyEncryptionAlgorithm returns how the content key is encrypted to the public key:
+// RSA-OAEP for RSA keys and ECDH-ES key agreement for EC keys
+func KeyEncryptionAlgorithm(publicKey crypto.PublicKey) (jose.KeyAlgorithm, error) {
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		return jose.RSA_OAEP, nil
+	case *ecdsa.PublicKey:
+		return jose.ECDH_ES, nil
+	}
+	return "", fmt.Errorf("%w: %T", ErrUnsupportedEncryptionKey, publicKey)
+}
+
+// EncryptionJWK returns the public JWK of the encryption key, published in the JWKS with `use` enc
+func EncryptionJWK(publicKey crypto.PublicKey) (jose.JSONWebKey, error) {
+	alg, err := KeyEncryptionAlgorithm(publicKey)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	jwk := jose.JSONWebKey{Key: publicKey, Algorithm: string(alg), Use: "enc"}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return jose.JSONWebKey{}, fmt.Errorf("failed to compute jwk thumbprint: %w", err)
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return jwk, nil
+}
+
+// EncryptToken nests the signed JWT in a JWE encrypted to the public key with A256GCM,
+// the key thumbprint is set as `kid` header so the audience can pick its key
+func EncryptToken(signedJWT string, publicKey crypto.PublicKey) (string, error) {
+	jwk, err := EncryptionJWK(publicKey)
+	if err != nil {
+		return "", err
+	}
+	rcpt := jose.Recipient{Algorithm: jose.KeyAlgorithm(jwk.Algorithm), Key: publicKey, KeyID: jwk.KeyID}
+	opts := (&jose.EncrypterOptions{}).WithType("JWT").WithContentType("JWT")
+
+	encrypter, err := jose.NewEncrypter(tokenContentEncryption, rcpt, opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to create encrypter: %w", err)
+	}
+	obj, err := encrypter.Encrypt([]byte(signedJWT))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt jwt: %w", err)
+	}
+	return obj.CompactSerialize()
+}
+
+// isEncryptedToken reports whether the token is a compact JWE, it has five parts instead of three
+func isEncryptedToken(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// DecryptToken returns the signed JWT nested in an encrypted token, signed tokens are returned
+// as they are. Only the algorithms the tokens are encrypted with are accepted, ErrInvalidToken
+// is returned otherwise or when the token is encrypted and key is nil
+func DecryptToken(token string, key crypto.Signer) (string, error) {
+	if !isEncryptedToken(token) {
+		return token, nil
+	}
+	if key == nil {
+		return "", ErrInvalidToken
+	}
+
+	obj, err := jose.ParseEncrypted(token)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	// never let the token choose how it's decrypted
+	alg, err := KeyEncryptionAlgorithm(key.Public())
+	if err != nil {
+		return "", err
+	}
+	if obj.Header.Algorithm != string(alg) ||
+		obj.Header.ExtraHeaders["enc"] != string(tokenContentEncryption) ||
+		obj.Header.ExtraHeaders[jose.HeaderContentType] != "JWT" {
+		return "", ErrInvalidToken
+	}
+
+	signedJWT, err := obj.Decrypt(key)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	return string(signedJWT), nil
+}
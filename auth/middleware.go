@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type contextKey int
+
+const claimsContextKey contextKey = iota
+
+const (
+	authorizationHeader = "Authorization"
+	bearerScheme        = "Bearer"
+)
+
+var (
+	errMissingToken   = errors.New("missing bearer token")
+	errMalformedToken = errors.New("malformed authorization header")
+
+	// RFC 6750 section 2.1: b64token = 1*( ALPHA / DIGIT / "-" / "." / "_" / "~" / "+" / "/" ) *"="
+	b64TokenRegexp = regexp.MustCompile(`^[A-Za-z0-9\-._~+/]+=*$`)
+)
+
+// TokenVerifier verifies bearer tokens, returning ErrInvalidToken for the ones that must be rejected
+type TokenVerifier interface {
+	VerifyToken(ctx context.Context, token string) (*Claims, error)
+}
+
+// ErrorOut is the OAuth 2.0 error response
+type ErrorOut struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// Authenticate verifies the `Authorization: Bearer` token of the request and puts its claims
+// in the request context, see ClaimsFromContext. The errors follow RFC 6750 section 3
+func Authenticate(v TokenVerifier, next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := bearerToken(r)
+		switch {
+		case err == errMissingToken:
+			// no error code when the request had no authentication at all
+			w.Header().Set("WWW-Authenticate", `Bearer realm="airvet"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		case err != nil:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="airvet", error="invalid_request"`)
+			WriteError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		claims, err := v.VerifyToken(r.Context(), token)
+		if err == ErrInvalidToken {
+			WriteInvalidToken(w)
+			return
+		}
+		if err != nil {
+			log.Printf("Error verifying bearer token: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+	})
+}
+
+// RequireScope only lets through the requests whose token has the scope,
+// it must be wrapped by Authenticate
+func RequireScope(scope string, next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		if !ok {
+			WriteInvalidToken(w)
+			return
+		}
+		if !claims.HasScope(scope) {
+			writeInsufficientScope(w, scope, fmt.Sprintf("the %s scope is required", scope))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireRole only lets through the requests whose token has the role,
+// it must be wrapped by Authenticate
+func RequireRole(role string, next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		if !ok {
+			WriteInvalidToken(w)
+			return
+		}
+		if !claims.HasRole(role) {
+			writeInsufficientScope(w, "", fmt.Sprintf("the %s role is required", role))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClaimsFromContext returns the claims verified by Authenticate
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*Claims)
+	return claims, ok && claims != nil
+}
+
+// bearerToken parses the one `Authorization: Bearer <token>` header of the request
+func bearerToken(req *http.Request) (string, error) {
+	values := req.Header.Values(authorizationHeader)
+	switch {
+	case len(values) == 0:
+		return "", errMissingToken
+	case len(values) > 1:
+		return "", errMalformedToken
+	}
+
+	header := values[0]
+	if len(header) < len(bearerScheme) || !strings.EqualFold(header[:len(bearerScheme)], bearerScheme) {
+		// other schemes don't authenticate the request for us
+		return "", errMissingToken
+	}
+	rest := header[len(bearerScheme):]
+	if rest != "" && rest[0] != ' ' {
+		// a longer scheme name, like "Bearerx"
+		return "", errMissingToken
+	}
+	// the Bearer scheme without a token is a malformed request, RFC 6750 section 3.1
+	token := strings.TrimLeft(rest, " ")
+	if !b64TokenRegexp.MatchString(token) {
+		return "", errMalformedToken
+	}
+	return token, nil
+}
+
+// WriteError writes an error code and its description in the OAuth 2.0 error format
+func WriteError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorOut{Error: code, ErrorDescription: description})
+}
+
+// WriteInvalidToken asks for a new access token, RFC 6750 section 3.1
+func WriteInvalidToken(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="airvet", error="invalid_token"`)
+	WriteError(w, http.StatusUnauthorized, "invalid_token", "the access token is invalid")
+}
+
+// writeInsufficientScope tells the token is valid but not enough for the request, RFC 6750 section 3.1
+func writeInsufficientScope(w http.ResponseWriter, scope, description string) {
+	challenge := `Bearer realm="airvet", error="insufficient_scope"`
+	if scope != "" {
+		challenge += fmt.Sprintf(`, scope="%s"`, scope)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	WriteError(w, http.StatusForbidden, "insufficient_scope", description)
+}
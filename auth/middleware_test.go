@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeVerifier accepts only its token
+type fakeVerifier struct {
+	token  string
+	claims *Claims
+}
+
+func (v *fakeVerifier) VerifyToken(_ context.Context, token string) (*Claims, error) {
+	if token != v.token {
+		return nil, ErrInvalidToken
+	}
+	return v.claims, nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	v := &fakeVerifier{token: "valid.token", claims: &Claims{ClientID: "reports-service", Scope: "users:read", Roles: []string{"vet"}}}
+
+	tests := []struct {
+		name          string
+		headers       []string
+		next          func(http.Handler) http.Handler
+		wantCode      int
+		wantError     string
+		wantChallenge string
+	}{
+		{name: "no header", wantCode: http.StatusUnauthorized, wantChallenge: `Bearer realm="airvet"`},
+		{name: "other scheme", headers: []string{"Basic dXNlcjpwYXNz"}, wantCode: http.StatusUnauthorized, wantChallenge: `Bearer realm="airvet"`},
+		{name: "bearer without token", headers: []string{"Bearer"}, wantCode: http.StatusBadRequest, wantError: "invalid_request",
+			wantChallenge: `Bearer realm="airvet", error="invalid_request"`},
+		{name: "bearer with spaces only", headers: []string{"Bearer   "}, wantCode: http.StatusBadRequest, wantError: "invalid_request",
+			wantChallenge: `Bearer realm="airvet", error="invalid_request"`},
+		{name: "two tokens", headers: []string{"Bearer valid.token other"}, wantCode: http.StatusBadRequest, wantError: "invalid_request",
+			wantChallenge: `Bearer realm="airvet", error="invalid_request"`},
+		{name: "two headers", headers: []string{"Bearer valid.token", "Bearer valid.token"}, wantCode: http.StatusBadRequest, wantError: "invalid_request",
+			wantChallenge: `Bearer realm="airvet", error="invalid_request"`},
+		{name: "invalid token", headers: []string{"Bearer invalid.token"}, wantCode: http.StatusUnauthorized, wantError: "invalid_token",
+			wantChallenge: `Bearer realm="airvet", error="invalid_token"`},
+		{name: "valid token", headers: []string{"bearer valid.token"}, wantCode: http.StatusOK},
+		{
+			name:     "granted scope",
+			headers:  []string{"Bearer valid.token"},
+			next:     func(h http.Handler) http.Handler { return RequireScope("users:read", h) },
+			wantCode: http.StatusOK,
+		},
+		{
+			name:          "missing scope",
+			headers:       []string{"Bearer valid.token"},
+			next:          func(h http.Handler) http.Handler { return RequireScope("roles:write", h) },
+			wantCode:      http.StatusForbidden,
+			wantError:     "insufficient_scope",
+			wantChallenge: `Bearer realm="airvet", error="insufficient_scope", scope="roles:write"`,
+		},
+		{
+			name:          "missing role",
+			headers:       []string{"Bearer valid.token"},
+			next:          func(h http.Handler) http.Handler { return RequireRole("admin", h) },
+			wantCode:      http.StatusForbidden,
+			wantError:     "insufficient_scope",
+			wantChallenge: `Bearer realm="airvet", error="insufficient_scope"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				claims, ok := ClaimsFromContext(r.Context())
+				if !ok || claims != v.claims {
+					t.Errorf("got claims %v in the request context, want %v", claims, v.claims)
+				}
+			})
+			if tt.next != nil {
+				handler = tt.next(handler)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/appointments", nil)
+			for _, h := range tt.headers {
+				req.Header.Add("Authorization", h)
+			}
+			rec := httptest.NewRecorder()
+			Authenticate(v, handler).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+				t.Errorf("got WWW-Authenticate %q, want %q", got, tt.wantChallenge)
+			}
+			if tt.wantError != "" {
+				var out ErrorOut
+				if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+					t.Fatal(err)
+				}
+				if out.Error != tt.wantError {
+					t.Errorf("got error %q, want %q", out.Error, tt.wantError)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	insertAuthCodeSQL = `INSERT INTO auth_codes(hash, clientid, userid, redirecturi, codechallenge, scope, nonce, expiresat)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8)`
+	selectAuthCodeSQL = `SELECT clientid, userid, redirecturi, codechallenge, scope, nonce, expiresat
+	FROM auth_codes WHERE hash=?`
+	useAuthCodeSQL     = "UPDATE auth_codes SET usedat=? WHERE hash=? AND usedat=0"
+	deleteAuthCodesSQL = "DELETE FROM auth_codes WHERE expiresat<=?"
+)
+
+// ErrInvalidAuthCode is returned for unknown, expired or already used authorization codes
+var ErrInvalidAuthCode = errors.New("invalid authorization code")
+
+// AuthCode represents an authorization code granted to a client on behalf of a user
+type AuthCode struct {
+	ClientID    string
+	UserID      int
+	RedirectURI string
+	// CodeChallenge is the PKCE S256 challenge the code verifier must match
+	CodeChallenge string
+	Scope         string
+	Nonce         string
+	ExpiresAt     int64
+}
+
+// IssueAuthCode stores a new single use authorization code, the expired ones are pruned
+// at the same time. It returns the opaque code that is handed to the client
+func (d *DAO) IssueAuthCode(ctx context.Context, c *AuthCode) (string, error) {
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := d.db.ExecContext(ctx, deleteAuthCodesSQL, time.Now().Unix()); err != nil {
+		return "", fmt.Errorf("failed to prune auth codes: %w", err)
+	}
+	_, err = d.db.ExecContext(ctx, insertAuthCodeSQL, HashToken(code), c.ClientID, c.UserID, c.RedirectURI,
+		c.CodeChallenge, c.Scope, c.Nonce, c.ExpiresAt)
+	if err != nil {
+		return "", fmt.Errorf("failed to insert auth code: %w", err)
+	}
+	return code, nil
+}
+
+// ConsumeAuthCode marks the authorization code as used and returns it,
+// a code can only be consumed once
+func (d *DAO) ConsumeAuthCode(ctx context.Context, code string) (*AuthCode, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	hash := HashToken(code)
+	c := new(AuthCode)
+	err = tx.QueryRowContext(ctx, selectAuthCodeSQL, hash).Scan(&c.ClientID, &c.UserID, &c.RedirectURI,
+		&c.CodeChallenge, &c.Scope, &c.Nonce, &c.ExpiresAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrInvalidAuthCode
+	case err != nil:
+		return nil, fmt.Errorf("select auth code error: %w", err)
+	}
+
+	now := time.Now().Unix()
+	if c.ExpiresAt <= now {
+		return nil, ErrInvalidAuthCode
+	}
+	result, err := tx.ExecContext(ctx, useAuthCodeSQL, now, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use auth code: %w", err)
+	}
+	if countRows, _ := result.RowsAffected(); countRows != 1 {
+		return nil, ErrInvalidAuthCode
+	}
+	return c, tx.Commit()
+}
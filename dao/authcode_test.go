@@ -0,0 +1,49 @@
+package dao
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConsumeAuthCode(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+
+	issued := &AuthCode{
+		ClientID:      "clinic-integration",
+		UserID:        7,
+		RedirectURI:   "http://localhost:3000/callback",
+		CodeChallenge: "challenge",
+		Scope:         "openid email",
+		Nonce:         "nonce",
+		ExpiresAt:     time.Now().Add(time.Minute).Unix(),
+	}
+	code, err := d.IssueAuthCode(ctx, issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.ConsumeAuthCode(ctx, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *issued {
+		t.Fatalf("got code %+v, want %+v", got, issued)
+	}
+	if _, err := d.ConsumeAuthCode(ctx, code); err != ErrInvalidAuthCode {
+		t.Fatalf("got %v consuming a code twice, want %v", err, ErrInvalidAuthCode)
+	}
+
+	expired := *issued
+	expired.ExpiresAt = time.Now().Add(-time.Second).Unix()
+	code, err = d.IssueAuthCode(ctx, &expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, code := range map[string]string{"expired": code, "unknown": "not-a-code"} {
+		if _, err := d.ConsumeAuthCode(ctx, code); err != ErrInvalidAuthCode {
+			t.Errorf("%s: got %v, want %v", name, err, ErrInvalidAuthCode)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package dao
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	insertClientSQL            = "INSERT INTO client(id, secret, name, firstparty, scope, publickey, audience, encryptionkey, createdat) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+	insertClientRedirectURISQL = "INSERT INTO client_redirect_uris(clientid, uri) VALUES($1, $2)"
+	selectClientSQL            = "SELECT id, secret, name, firstparty, scope, publickey, audience, encryptionkey FROM client WHERE id=?"
+	selectClientRedirectURISQL = "SELECT uri FROM client_redirect_uris WHERE clientid=?"
+)
+
+var (
+	// ErrClientNotFound is a flag error to indicate a not found client
+	ErrClientNotFound = errors.New("client not found")
+
+	// ErrInvalidClient is returned when a client fails to authenticate
+	ErrInvalidClient = errors.New("invalid client credentials")
+)
+
+// Client represents an OAuth 2.0 client allowed to call the server
+type Client struct {
+	ID   string
+	Name string
+	// SecretHash is the PHC string of the client secret, empty for public clients
+	SecretHash string `json:"-"`
+	// FirstParty clients are our own apps, they act for the tokens of the logins
+	// that weren't issued to any client
+	FirstParty bool
+	// RedirectURIs is the allowlist of the authorization code flow redirections
+	RedirectURIs []string
+	// Scopes are the scopes the client can get tokens for with the client_credentials grant
+	Scopes []string
+	// PublicKey is the PEM public key verifying the client assertions of private_key_jwt authentication
+	PublicKey string `json:"-"`
+	// Audience is the `aud` claim of the access tokens issued to the client, the API
+	// or resource server the tokens are meant for, empty to use the default audience
+	Audience string
+	// EncryptionKey is the PEM public key of the audience, the access tokens issued
+	// to the client are encrypted to it. It's only used along with Audience
+	EncryptionKey string `json:"-"`
+
+	publicKey     interface{}
+	encryptionKey crypto.PublicKey
+}
+
+// IsPublic reports whether the client can't keep a secret, like a mobile or browser app
+func (c *Client) IsPublic() bool {
+	return c.SecretHash == "" && c.PublicKey == ""
+}
+
+// HasRedirectURI reports whether uri is registered, it must match exactly
+func (c *Client) HasRedirectURI(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsScope reports whether every scope of the space separated list is allowed to the client
+func (c *Client) AllowsScope(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		found := false
+		for _, allowed := range c.Scopes {
+			if s == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// GetPublicKey parses the PKIX public key of the client, nil when it doesn't use private_key_jwt
+func (c *Client) GetPublicKey() (interface{}, error) {
+	if c.publicKey != nil || c.PublicKey == "" {
+		return c.publicKey, nil
+	}
+
+	block, _ := pem.Decode([]byte(c.PublicKey))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM public key of client %q", c.ID)
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key of client %q: %w", c.ID, err)
+	}
+	c.publicKey = pubKey
+	return pubKey, nil
+}
+
+// GetEncryptionKey parses the PKIX encryption key of the client audience,
+// nil when its tokens aren't encrypted
+func (c *Client) GetEncryptionKey() (crypto.PublicKey, error) {
+	if c.encryptionKey != nil || c.EncryptionKey == "" || c.Audience == "" {
+		return c.encryptionKey, nil
+	}
+
+	pubKey, err := parsePublicKey(c.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encryption key of client %q: %w", c.ID, err)
+	}
+	c.encryptionKey = pubKey
+	return pubKey, nil
+}
+
+// InsertClient registers a new client with its redirect URIs
+func (d *DAO) InsertClient(ctx context.Context, c *Client) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, insertClientSQL, c.ID, c.SecretHash, c.Name, c.FirstParty,
+		strings.Join(c.Scopes, " "), c.PublicKey, c.Audience, c.EncryptionKey, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to insert client: %w", err)
+	}
+	countRows, _ := result.RowsAffected()
+	if countRows != 1 {
+		return fmt.Errorf("unexpected error inserting client: %+v", *c)
+	}
+	for _, uri := range c.RedirectURIs {
+		if _, err := tx.ExecContext(ctx, insertClientRedirectURISQL, c.ID, uri); err != nil {
+			return fmt.Errorf("failed to insert client redirect uri: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetClient fetchs a client by ID
+func (d *DAO) GetClient(ctx context.Context, id string) (*Client, error) {
+	c := new(Client)
+	var scope string
+	err := d.db.QueryRowContext(ctx, selectClientSQL, id).Scan(&c.ID, &c.SecretHash, &c.Name, &c.FirstParty, &scope, &c.PublicKey, &c.Audience, &c.EncryptionKey)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrClientNotFound
+	case err != nil:
+		return nil, fmt.Errorf("select client error: %w", err)
+	}
+	c.Scopes = strings.Fields(scope)
+
+	rows, err := d.db.QueryContext(ctx, selectClientRedirectURISQL, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select client redirect uris: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uri string
+		if err := rows.Scan(&uri); err != nil {
+			return nil, fmt.Errorf("failed to scan client redirect uri: %w", err)
+		}
+		c.RedirectURIs = append(c.RedirectURIs, uri)
+	}
+	return c, rows.Err()
+}
+
+// AuthenticateClient fetchs a confidential client by ID and secret
+func (d *DAO) AuthenticateClient(ctx context.Context, id, secret string) (*Client, error) {
+	c, err := d.GetClient(ctx, id)
+	if err == ErrClientNotFound {
+		verifyPassword(secret, dummyPasswordHash)
+		return nil, ErrInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.SecretHash == "" {
+		return nil, ErrInvalidClient
+	}
+
+	ok, err := verifyPassword(secret, c.SecretHash)
+	if err != nil {
+		return nil, fmt.Errorf("verify client secret error: %w", err)
+	}
+	if !ok {
+		return nil, ErrInvalidClient
+	}
+	return c, nil
+}
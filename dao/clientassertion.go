@@ -0,0 +1,39 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	insertClientAssertionSQL  = "INSERT INTO client_assertions(clientid, jti, expiresat) VALUES($1, $2, $3)"
+	deleteClientAssertionsSQL = "DELETE FROM client_assertions WHERE expiresat<=?"
+)
+
+// ErrAssertionReplayed is returned when a client assertion was already used
+var ErrAssertionReplayed = errors.New("client assertion already used")
+
+// UseClientAssertion records the `jti` of a client assertion until it expires, ErrAssertionReplayed
+// means the client already used it. The insert is the check, so concurrent requests can't both
+// use the same assertion. The entries of expired assertions are pruned at the same time
+func (d *DAO) UseClientAssertion(ctx context.Context, clientID, jti string, expiresAt time.Time) error {
+	result, err := d.db.ExecContext(ctx, insertClientAssertionSQL, clientID, jti, expiresAt.Unix())
+	if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return ErrAssertionReplayed
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert client assertion: %w", err)
+	}
+	if countRows, _ := result.RowsAffected(); countRows != 1 {
+		return ErrAssertionReplayed
+	}
+
+	if _, err := d.db.ExecContext(ctx, deleteClientAssertionsSQL, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to prune client assertions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package dao
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUseClientAssertion(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+	expiresAt := time.Now().Add(time.Minute)
+
+	if err := d.UseClientAssertion(ctx, "reports-service", "jti-1", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UseClientAssertion(ctx, "reports-service", "jti-1", expiresAt); err != ErrAssertionReplayed {
+		t.Fatalf("got %v replaying the assertion, want %v", err, ErrAssertionReplayed)
+	}
+	// the jti is only unique for its client
+	if err := d.UseClientAssertion(ctx, "clinic-integration", "jti-1", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+
+	// the assertion jti isn't an access token revocation
+	revoked, err := d.IsJTIRevoked(ctx, "jti-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked {
+		t.Fatal("using a client assertion revoked the access token with its jti")
+	}
+}
+
+func TestUseClientAssertionConcurrently(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+	expiresAt := time.Now().Add(time.Minute)
+
+	const requests = 8
+	errs := make(chan error, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- d.UseClientAssertion(ctx, "reports-service", "jti-1", expiresAt)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	used := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			used++
+		case ErrAssertionReplayed:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if used != 1 {
+		t.Fatalf("the assertion was used %d times, want once", used)
+	}
+}
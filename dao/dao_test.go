@@ -0,0 +1,53 @@
+package dao
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDAO returns a DAO over a fresh migrated database
+func newTestDAO(t *testing.T) *DAO {
+	t.Helper()
+
+	d, err := NewDAO(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	if err := d.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// insertTestJWK adds a new pending key
+func insertTestJWK(t *testing.T, d *DAO) *JWK {
+	t.Helper()
+
+	privateKey, publicKey, err := GeneratePrivatePublicKeyPair(DefaultRSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := &JWK{PrivateKey: privateKey, PublicKey: publicKey, ExpiresAt: time.Now().Add(JWKExpiration).Unix()}
+	if err := d.InsertJWK(context.Background(), jwk); err != nil {
+		t.Fatal(err)
+	}
+	return jwk
+}
+
+// jwkStates returns the state of every key by key ID
+func jwkStates(t *testing.T, d *DAO) map[string]KeyState {
+	t.Helper()
+
+	jwks, err := d.GetJWKS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]KeyState{}
+	for _, j := range jwks {
+		states[j.KID] = j.State
+	}
+	return states
+}
@@ -0,0 +1,427 @@
+package dao
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/go-jose/v3"
+)
+
+const (
+	jwkFileExt = ".json"
+	pemFileExt = ".pem"
+)
+
+// keyFileMetadata are the members added to the JWK in the key files,
+// they have the same meaning as the JWK fields
+type keyFileMetadata struct {
+	// PrivateKey is the private key encrypted with the KEK, the JWK is then the public key
+	PrivateKey  string   `json:"private_key,omitempty"`
+	State       KeyState `json:"state,omitempty"`
+	ExpiresAt   int64    `json:"expires_at,omitempty"`
+	CreatedAt   int64    `json:"created_at,omitempty"`
+	ActivatedAt int64    `json:"activated_at,omitempty"`
+	RetiredAt   int64    `json:"retired_at,omitempty"`
+	RevokedAt   int64    `json:"revoked_at,omitempty"`
+}
+
+// DirKeyStore keeps the JWKs in a directory, as a mounted Kubernetes secret, one key per file:
+//   - <name>.json holds a private JWK (RFC 7517) and optionally the keyFileMetadata members,
+//     or a public JWK when the private key is held by an external signer
+//   - <name>.pem holds a PKCS1 or PKCS8 PEM private key
+//
+// Keys without `kid` are identified by their thumbprint, keys without `alg` get the default one
+// for their type, keys without state are active and keys without expires_at expire JWKExpiration
+// after the file was modified. The directory is read on every call so changes are picked up.
+// New keys and state changes are written as <kid>.json, which needs a writable directory.
+// Hidden files are ignored. With a KEK the private keys are written encrypted as the private_key
+// member of a public JWK, like in the database, and the plaintext files are encrypted once rewritten
+type DirKeyStore struct {
+	dir string
+	kek *KEK
+	// mu serializes the writes
+	mu sync.Mutex
+}
+
+// NewDirKeyStore creates a DirKeyStore reading the keys in dir, the private keys are
+// stored in plaintext when kek is nil
+func NewDirKeyStore(dir string, kek *KEK) (*DirKeyStore, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("key directory %q is not a directory", dir)
+	}
+
+	s := &DirKeyStore{dir: dir, kek: kek}
+	keys, paths, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for kid, j := range keys {
+		if !isEncryptedKey(j.PrivateKey) {
+			log.Printf("The private key of JWK %q is stored in plaintext in %q", kid, paths[kid])
+		}
+	}
+	return s, nil
+}
+
+// GetJWKS returns all JWK in the directory, ordered by expiration time
+func (s *DirKeyStore) GetJWKS(ctx context.Context) ([]*JWK, error) {
+	keys, _, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*JWK, 0, len(keys))
+	for _, j := range keys {
+		results = append(results, j)
+	}
+	sortJWKS(results)
+	return results, nil
+}
+
+// GetJWK returns the JWK with the key ID
+func (s *DirKeyStore) GetJWK(ctx context.Context, kid string) (*JWK, error) {
+	keys, _, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	j, ok := keys[kid]
+	if !ok {
+		return nil, ErrJWKNotFound
+	}
+	return j, nil
+}
+
+// InsertJWK writes a JWK in pending state to <kid>.json
+func (s *DirKeyStore) InsertJWK(ctx context.Context, j *JWK) error {
+	if err := j.initPending(time.Now()); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, _, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := keys[j.KID]; ok {
+		return fmt.Errorf("failed to insert jwks: jwk %q already exists", j.KID)
+	}
+	return s.write(j, "", s.kek)
+}
+
+// UpdateJWKState moves the key to active, retiring or revoked, rewriting the changed keys
+func (s *DirKeyStore) UpdateJWKState(ctx context.Context, kid string, state KeyState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, paths, err := s.load()
+	if err != nil {
+		return err
+	}
+	changed, err := transitionKeys(keys, kid, state, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, j := range changed {
+		if err := s.write(j, paths[j.KID], s.kek); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeJWK deletes the file of a retiring or revoked key
+func (s *DirKeyStore) PurgeJWK(ctx context.Context, kid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, paths, err := s.load()
+	if err != nil {
+		return err
+	}
+	j, ok := keys[kid]
+	if !ok {
+		return ErrJWKNotFound
+	}
+	if err := checkTransition(kid, j.State, purgeableKeyStates); err != nil {
+		return err
+	}
+	if err := os.Remove(paths[kid]); err != nil {
+		return fmt.Errorf("failed to delete jwk: %w", err)
+	}
+	return nil
+}
+
+// RewrapJWKs wraps the data keys of the encrypted private keys with the new KEK, encrypting the
+// plaintext ones with it. The files are rewritten one by one, the keys already wrapped with the
+// new KEK are skipped so a failed re-wrapping can be resumed. The store must be created again
+// with the new KEK to use them
+func (s *DirKeyStore) RewrapJWKs(ctx context.Context, newKEK *KEK) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.kek == nil {
+		return ErrKEKRequired
+	}
+	keys, paths, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	var rewrapped []*JWK
+	for kid, j := range keys {
+		switch {
+		case j.IsExternal() || strings.HasPrefix(j.PrivateKey, encryptedKeyPrefix+newKEK.ID+":"):
+			continue
+		case isEncryptedKey(j.PrivateKey):
+			if j.PrivateKey, err = s.kek.rewrap(kid, j.PrivateKey, newKEK); err != nil {
+				return fmt.Errorf("failed to update private key of jwk %q: %w", kid, err)
+			}
+		}
+		rewrapped = append(rewrapped, j)
+	}
+
+	for _, j := range rewrapped {
+		if err := s.write(j, paths[j.KID], newKEK); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads every key file, returning the keys and their file paths by key ID
+func (s *DirKeyStore) load() (map[string]*JWK, map[string]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read key directory: %w", err)
+	}
+
+	keys := map[string]*JWK{}
+	paths := map[string]string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if strings.HasPrefix(name, ".") || (ext != jwkFileExt && ext != pemFileExt) {
+			continue
+		}
+
+		path := filepath.Join(s.dir, name)
+		j, err := readKeyFile(path, s.kek)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read key file %q: %w", name, err)
+		}
+		if other, ok := paths[j.KID]; ok {
+			return nil, nil, fmt.Errorf("key files %q and %q have the same kid %q", filepath.Base(other), name, j.KID)
+		}
+		keys[j.KID] = j
+		paths[j.KID] = path
+	}
+	return keys, paths, nil
+}
+
+// readKeyFile parses a JWK or PEM key file, filling in the defaults. Encrypted private keys
+// are only decrypted by JWK.GetPrivateKey, with the kek
+func readKeyFile(path string, kek *KEK) (*JWK, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		signer    crypto.Signer
+		publicKey crypto.PublicKey
+		kid       string
+		alg       string
+		meta      keyFileMetadata
+	)
+	if filepath.Ext(path) == pemFileExt {
+		if signer, err = parsePrivateKey(string(data)); err != nil {
+			return nil, err
+		}
+		publicKey = signer.Public()
+	} else {
+		var key jose.JSONWebKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, err
+		}
+		if key.Use != "" && key.Use != "sig" {
+			return nil, fmt.Errorf("unexpected key use %q", key.Use)
+		}
+		switch {
+		case meta.PrivateKey != "":
+			if !isEncryptedKey(meta.PrivateKey) || !key.IsPublic() || key.KeyID == "" {
+				return nil, errMalformedEncryptedKey
+			}
+			publicKey = key.Key
+		case key.IsPublic():
+			// the private key is held by an external signer
+			publicKey = key.Key
+		default:
+			var ok bool
+			if signer, ok = key.Key.(crypto.Signer); !ok {
+				return nil, fmt.Errorf("unexpected private key type %T", key.Key)
+			}
+			publicKey = signer.Public()
+		}
+		kid, alg = key.KeyID, key.Algorithm
+	}
+
+	if alg == "" {
+		if alg, err = defaultKeyAlgorithm(publicKey); err != nil {
+			return nil, err
+		}
+	}
+	publicPem, err := EncodePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	privatePem := meta.PrivateKey
+	if signer != nil {
+		if privatePem, err = encodePrivateKey(signer); err != nil {
+			return nil, err
+		}
+	}
+
+	j := &JWK{
+		KID:         kid,
+		PrivateKey:  privatePem,
+		PublicKey:   publicPem,
+		Algorithm:   alg,
+		ExpiresAt:   meta.ExpiresAt,
+		State:       meta.State,
+		CreatedAt:   meta.CreatedAt,
+		ActivatedAt: meta.ActivatedAt,
+		RetiredAt:   meta.RetiredAt,
+		RevokedAt:   meta.RevokedAt,
+		privateKey:  signer,
+		kek:         kek,
+	}
+	// checks the key matches the algorithm
+	if _, err := j.GetPublicKey(); err != nil {
+		return nil, err
+	}
+	if j.KID == "" {
+		if j.KID, err = j.Thumbprint(); err != nil {
+			return nil, err
+		}
+	}
+	if j.State == "" {
+		j.State = KeyStateActive
+	}
+	if j.CreatedAt == 0 {
+		j.CreatedAt = info.ModTime().Unix()
+	}
+	if j.ExpiresAt == 0 {
+		j.ExpiresAt = info.ModTime().Add(JWKExpiration).Unix()
+	}
+	return j, nil
+}
+
+// write saves the key to <kid>.json replacing it atomically, then deletes
+// its previous file when it was another one. The private key is encrypted with kek, if any
+func (s *DirKeyStore) write(j *JWK, previousPath string, kek *KEK) error {
+	if j.KID == "" || strings.HasPrefix(j.KID, ".") || strings.ContainsAny(j.KID, `/\`) {
+		return fmt.Errorf("jwk %q can't be used as file name", j.KID)
+	}
+	data, err := marshalKeyFile(j, kek)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".jwk-*")
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+
+	path := filepath.Join(s.dir, j.KID+jwkFileExt)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+	if previousPath != "" && previousPath != path {
+		if err := os.Remove(previousPath); err != nil {
+			return fmt.Errorf("failed to delete previous key file: %w", err)
+		}
+	}
+	return nil
+}
+
+// marshalKeyFile encodes the key as a private JWK with the keyFileMetadata members or,
+// with a KEK, as a public JWK with the encrypted private key. Keys held by an external
+// signer are encoded as public JWKs
+func marshalKeyFile(j *JWK, kek *KEK) ([]byte, error) {
+	var (
+		key        interface{}
+		privateKey string
+		err        error
+	)
+	switch {
+	case j.IsExternal():
+		key, err = j.GetPublicKey()
+	case kek != nil && isEncryptedKey(j.PrivateKey):
+		key, err = j.GetPublicKey()
+		privateKey = j.PrivateKey
+	case kek != nil:
+		key, err = j.GetPublicKey()
+		if err == nil {
+			privateKey, err = kek.encrypt(j.KID, j.PrivateKey)
+		}
+	default:
+		key, err = j.GetPrivateKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	jwk, err := json.Marshal(jose.JSONWebKey{Key: key, KeyID: j.KID, Algorithm: j.Algorithm, Use: "sig"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode jwk: %w", err)
+	}
+	meta, err := json.Marshal(keyFileMetadata{
+		PrivateKey:  privateKey,
+		State:       j.State,
+		ExpiresAt:   j.ExpiresAt,
+		CreatedAt:   j.CreatedAt,
+		ActivatedAt: j.ActivatedAt,
+		RetiredAt:   j.RetiredAt,
+		RevokedAt:   j.RevokedAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	members := map[string]json.RawMessage{}
+	if err := json.Unmarshal(jwk, &members); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(meta, &members); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(members, "", "  ")
+}
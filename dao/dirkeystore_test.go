@@ -0,0 +1,274 @@
+package dao
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/square/go-jose/v3"
+)
+
+// writeKeyFile writes a key file to the directory
+func writeKeyFile(t *testing.T, dir, name, data string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestSigner generates an ES256 private key
+func newTestSigner(t *testing.T) crypto.Signer {
+	t.Helper()
+
+	privatePem, _, err := GenerateKeyPair(KeySpec{Algorithm: AlgES256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := parsePrivateKey(privatePem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// marshalTestJWK encodes the key as a JWK with the key ID, for signatures with ES256
+func marshalTestJWK(t *testing.T, key interface{}, kid string) string {
+	t.Helper()
+
+	data, err := json.Marshal(jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: AlgES256, Use: "sig"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// readKeyFileMembers returns the members of the JSON key file of the key
+func readKeyFileMembers(t *testing.T, dir, kid string) map[string]interface{} {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, kid+jwkFileExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := map[string]interface{}{}
+	if err := json.Unmarshal(data, &members); err != nil {
+		t.Fatal(err)
+	}
+	return members
+}
+
+func TestDirKeyStoreKeyFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// a PEM private key, with the defaults for everything else
+	privatePem, _, err := GenerateKeyPair(KeySpec{Algorithm: AlgES384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, dir, "signing.pem", privatePem)
+
+	// a private JWK with its state
+	jwk := marshalTestJWK(t, newTestSigner(t), "previous")
+	writeKeyFile(t, dir, "previous.json", strings.TrimSuffix(jwk, "}")+`,"state":"retiring","retired_at":1}`)
+
+	// ignored files
+	writeKeyFile(t, dir, ".hidden.pem", "not a key")
+	writeKeyFile(t, dir, "README.txt", "not a key")
+
+	keys, err := NewDirKeyStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := keys.GetJWKS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks) != 2 {
+		t.Fatalf("got %d keys, want the PEM and JWK files", len(jwks))
+	}
+	byKID := map[string]*JWK{}
+	for _, j := range jwks {
+		byKID[j.KID] = j
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "signing.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := parsePrivateKey(privatePem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPem, err := EncodePublicKey(privateKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbprint, err := (&JWK{PublicKey: publicPem, Algorithm: AlgES384}).Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signing, ok := byKID[thumbprint]
+	if !ok {
+		t.Fatalf("got keys %v, want the PEM key identified by its thumbprint %s", byKID, thumbprint)
+	}
+	if signing.Algorithm != AlgES384 || signing.State != KeyStateActive || signing.ExpiresAt != info.ModTime().Add(JWKExpiration).Unix() {
+		t.Fatalf("got key %+v, want an active ES384 key expiring a year after the file was modified", signing)
+	}
+	if previous := byKID["previous"]; previous == nil || previous.State != KeyStateRetiring || previous.RetiredAt != 1 {
+		t.Fatalf("got key %+v, want the retiring key of the JWK file", previous)
+	}
+
+	// activating a new key rewrites the PEM file as <kid>.json
+	next := insertStoreJWK(t, keys)
+	if err := keys.UpdateJWKState(ctx, next.KID, KeyStateActive); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "signing.pem")); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want the PEM file replaced", err)
+	}
+	if members := readKeyFileMembers(t, dir, thumbprint); members["state"] != string(KeyStateRetiring) || members["d"] == nil {
+		t.Fatalf("got key file %v, want the retiring private JWK", members)
+	}
+
+	// two files with the same key
+	writeKeyFile(t, dir, "copy.pem", privatePem)
+	if _, err := keys.GetJWKS(ctx); err == nil {
+		t.Fatal("got the keys with a duplicated kid, want an error")
+	}
+}
+
+func TestDirKeyStoreRejectsInvalidFiles(t *testing.T) {
+	signer := newTestSigner(t)
+	privateJWK := marshalTestJWK(t, signer, "key")
+	files := map[string]string{
+		"not a PEM":         "not a key",
+		"encryption JWK":    strings.Replace(privateJWK, `"use":"sig"`, `"use":"enc"`, 1),
+		"another algorithm": strings.Replace(privateJWK, `"alg":"ES256"`, `"alg":"ES384"`, 1),
+		"plaintext private_key": strings.TrimSuffix(marshalTestJWK(t, signer.Public(), "key"), "}") +
+			`,"private_key":"not encrypted"}`,
+	}
+	for name, data := range files {
+		dir := t.TempDir()
+		ext := jwkFileExt
+		if name == "not a PEM" {
+			ext = pemFileExt
+		}
+		writeKeyFile(t, dir, "key"+ext, data)
+		if _, err := NewDirKeyStore(dir, nil); err == nil {
+			t.Errorf("%s: got a key store, want an error", name)
+		}
+	}
+
+	if _, err := NewDirKeyStore(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Fatal("got a key store of a missing directory, want an error")
+	}
+}
+
+func TestDirKeyStoreExternalKeys(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// a public JWK is a key whose private key is held by an external signer
+	writeKeyFile(t, dir, "external.json", marshalTestJWK(t, newTestSigner(t).Public(), "external"))
+
+	keys, err := NewDirKeyStore(dir, newTestKEK(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := keys.GetJWK(ctx, "external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !jwk.IsExternal() {
+		t.Fatalf("got key %+v, want a key held by an external signer", jwk)
+	}
+	if _, err := jwk.GetPrivateKey(); !errors.Is(err, ErrExternalPrivateKey) {
+		t.Fatalf("got %v reading the private key, want %v", err, ErrExternalPrivateKey)
+	}
+
+	// it stays a public JWK when rewritten, even with a KEK
+	if err := keys.UpdateJWKState(ctx, jwk.KID, KeyStateRevoked); err != nil {
+		t.Fatal(err)
+	}
+	if members := readKeyFileMembers(t, dir, jwk.KID); members["state"] != string(KeyStateRevoked) || members["d"] != nil || members["private_key"] != nil {
+		t.Fatalf("got key file %v, want the revoked public JWK", members)
+	}
+}
+
+func TestDirKeyStoreKEK(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	privatePem, _, err := GenerateKeyPair(KeySpec{Algorithm: AlgEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, dir, "plaintext.pem", privatePem)
+
+	kek := newTestKEK(t)
+	keys, err := NewDirKeyStore(dir, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// new keys and rewritten keys are encrypted
+	jwk := insertStoreJWK(t, keys)
+	if err := keys.UpdateJWKState(ctx, jwk.KID, KeyStateActive); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.pem")); len(matches) != 0 {
+		t.Fatalf("got files %v, want the plaintext PEM file rewritten", matches)
+	}
+	jwks, err := keys.GetJWKS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range jwks {
+		members := readKeyFileMembers(t, dir, j.KID)
+		privateKey, _ := members["private_key"].(string)
+		if members["d"] != nil || !strings.HasPrefix(privateKey, encryptedKeyPrefix+kek.ID+":") {
+			t.Fatalf("got key file %v, want a public JWK with the encrypted private key", members)
+		}
+		if _, err := j.GetPrivateKey(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the encrypted keys can't be used without their KEK
+	assertPrivateKeyErr := func(keys *DirKeyStore, want error) {
+		t.Helper()
+
+		j, err := keys.GetJWK(ctx, jwk.KID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := j.GetPrivateKey(); !errors.Is(err, want) {
+			t.Fatalf("got %v reading the private key, want %v", err, want)
+		}
+	}
+	withoutKEK, err := NewDirKeyStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPrivateKeyErr(withoutKEK, ErrKEKRequired)
+	if err := withoutKEK.RewrapJWKs(ctx, newTestKEK(t)); err != ErrKEKRequired {
+		t.Fatalf("got %v re-wrapping without a KEK, want %v", err, ErrKEKRequired)
+	}
+
+	newKEK := newTestKEK(t)
+	if err := keys.RewrapJWKs(ctx, newKEK); err != nil {
+		t.Fatal(err)
+	}
+	assertPrivateKeyErr(keys, ErrWrongKEK)
+	rewrapped, err := NewDirKeyStore(dir, newKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPrivateKeyErr(rewrapped, nil)
+}
@@ -0,0 +1,59 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	insertEncryptedTokenSQL  = "INSERT INTO encrypted_tokens(hash, jti, kid, claims, expiresat) VALUES($1, $2, $3, $4, $5)"
+	selectEncryptedTokenSQL  = "SELECT jti, kid, claims, expiresat FROM encrypted_tokens WHERE hash=? AND expiresat>?"
+	deleteEncryptedTokensSQL = "DELETE FROM encrypted_tokens WHERE expiresat<=?"
+)
+
+// ErrEncryptedTokenNotFound is returned when a token wasn't recorded as encrypted or it expired
+var ErrEncryptedTokenNotFound = errors.New("encrypted token not found")
+
+// EncryptedToken records an access token encrypted to the key of a client audience, that we
+// can't decrypt, so it can still be revoked and introspected. Only the token hash is kept
+type EncryptedToken struct {
+	JTI string
+	// KID is the key the nested JWT is signed with
+	KID string
+	// Claims are the JSON claims of the nested JWT
+	Claims    []byte
+	ExpiresAt int64
+}
+
+// InsertEncryptedToken records the token until it expires,
+// the records of expired tokens are pruned at the same time
+func (d *DAO) InsertEncryptedToken(ctx context.Context, token string, et *EncryptedToken) error {
+	_, err := d.db.ExecContext(ctx, insertEncryptedTokenSQL, HashToken(token), et.JTI, et.KID, string(et.Claims), et.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert encrypted token: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, deleteEncryptedTokensSQL, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to prune encrypted tokens: %w", err)
+	}
+	return nil
+}
+
+// GetEncryptedToken returns the record of the token, or ErrEncryptedTokenNotFound
+func (d *DAO) GetEncryptedToken(ctx context.Context, token string) (*EncryptedToken, error) {
+	et := new(EncryptedToken)
+	var claims string
+	err := d.db.QueryRowContext(ctx, selectEncryptedTokenSQL, HashToken(token), time.Now().Unix()).
+		Scan(&et.JTI, &et.KID, &claims, &et.ExpiresAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrEncryptedTokenNotFound
+	case err != nil:
+		return nil, fmt.Errorf("select encrypted token error: %w", err)
+	}
+	et.Claims = []byte(claims)
+	return et, nil
+}
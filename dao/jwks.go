@@ -2,69 +2,162 @@ package dao
 
 import (
 	"context"
+	"crypto"
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"database/sql"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"time"
+
+	"github.com/square/go-jose/v3"
 )
 
 const (
-	insertJWKSQL  = "INSERT INTO jwks(privatekey, publickey, expiresat) VALUES($1, $2, $3)"
-	selectJWKSSQL = "SELECT privatekey, publickey, expiresat FROM jwks ORDER BY expiresat DESC"
+	insertJWKSQL  = "INSERT INTO jwks(kid, privatekey, publickey, alg, expiresat, state, createdat) VALUES($1, $2, $3, $4, $5, $6, $7)"
+	selectJWKSSQL = `SELECT kid, privatekey, publickey, alg, expiresat, state, createdat, activatedat, retiredat, revokedat
+	FROM jwks ORDER BY expiresat DESC`
+	selectJWKSQL = `SELECT kid, privatekey, publickey, alg, expiresat, state, createdat, activatedat, retiredat, revokedat
+	FROM jwks WHERE kid=?`
 )
 
+// ErrExternalPrivateKey is returned reading the private key of a key held by an external signer
+var ErrExternalPrivateKey = errors.New("the private key is held by an external signer")
+
 // JWK represents a JSON Web Key
 type JWK struct {
+	// KID is the key ID, the RFC 7638 thumbprint of the public key
+	KID string
+	// PrivateKey is the PEM private key, encrypted when the DAO has a KEK.
+	// It's empty when the private key is held by an external signer
 	PrivateKey string
 	PublicKey  string
-	ExpiresAt  int64
+	// Algorithm is the JWS `alg` the key signs with
+	Algorithm string
+	// ExpiresAt is the time the key should stop signing
+	ExpiresAt int64
+
+	State       KeyState
+	CreatedAt   int64
+	ActivatedAt int64
+	RetiredAt   int64
+	RevokedAt   int64
 
-	privateRSAKey *rsa.PrivateKey
-	publicRSAKey  *rsa.PublicKey
+	privateKey crypto.Signer
+	publicKey  crypto.PublicKey
+	// kek decrypts the private key
+	kek *KEK
 }
 
-// GetRSAPrivateKey returns a RSA private key
-func (j *JWK) GetRSAPrivateKey() (*rsa.PrivateKey, error) {
-	if j.privateRSAKey == nil {
-		// parse the private key once
-		block, _ := pem.Decode([]byte(j.PrivateKey))
-		if block == nil || block.Type != rsaPrivateKeyType {
-			return nil, fmt.Errorf("failed to decode PEM block containing %s", rsaPrivateKeyType)
+// GetPrivateKey returns the private key, decrypted and parsed once.
+// It's the only place private keys are decrypted
+func (j *JWK) GetPrivateKey() (crypto.Signer, error) {
+	if j.IsExternal() {
+		return nil, fmt.Errorf("jwk %q: %w", j.KID, ErrExternalPrivateKey)
+	}
+	if j.privateKey == nil {
+		privatePem := j.PrivateKey
+		if isEncryptedKey(privatePem) {
+			if j.kek == nil {
+				return nil, fmt.Errorf("jwk %q: %w", j.KID, ErrKEKRequired)
+			}
+			var err error
+			if privatePem, err = j.kek.decrypt(j.KID, privatePem); err != nil {
+				return nil, fmt.Errorf("jwk %q: %w", j.KID, err)
+			}
 		}
-		pkey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+
+		pkey, err := parsePrivateKey(privatePem)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to parse private key of jwk %q: %w", j.KID, err)
 		}
-		j.privateRSAKey = pkey
+		j.privateKey = pkey
 	}
-	return j.privateRSAKey, nil
+	return j.privateKey, nil
 }
 
-// GetRSAPublicKey returns a RSA public key
-func (j *JWK) GetRSAPublicKey() (*rsa.PublicKey, error) {
-	if j.publicRSAKey == nil {
-		// parse the private key once
-		block, _ := pem.Decode([]byte(j.PublicKey))
-		if block == nil || block.Type != rsaPublicKeyType {
-			return nil, fmt.Errorf("failed to decode PEM block containing %s", rsaPublicKeyType)
-		}
-		pkey, err := x509.ParsePKIXPublicKey(block.Bytes)
+// IsExternal reports whether the private key is held by an external signer, we only have the public key
+func (j *JWK) IsExternal() bool {
+	return j.PrivateKey == "" && j.privateKey == nil
+}
+
+// GetPublicKey returns the public key, parsed once: *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+func (j *JWK) GetPublicKey() (crypto.PublicKey, error) {
+	if j.publicKey == nil {
+		pkey, err := parsePublicKey(j.PublicKey)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to parse public key of jwk %q: %w", j.KID, err)
 		}
-
-		publicRSAKey, isRSAPublicKey := pkey.(*rsa.PublicKey)
-		if !isRSAPublicKey {
-			return nil, fmt.Errorf("failed to convert public key")
+		if !keyMatchesAlgorithm(pkey, j.Algorithm) {
+			return nil, fmt.Errorf("the public key of jwk %q can't be used with %s", j.KID, j.Algorithm)
 		}
-		j.publicRSAKey = publicRSAKey
+		j.publicKey = pkey
+	}
+	return j.publicKey, nil
+}
+
+// Thumbprint returns the base64url encoded RFC 7638 SHA-256 thumbprint of the public key
+func (j *JWK) Thumbprint() (string, error) {
+	publicKey, err := j.GetPublicKey()
+	if err != nil {
+		return "", err
+	}
+	jwk := jose.JSONWebKey{Key: publicKey}
+	tp, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute jwk thumbprint: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(tp), nil
+}
+
+// NewJWK generates a new key pair following the spec that should stop signing at expiresAt
+func NewJWK(spec KeySpec, expiresAt time.Time) (*JWK, error) {
+	spec = spec.withDefaults()
+	privatekey, publickey, err := GenerateKeyPair(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &JWK{
+		PrivateKey: privatekey,
+		PublicKey:  publickey,
+		Algorithm:  spec.Algorithm,
+		ExpiresAt:  expiresAt.Unix(),
+	}, nil
+}
+
+// Matches reports whether the key was generated following the spec
+func (j *JWK) Matches(spec KeySpec) bool {
+	spec = spec.withDefaults()
+	if j.Algorithm != spec.Algorithm {
+		return false
 	}
-	return j.publicRSAKey, nil
+	if !isRSAAlgorithm(spec.Algorithm) {
+		return true
+	}
+	publicKey, err := j.GetPublicKey()
+	if err != nil {
+		return false
+	}
+	rsaKey, ok := publicKey.(*rsa.PublicKey)
+	return ok && rsaKey.N.BitLen() == spec.RSAKeySize
 }
 
-// InsertJWK adds a JWK par
+// InsertJWK adds a JWK par in pending state, the key ID is set from the public key thumbprint
+// and the creation time to now when empty
 func (d *DAO) InsertJWK(ctx context.Context, j *JWK) error {
-	result, err := d.db.ExecContext(ctx, insertJWKSQL, j.PrivateKey, j.PublicKey, j.ExpiresAt)
+	if err := j.initPending(time.Now()); err != nil {
+		return err
+	}
+	if d.kek != nil && j.PrivateKey != "" && !isEncryptedKey(j.PrivateKey) {
+		privateKey, err := d.kek.encrypt(j.KID, j.PrivateKey)
+		if err != nil {
+			return err
+		}
+		j.PrivateKey = privateKey
+		j.kek = d.kek
+	}
+
+	result, err := d.db.ExecContext(ctx, insertJWKSQL, j.KID, j.PrivateKey, j.PublicKey, j.Algorithm, j.ExpiresAt, j.State, j.CreatedAt)
 	if err != nil {
 		return fmt.Errorf("failed to insert jwks: %+w", err)
 	}
@@ -75,7 +168,27 @@ func (d *DAO) InsertJWK(ctx context.Context, j *JWK) error {
 	return nil
 }
 
-// GetJWKS returns all JWK ordered by expiration time
+// initPending sets the fields of a new pending key, the key ID to the public key thumbprint
+// and the creation time to now when empty
+func (j *JWK) initPending(now time.Time) error {
+	if j.Algorithm == "" {
+		j.Algorithm = DefaultAlgorithm
+	}
+	if j.KID == "" {
+		kid, err := j.Thumbprint()
+		if err != nil {
+			return err
+		}
+		j.KID = kid
+	}
+	j.State = KeyStatePending
+	if j.CreatedAt == 0 {
+		j.CreatedAt = now.Unix()
+	}
+	return nil
+}
+
+// GetJWKS returns all JWK, in any state, ordered by expiration time
 func (d *DAO) GetJWKS(ctx context.Context) ([]*JWK, error) {
 	rows, err := d.db.QueryContext(ctx, selectJWKSSQL)
 	if err != nil {
@@ -85,8 +198,8 @@ func (d *DAO) GetJWKS(ctx context.Context) ([]*JWK, error) {
 
 	var results []*JWK
 	for rows.Next() {
-		j := new(JWK)
-		if err := rows.Scan(&j.PrivateKey, &j.PublicKey, &j.ExpiresAt); err != nil {
+		j, err := d.scanJWK(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan jwk: %w", err)
 		}
 		results = append(results, j)
@@ -94,3 +207,22 @@ func (d *DAO) GetJWKS(ctx context.Context) ([]*JWK, error) {
 
 	return results, nil
 }
+
+// GetJWK returns the JWK with the key ID, in any state
+func (d *DAO) GetJWK(ctx context.Context, kid string) (*JWK, error) {
+	j, err := d.scanJWK(d.db.QueryRowContext(ctx, selectJWKSQL, kid))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrJWKNotFound
+	case err != nil:
+		return nil, fmt.Errorf("select jwk error: %w", err)
+	}
+	return j, nil
+}
+
+func (d *DAO) scanJWK(row interface{ Scan(...interface{}) error }) (*JWK, error) {
+	j := &JWK{kek: d.kek}
+	err := row.Scan(&j.KID, &j.PrivateKey, &j.PublicKey, &j.Algorithm, &j.ExpiresAt,
+		&j.State, &j.CreatedAt, &j.ActivatedAt, &j.RetiredAt, &j.RevokedAt)
+	return j, err
+}
@@ -0,0 +1,198 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// KeyState is the lifecycle state of a JWK
+type KeyState string
+
+const (
+	// KeyStatePending keys are published in the JWKS but not used for signing yet
+	KeyStatePending KeyState = "pending"
+	// KeyStateActive keys sign new tokens
+	KeyStateActive KeyState = "active"
+	// KeyStateRetiring keys are published and only verify previously signed tokens
+	KeyStateRetiring KeyState = "retiring"
+	// KeyStateRevoked keys are removed from the JWKS and their tokens are rejected
+	KeyStateRevoked KeyState = "revoked"
+)
+
+const (
+	selectJWKStateSQL = "SELECT state FROM jwks WHERE kid=?"
+	activateJWKSQL    = "UPDATE jwks SET state=?, activatedat=? WHERE kid=?"
+	retireActiveSQL   = "UPDATE jwks SET state=?, retiredat=? WHERE state=? AND kid<>?"
+	retireJWKSQL      = "UPDATE jwks SET state=?, retiredat=? WHERE kid=?"
+	revokeJWKSQL      = "UPDATE jwks SET state=?, revokedat=? WHERE kid=?"
+	deleteJWKSQL      = "DELETE FROM jwks WHERE kid=?"
+)
+
+var (
+	// ErrJWKNotFound is a flag error to indicate a not found JWK
+	ErrJWKNotFound = errors.New("jwk not found")
+
+	// ErrInvalidKeyTransition is returned when a JWK can't move to the requested state
+	ErrInvalidKeyTransition = errors.New("invalid jwk state transition")
+)
+
+// keyTransitions are the states a key can move to each state from
+var keyTransitions = map[KeyState][]KeyState{
+	KeyStateActive:   {KeyStatePending},
+	KeyStateRetiring: {KeyStateActive},
+	KeyStateRevoked:  {KeyStatePending, KeyStateActive, KeyStateRetiring},
+}
+
+// purgeableKeyStates are the states a key can be deleted from
+var purgeableKeyStates = []KeyState{KeyStateRetiring, KeyStateRevoked}
+
+// IsPublished reports whether the key should be listed in the JWKS
+func (j *JWK) IsPublished() bool {
+	return j.State == KeyStatePending || j.State == KeyStateActive || j.State == KeyStateRetiring
+}
+
+// CanSign reports whether the key can sign new tokens
+func (j *JWK) CanSign() bool {
+	return j.State == KeyStateActive
+}
+
+// CanVerify reports whether tokens signed by the key are still accepted
+func (j *JWK) CanVerify() bool {
+	return j.State == KeyStateActive || j.State == KeyStateRetiring
+}
+
+// UpdateJWKState moves the key to active, retiring or revoked
+func (d *DAO) UpdateJWKState(ctx context.Context, kid string, state KeyState) error {
+	switch state {
+	case KeyStateActive:
+		return d.ActivateJWK(ctx, kid)
+	case KeyStateRetiring:
+		return d.RetireJWK(ctx, kid)
+	case KeyStateRevoked:
+		return d.RevokeJWK(ctx, kid)
+	}
+	return fmt.Errorf("%w: jwk %q can't move to %s", ErrInvalidKeyTransition, kid, state)
+}
+
+// ActivateJWK moves a pending key to active, the previous active keys start retiring
+func (d *DAO) ActivateJWK(ctx context.Context, kid string) error {
+	return d.transitionJWK(ctx, kid, keyTransitions[KeyStateActive], func(tx *sql.Tx, now int64) error {
+		if _, err := tx.ExecContext(ctx, retireActiveSQL, KeyStateRetiring, now, KeyStateActive, kid); err != nil {
+			return fmt.Errorf("failed to retire active jwks: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, activateJWKSQL, KeyStateActive, now, kid); err != nil {
+			return fmt.Errorf("failed to activate jwk: %w", err)
+		}
+		return nil
+	})
+}
+
+// RetireJWK moves an active key to retiring, so it only verifies tokens
+func (d *DAO) RetireJWK(ctx context.Context, kid string) error {
+	return d.transitionJWK(ctx, kid, keyTransitions[KeyStateRetiring], func(tx *sql.Tx, now int64) error {
+		if _, err := tx.ExecContext(ctx, retireJWKSQL, KeyStateRetiring, now, kid); err != nil {
+			return fmt.Errorf("failed to retire jwk: %w", err)
+		}
+		return nil
+	})
+}
+
+// RevokeJWK moves a key in any state to revoked, its tokens won't verify anymore
+func (d *DAO) RevokeJWK(ctx context.Context, kid string) error {
+	return d.transitionJWK(ctx, kid, keyTransitions[KeyStateRevoked], func(tx *sql.Tx, now int64) error {
+		if _, err := tx.ExecContext(ctx, revokeJWKSQL, KeyStateRevoked, now, kid); err != nil {
+			return fmt.Errorf("failed to revoke jwk: %w", err)
+		}
+		return nil
+	})
+}
+
+// PurgeJWK deletes a retiring or revoked key
+func (d *DAO) PurgeJWK(ctx context.Context, kid string) error {
+	return d.transitionJWK(ctx, kid, purgeableKeyStates, func(tx *sql.Tx, _ int64) error {
+		if _, err := tx.ExecContext(ctx, deleteJWKSQL, kid); err != nil {
+			return fmt.Errorf("failed to delete jwk: %w", err)
+		}
+		return nil
+	})
+}
+
+// transitionJWK runs update in a transaction when the key is in one of the from states
+func (d *DAO) transitionJWK(ctx context.Context, kid string, from []KeyState, update func(*sql.Tx, int64) error) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var state KeyState
+	err = tx.QueryRowContext(ctx, selectJWKStateSQL, kid).Scan(&state)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrJWKNotFound
+	case err != nil:
+		return fmt.Errorf("select jwk state error: %w", err)
+	}
+
+	if err := checkTransition(kid, state, from); err != nil {
+		return err
+	}
+	if err := update(tx, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkTransition returns ErrInvalidKeyTransition when state isn't one of the from states
+func checkTransition(kid string, state KeyState, from []KeyState) error {
+	for _, s := range from {
+		if s == state {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: jwk %q is %s", ErrInvalidKeyTransition, kid, state)
+}
+
+// transitionKeys applies the state change of UpdateJWKState to an in memory key set,
+// returning the keys it changed
+func transitionKeys(keys map[string]*JWK, kid string, state KeyState, now time.Time) ([]*JWK, error) {
+	jwk, ok := keys[kid]
+	if !ok {
+		return nil, ErrJWKNotFound
+	}
+	from, ok := keyTransitions[state]
+	if !ok {
+		return nil, fmt.Errorf("%w: jwk %q can't move to %s", ErrInvalidKeyTransition, kid, state)
+	}
+	if err := checkTransition(kid, jwk.State, from); err != nil {
+		return nil, err
+	}
+
+	var changed []*JWK
+	if state == KeyStateActive {
+		for _, other := range keys {
+			if other.State == KeyStateActive {
+				other.setState(KeyStateRetiring, now)
+				changed = append(changed, other)
+			}
+		}
+	}
+	jwk.setState(state, now)
+	return append(changed, jwk), nil
+}
+
+// setState moves the key to state, recording when it happened
+func (j *JWK) setState(state KeyState, now time.Time) {
+	j.State = state
+	switch state {
+	case KeyStateActive:
+		j.ActivatedAt = now.Unix()
+	case KeyStateRetiring:
+		j.RetiredAt = now.Unix()
+	case KeyStateRevoked:
+		j.RevokedAt = now.Unix()
+	}
+}
@@ -0,0 +1,115 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestJWKStateTransitions(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+
+	first := insertTestJWK(t, d)
+	if err := d.ActivateJWK(ctx, first.KID); err != nil {
+		t.Fatal(err)
+	}
+	next := insertTestJWK(t, d)
+	if got := jwkStates(t, d)[next.KID]; got != KeyStatePending {
+		t.Fatalf("got new key state %q, want %q", got, KeyStatePending)
+	}
+
+	tests := []struct {
+		name       string
+		transition func(context.Context, string) error
+		kid        string
+		wantErr    error
+		want       map[string]KeyState
+	}{
+		{
+			name:       "retire a pending key",
+			transition: d.RetireJWK,
+			kid:        next.KID,
+			wantErr:    ErrInvalidKeyTransition,
+			want:       map[string]KeyState{first.KID: KeyStateActive, next.KID: KeyStatePending},
+		},
+		{
+			name:       "activate retires the active key",
+			transition: d.ActivateJWK,
+			kid:        next.KID,
+			want:       map[string]KeyState{first.KID: KeyStateRetiring, next.KID: KeyStateActive},
+		},
+		{
+			name:       "activate an active key",
+			transition: d.ActivateJWK,
+			kid:        next.KID,
+			wantErr:    ErrInvalidKeyTransition,
+			want:       map[string]KeyState{first.KID: KeyStateRetiring, next.KID: KeyStateActive},
+		},
+		{
+			name:       "activate a retiring key",
+			transition: d.ActivateJWK,
+			kid:        first.KID,
+			wantErr:    ErrInvalidKeyTransition,
+			want:       map[string]KeyState{first.KID: KeyStateRetiring, next.KID: KeyStateActive},
+		},
+		{
+			name:       "revoke a retiring key",
+			transition: d.RevokeJWK,
+			kid:        first.KID,
+			want:       map[string]KeyState{first.KID: KeyStateRevoked, next.KID: KeyStateActive},
+		},
+		{
+			name:       "revoke a revoked key",
+			transition: d.RevokeJWK,
+			kid:        first.KID,
+			wantErr:    ErrInvalidKeyTransition,
+			want:       map[string]KeyState{first.KID: KeyStateRevoked, next.KID: KeyStateActive},
+		},
+		{
+			name:       "retire the active key",
+			transition: d.RetireJWK,
+			kid:        next.KID,
+			want:       map[string]KeyState{first.KID: KeyStateRevoked, next.KID: KeyStateRetiring},
+		},
+		{
+			name:       "unknown key",
+			transition: d.RevokeJWK,
+			kid:        "unknown",
+			wantErr:    ErrJWKNotFound,
+			want:       map[string]KeyState{first.KID: KeyStateRevoked, next.KID: KeyStateRetiring},
+		},
+	}
+	for _, tt := range tests {
+		if err := tt.transition(ctx, tt.kid); !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+		}
+		states := jwkStates(t, d)
+		for kid, want := range tt.want {
+			if states[kid] != want {
+				t.Errorf("%s: got key %s %q, want %q", tt.name, kid, states[kid], want)
+			}
+		}
+	}
+}
+
+func TestJWKStatePublication(t *testing.T) {
+	tests := []struct {
+		state     KeyState
+		published bool
+		canSign   bool
+		canVerify bool
+	}{
+		{state: KeyStatePending, published: true},
+		{state: KeyStateActive, published: true, canSign: true, canVerify: true},
+		{state: KeyStateRetiring, published: true, canVerify: true},
+		{state: KeyStateRevoked},
+	}
+	for _, tt := range tests {
+		j := &JWK{State: tt.state}
+		if j.IsPublished() != tt.published || j.CanSign() != tt.canSign || j.CanVerify() != tt.canVerify {
+			t.Errorf("%s: got published %v, sign %v and verify %v, want %v, %v and %v", tt.state,
+				j.IsPublished(), j.CanSign(), j.CanVerify(), tt.published, tt.canSign, tt.canVerify)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package dao
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+const (
+	selectJWKPrivateKeysSQL = "SELECT kid, privatekey FROM jwks"
+	updateJWKPrivateKeySQL  = "UPDATE jwks SET privatekey=? WHERE kid=? AND privatekey=?"
+
+	// encrypted private keys are stored as enc:v1:<kek id>:<wrapped dek>:<ciphertext>
+	encryptedKeyPrefix = "enc:v1:"
+
+	kekSize = 32 // AES-256
+)
+
+var (
+	// ErrKEKRequired is returned reading an encrypted private key without the key-encryption key
+	ErrKEKRequired = errors.New("the private key is encrypted and no key-encryption key is set")
+
+	// ErrWrongKEK is returned when a private key was encrypted with another key-encryption key
+	ErrWrongKEK = errors.New("the private key was encrypted with another key-encryption key")
+
+	errMalformedEncryptedKey = errors.New("malformed encrypted private key")
+)
+
+// KEK is a key-encryption key: every JWK private key is encrypted with its own random
+// data key (AES-256-GCM) and the data key is encrypted (wrapped) with the KEK
+type KEK struct {
+	// ID identifies the KEK in the encrypted keys, so the wrong KEK is detected
+	ID  string
+	key []byte
+}
+
+// NewKEK creates a KEK from 32 random bytes
+func NewKEK(key []byte) (*KEK, error) {
+	if len(key) != kekSize {
+		return nil, fmt.Errorf("the key-encryption key must be %d bytes, got %d", kekSize, len(key))
+	}
+	sum := sha256.Sum256(key)
+	return &KEK{ID: hex.EncodeToString(sum[:8]), key: key}, nil
+}
+
+// LoadKEK reads a base64 encoded KEK from value or, when it's empty, from the file at path,
+// holding either the base64 text or the 32 raw bytes. It returns nil when both are empty
+func LoadKEK(value, path string) (*KEK, error) {
+	if value == "" && path == "" {
+		return nil, nil
+	}
+	if value == "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key-encryption key file: %w", err)
+		}
+		if len(data) == kekSize {
+			return NewKEK(data)
+		}
+		value = string(data)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 key-encryption key: %w", err)
+	}
+	return NewKEK(key)
+}
+
+// SetKEK sets the key-encryption key of the private keys, new keys are encrypted with it
+func (d *DAO) SetKEK(kek *KEK) {
+	d.kek = kek
+}
+
+// EncryptJWKs encrypts the private keys still stored in plaintext, it does nothing without a KEK
+func (d *DAO) EncryptJWKs(ctx context.Context) error {
+	if d.kek == nil {
+		return nil
+	}
+	return d.updatePrivateKeys(ctx, func(kid, privateKey string) (string, error) {
+		if privateKey == "" || isEncryptedKey(privateKey) {
+			return privateKey, nil
+		}
+		log.Printf("Encrypting the private key of JWK %q", kid)
+		return d.kek.encrypt(kid, privateKey)
+	})
+}
+
+// RewrapJWKs wraps the data keys of every private key with the new KEK, the private keys
+// themselves aren't decrypted. The new KEK is used from then on
+func (d *DAO) RewrapJWKs(ctx context.Context, newKEK *KEK) error {
+	if d.kek == nil {
+		return ErrKEKRequired
+	}
+	err := d.updatePrivateKeys(ctx, func(kid, privateKey string) (string, error) {
+		if privateKey == "" {
+			return privateKey, nil
+		}
+		if !isEncryptedKey(privateKey) {
+			return newKEK.encrypt(kid, privateKey)
+		}
+		return d.kek.rewrap(kid, privateKey, newKEK)
+	})
+	if err != nil {
+		return err
+	}
+	d.kek = newKEK
+	return nil
+}
+
+// updatePrivateKeys replaces every private key with the result of update in a single transaction
+func (d *DAO) updatePrivateKeys(ctx context.Context, update func(kid, privateKey string) (string, error)) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, selectJWKPrivateKeysSQL)
+	if err != nil {
+		return fmt.Errorf("failed to select jwk private keys: %w", err)
+	}
+	keys := map[string]string{}
+	for rows.Next() {
+		var kid, privateKey string
+		if err := rows.Scan(&kid, &privateKey); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan jwk private key: %w", err)
+		}
+		keys[kid] = privateKey
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for kid, privateKey := range keys {
+		updated, err := update(kid, privateKey)
+		if err != nil {
+			return fmt.Errorf("failed to update private key of jwk %q: %w", kid, err)
+		}
+		if updated == privateKey {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, updateJWKPrivateKeySQL, updated, kid, privateKey); err != nil {
+			return fmt.Errorf("failed to update jwk private key: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func isEncryptedKey(privateKey string) bool {
+	return strings.HasPrefix(privateKey, encryptedKeyPrefix)
+}
+
+// encrypt seals the PEM private key with a new data key, the kid is authenticated
+// so an encrypted key can't be moved to another row
+func (k *KEK) encrypt(kid, privatePem string) (string, error) {
+	dek := make([]byte, kekSize)
+	if _, err := rand.Read(dek); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+	ciphertext, err := seal(dek, []byte(privatePem), kid)
+	if err != nil {
+		return "", err
+	}
+	wrappedDEK, err := seal(k.key, dek, kid)
+	if err != nil {
+		return "", err
+	}
+	return encryptedKeyPrefix + k.ID + ":" + wrappedDEK + ":" + ciphertext, nil
+}
+
+// decrypt opens a private key sealed by encrypt
+func (k *KEK) decrypt(kid, encrypted string) (string, error) {
+	wrappedDEK, ciphertext, err := k.split(encrypted)
+	if err != nil {
+		return "", err
+	}
+	dek, err := open(k.key, wrappedDEK, kid)
+	if err != nil {
+		return "", err
+	}
+	privatePem, err := open(dek, ciphertext, kid)
+	if err != nil {
+		return "", err
+	}
+	return string(privatePem), nil
+}
+
+// rewrap wraps the data key of the encrypted private key with newKEK
+func (k *KEK) rewrap(kid, encrypted string, newKEK *KEK) (string, error) {
+	wrappedDEK, ciphertext, err := k.split(encrypted)
+	if err != nil {
+		return "", err
+	}
+	dek, err := open(k.key, wrappedDEK, kid)
+	if err != nil {
+		return "", err
+	}
+	if wrappedDEK, err = seal(newKEK.key, dek, kid); err != nil {
+		return "", err
+	}
+	return encryptedKeyPrefix + newKEK.ID + ":" + wrappedDEK + ":" + ciphertext, nil
+}
+
+// split returns the wrapped data key and the ciphertext of an encrypted private key
+func (k *KEK) split(encrypted string) (string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(encrypted, encryptedKeyPrefix), ":")
+	if len(parts) != 3 {
+		return "", "", errMalformedEncryptedKey
+	}
+	if parts[0] != k.ID {
+		return "", "", ErrWrongKEK
+	}
+	return parts[1], parts[2], nil
+}
+
+// seal encrypts with AES-GCM, returning base64(nonce | ciphertext)
+func seal(key, plaintext []byte, additionalData string) (string, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(additionalData))
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts the output of seal
+func open(key []byte, sealed, additionalData string) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return nil, errMalformedEncryptedKey
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(additionalData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,188 @@
+package dao
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestKEK returns a KEK of random bytes
+func newTestKEK(t *testing.T) *KEK {
+	t.Helper()
+
+	key := make([]byte, kekSize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	kek, err := NewKEK(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kek
+}
+
+// storedPrivateKey returns the private key column of the key
+func storedPrivateKey(t *testing.T, d *DAO, kid string) string {
+	t.Helper()
+
+	var privateKey string
+	if err := d.db.QueryRow("SELECT privatekey FROM jwks WHERE kid=?", kid).Scan(&privateKey); err != nil {
+		t.Fatal(err)
+	}
+	return privateKey
+}
+
+// privateKeyErr returns the error reading the private key of the key
+func privateKeyErr(t *testing.T, d *DAO, kid string) error {
+	t.Helper()
+
+	jwks, err := d.GetJWKS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range jwks {
+		if j.KID == kid {
+			_, err := j.GetPrivateKey()
+			return err
+		}
+	}
+	t.Fatalf("key %q not found", kid)
+	return nil
+}
+
+func TestLoadKEK(t *testing.T) {
+	key := make([]byte, kekSize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"kek.txt": []byte(encoded + "\n"),
+		"kek.bin": key,
+		"short":   key[:16],
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := NewKEK(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := map[string][2]string{
+		"base64 value":     {encoded, ""},
+		"base64 file":      {"", filepath.Join(dir, "kek.txt")},
+		"raw file":         {"", filepath.Join(dir, "kek.bin")},
+		"value over files": {encoded, filepath.Join(dir, "short")},
+	}
+	for name, args := range valid {
+		kek, err := LoadKEK(args[0], args[1])
+		if err != nil {
+			t.Errorf("%s: got %v", name, err)
+			continue
+		}
+		if kek.ID != want.ID || !bytes.Equal(kek.key, key) {
+			t.Errorf("%s: got KEK %s, want %s", name, kek.ID, want.ID)
+		}
+	}
+
+	invalid := map[string][2]string{
+		"short value":  {base64.StdEncoding.EncodeToString(key[:16]), ""},
+		"not base64":   {"not base64!", ""},
+		"short file":   {"", filepath.Join(dir, "short")},
+		"missing file": {"", filepath.Join(dir, "missing")},
+	}
+	for name, args := range invalid {
+		if kek, err := LoadKEK(args[0], args[1]); err == nil {
+			t.Errorf("%s: got KEK %s, want an error", name, kek.ID)
+		}
+	}
+
+	if kek, err := LoadKEK("", ""); kek != nil || err != nil {
+		t.Fatalf("got %v, %v without a KEK, want none", kek, err)
+	}
+}
+
+func TestKEKEncryptsPrivateKeys(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+	plaintext := insertTestJWK(t, d)
+
+	// the existing plaintext keys are encrypted by the migrations
+	kek := newTestKEK(t)
+	d.SetKEK(kek)
+	if err := d.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := insertTestJWK(t, d)
+	for _, kid := range []string{plaintext.KID, encrypted.KID} {
+		stored := storedPrivateKey(t, d, kid)
+		if !strings.HasPrefix(stored, encryptedKeyPrefix+kek.ID+":") || strings.Contains(stored, "PRIVATE KEY") {
+			t.Fatalf("got private key %.40q stored for %s, want it encrypted", stored, kid)
+		}
+		if err := privateKeyErr(t, d, kid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.SetKEK(nil)
+	if err := privateKeyErr(t, d, encrypted.KID); !errors.Is(err, ErrKEKRequired) {
+		t.Fatalf("got %v without the KEK, want %v", err, ErrKEKRequired)
+	}
+	d.SetKEK(newTestKEK(t))
+	if err := privateKeyErr(t, d, encrypted.KID); !errors.Is(err, ErrWrongKEK) {
+		t.Fatalf("got %v with another KEK, want %v", err, ErrWrongKEK)
+	}
+
+	// the key ID is authenticated, an encrypted key can't be moved to another key
+	d.SetKEK(kek)
+	_, err := d.db.Exec("UPDATE jwks SET privatekey=? WHERE kid=?", storedPrivateKey(t, d, plaintext.KID), encrypted.KID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := privateKeyErr(t, d, encrypted.KID); err == nil {
+		t.Fatal("got the private key of another key, want an error")
+	}
+}
+
+func TestRewrapJWKs(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+	if err := d.RewrapJWKs(ctx, newTestKEK(t)); err != ErrKEKRequired {
+		t.Fatalf("got %v re-wrapping without a KEK, want %v", err, ErrKEKRequired)
+	}
+
+	oldKEK, newKEK := newTestKEK(t), newTestKEK(t)
+	d.SetKEK(oldKEK)
+	jwk := insertTestJWK(t, d)
+	before := storedPrivateKey(t, d, jwk.KID)
+
+	if err := d.RewrapJWKs(ctx, newKEK); err != nil {
+		t.Fatal(err)
+	}
+	after := storedPrivateKey(t, d, jwk.KID)
+	if !strings.HasPrefix(after, encryptedKeyPrefix+newKEK.ID+":") {
+		t.Fatalf("got private key %.40q, want it wrapped with the new KEK %s", after, newKEK.ID)
+	}
+	// only the data key is wrapped again, the private key isn't encrypted again
+	if before[strings.LastIndex(before, ":"):] != after[strings.LastIndex(after, ":"):] {
+		t.Fatal("got the private key ciphertext changed, want only the data key wrapped again")
+	}
+
+	if err := privateKeyErr(t, d, jwk.KID); err != nil {
+		t.Fatalf("got %v with the new KEK after re-wrapping", err)
+	}
+	d.SetKEK(oldKEK)
+	if err := privateKeyErr(t, d, jwk.KID); !errors.Is(err, ErrWrongKEK) {
+		t.Fatalf("got %v with the old KEK, want %v", err, ErrWrongKEK)
+	}
+}
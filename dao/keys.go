@@ -0,0 +1,195 @@
+package dao
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Signing algorithms of the keys, named as the JWS `alg` header
+const (
+	AlgRS256 = "RS256"
+	AlgRS384 = "RS384"
+	AlgRS512 = "RS512"
+	AlgPS256 = "PS256"
+	AlgPS384 = "PS384"
+	AlgPS512 = "PS512"
+	AlgES256 = "ES256"
+	AlgES384 = "ES384"
+	AlgEdDSA = "EdDSA"
+
+	// DefaultAlgorithm is the algorithm of the keys created before it was recorded per key
+	DefaultAlgorithm = AlgRS256
+
+	pkcs8PrivateKeyType = "PRIVATE KEY"
+)
+
+var (
+	// ErrUnsupportedAlgorithm is returned for algorithms we can't generate keys for
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+
+	// ErrUnsupportedKeySize is returned for RSA modulus sizes other than 2048, 3072 and 4096 bits
+	ErrUnsupportedKeySize = errors.New("unsupported RSA key size")
+)
+
+// SupportedAlgorithms are the algorithms we can generate keys for
+var SupportedAlgorithms = []string{
+	AlgRS256, AlgRS384, AlgRS512,
+	AlgPS256, AlgPS384, AlgPS512,
+	AlgES256, AlgES384, AlgEdDSA,
+}
+
+// KeySpec describes the keys to generate
+type KeySpec struct {
+	// Algorithm is the signing algorithm, DefaultAlgorithm when empty
+	Algorithm string
+	// RSAKeySize is the modulus size in bits of RSA keys, DefaultRSAKeySize when zero
+	RSAKeySize int
+}
+
+// withDefaults returns the spec with the zero values set to the defaults
+func (s KeySpec) withDefaults() KeySpec {
+	if s.Algorithm == "" {
+		s.Algorithm = DefaultAlgorithm
+	}
+	if s.RSAKeySize == 0 && isRSAAlgorithm(s.Algorithm) {
+		s.RSAKeySize = DefaultRSAKeySize
+	}
+	return s
+}
+
+// GenerateKeyPair returns a PEM private and public key pair following the spec
+func GenerateKeyPair(spec KeySpec) (string, string, error) {
+	spec = spec.withDefaults()
+
+	var privateKey crypto.Signer
+	var err error
+	switch spec.Algorithm {
+	case AlgRS256, AlgRS384, AlgRS512, AlgPS256, AlgPS384, AlgPS512:
+		return GeneratePrivatePublicKeyPair(spec.RSAKeySize)
+	case AlgES256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgES384:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case AlgEdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", "", fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, spec.Algorithm)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return encodeKeyPair(privateKey)
+}
+
+// encodeKeyPair returns the PKCS8 PEM private key and the PKIX PEM public key
+func encodeKeyPair(privateKey crypto.Signer) (string, string, error) {
+	privatePem, err := encodePrivateKey(privateKey)
+	if err != nil {
+		return "", "", err
+	}
+	publicPem, err := EncodePublicKey(privateKey.Public())
+	if err != nil {
+		return "", "", err
+	}
+	return privatePem, publicPem, nil
+}
+
+// encodePrivateKey returns the PKCS8 PEM private key
+func encodePrivateKey(privateKey crypto.Signer) (string, error) {
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: pkcs8PrivateKeyType, Bytes: privateKeyBytes})), nil
+}
+
+// EncodePublicKey returns the PKIX PEM public key, the format of JWK.PublicKey
+func EncodePublicKey(publicKey crypto.PublicKey) (string, error) {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: publicKeyType, Bytes: publicKeyBytes})), nil
+}
+
+// parsePrivateKey decodes PKCS1 RSA and PKCS8 private keys
+func parsePrivateKey(privatePem string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(privatePem))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing the private key")
+	}
+
+	switch block.Type {
+	case rsaPrivateKeyType:
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case pkcs8PrivateKeyType:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unexpected private key type %T", key)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+}
+
+// parsePublicKey decodes PKIX public keys
+func parsePublicKey(publicPem string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicPem))
+	if block == nil || block.Type != publicKeyType {
+		return nil, fmt.Errorf("failed to decode PEM block containing %s", publicKeyType)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// keyMatchesAlgorithm reports whether the public key can verify signatures of the algorithm
+func keyMatchesAlgorithm(publicKey crypto.PublicKey, alg string) bool {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return isRSAAlgorithm(alg) && key.N.BitLen() >= minRSAKeySize
+	case *ecdsa.PublicKey:
+		return (alg == AlgES256 && key.Curve == elliptic.P256()) || (alg == AlgES384 && key.Curve == elliptic.P384())
+	case ed25519.PublicKey:
+		return alg == AlgEdDSA
+	}
+	return false
+}
+
+// defaultKeyAlgorithm returns the algorithm of keys without one: RS256 for RSA keys,
+// ES256 or ES384 for P-256 and P-384 keys and EdDSA for Ed25519 keys
+func defaultKeyAlgorithm(publicKey crypto.PublicKey) (string, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return AlgRS256, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return AlgES256, nil
+		case elliptic.P384():
+			return AlgES384, nil
+		}
+		return "", fmt.Errorf("%w: curve %s", ErrUnsupportedAlgorithm, key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return AlgEdDSA, nil
+	}
+	return "", fmt.Errorf("%w: key type %T", ErrUnsupportedAlgorithm, publicKey)
+}
+
+func isRSAAlgorithm(alg string) bool {
+	switch alg {
+	case AlgRS256, AlgRS384, AlgRS512, AlgPS256, AlgPS384, AlgPS512:
+		return true
+	}
+	return false
+}
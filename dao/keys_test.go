@@ -0,0 +1,125 @@
+package dao
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose/v3"
+)
+
+func TestNewJWKAlgorithms(t *testing.T) {
+	for _, alg := range SupportedAlgorithms {
+		t.Run(alg, func(t *testing.T) {
+			jwk, err := NewJWK(KeySpec{Algorithm: alg}, time.Now().Add(JWKExpiration))
+			if err != nil {
+				t.Fatal(err)
+			}
+			privateKey, err := jwk.GetPrivateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			publicKey, err := jwk.GetPublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := jwk.Thumbprint(); err != nil {
+				t.Fatal(err)
+			}
+
+			signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.SignatureAlgorithm(alg), Key: privateKey}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signed, err := signer.Sign([]byte("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := signed.Verify(publicKey); err != nil {
+				t.Fatalf("got %v verifying with the public key", err)
+			}
+		})
+	}
+
+	if _, err := NewJWK(KeySpec{Algorithm: "HS256"}, time.Now()); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Fatalf("got %v for a symmetric algorithm, want %v", err, ErrUnsupportedAlgorithm)
+	}
+}
+
+func TestJWKAlgorithmMustMatchKey(t *testing.T) {
+	keys := map[string]*JWK{}
+	for _, alg := range []string{AlgRS256, AlgES256, AlgEdDSA} {
+		jwk, err := NewJWK(KeySpec{Algorithm: alg}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[alg] = jwk
+	}
+
+	tests := []struct {
+		key string
+		alg string
+	}{
+		{key: AlgRS256, alg: AlgES256},
+		{key: AlgES256, alg: AlgES384},
+		{key: AlgES256, alg: AlgRS256},
+		{key: AlgEdDSA, alg: AlgES256},
+		{key: AlgRS256, alg: ""},
+		{key: AlgEdDSA, alg: AlgPS256},
+	}
+	for _, tt := range tests {
+		jwk := &JWK{KID: "test", PublicKey: keys[tt.key].PublicKey, Algorithm: tt.alg}
+		if _, err := jwk.GetPublicKey(); err == nil {
+			t.Errorf("got the %s public key for %q, want an error", tt.key, tt.alg)
+		}
+	}
+}
+
+func TestRSAKeySizes(t *testing.T) {
+	spec := KeySpec{Algorithm: AlgPS384, RSAKeySize: 3072}
+	jwk, err := NewJWK(spec, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := jwk.GetPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bits := publicKey.(*rsa.PublicKey).N.BitLen(); bits != 3072 {
+		t.Fatalf("got a %d bits key, want 3072", bits)
+	}
+
+	if !jwk.Matches(spec) {
+		t.Errorf("got no match for the spec of the key %+v", spec)
+	}
+	if jwk.Matches(KeySpec{Algorithm: AlgPS384}) {
+		t.Error("got a match for the default key size")
+	}
+	if jwk.Matches(KeySpec{Algorithm: AlgRS384, RSAKeySize: 3072}) {
+		t.Error("got a match for another RSA algorithm")
+	}
+
+	if _, err := NewJWK(KeySpec{Algorithm: AlgRS256, RSAKeySize: 1024}, time.Now()); !errors.Is(err, ErrUnsupportedKeySize) {
+		t.Fatalf("got %v for a 1024 bits key, want %v", err, ErrUnsupportedKeySize)
+	}
+}
+
+func TestRSAKeyFloor(t *testing.T) {
+	// keys under 2048 bits aren't generated anymore, nor used when found
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := &JWK{KID: "weak", Algorithm: AlgRS256, PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: publicKeyType, Bytes: der}))}
+	if _, err := jwk.GetPublicKey(); err == nil {
+		t.Fatal("got the public key of a 1024 bits RSA key, want an error")
+	}
+}
@@ -0,0 +1,122 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyStore stores the JWKs and their lifecycle state. The DAO stores them in SQLite,
+// DirKeyStore in a directory of key files and MemoryKeyStore in memory
+type KeyStore interface {
+	// GetJWKS returns all JWK, in any state, ordered by expiration time
+	GetJWKS(ctx context.Context) ([]*JWK, error)
+	// GetJWK returns the JWK with the key ID or ErrJWKNotFound
+	GetJWK(ctx context.Context, kid string) (*JWK, error)
+	// InsertJWK adds a JWK in pending state, the key ID is set from the public key thumbprint
+	// and the creation time to now when empty
+	InsertJWK(ctx context.Context, j *JWK) error
+	// UpdateJWKState moves the key to active, retiring or revoked, activating a key retires
+	// the active one. It returns ErrInvalidKeyTransition when the key can't move to state
+	UpdateJWKState(ctx context.Context, kid string, state KeyState) error
+	// PurgeJWK deletes a retiring or revoked key
+	PurgeJWK(ctx context.Context, kid string) error
+}
+
+var (
+	_ KeyStore = (*DAO)(nil)
+	_ KeyStore = (*MemoryKeyStore)(nil)
+	_ KeyStore = (*DirKeyStore)(nil)
+)
+
+// MemoryKeyStore keeps the JWKs in memory, they're lost on restart. It's safe for concurrent use
+type MemoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]*JWK
+}
+
+// NewMemoryKeyStore creates an empty MemoryKeyStore
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: map[string]*JWK{}}
+}
+
+// GetJWKS returns copies of all the JWK, ordered by expiration time
+func (m *MemoryKeyStore) GetJWKS(ctx context.Context) ([]*JWK, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*JWK, 0, len(m.keys))
+	for _, j := range m.keys {
+		c := *j
+		results = append(results, &c)
+	}
+	sortJWKS(results)
+	return results, nil
+}
+
+// GetJWK returns a copy of the JWK with the key ID
+func (m *MemoryKeyStore) GetJWK(ctx context.Context, kid string) (*JWK, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.keys[kid]
+	if !ok {
+		return nil, ErrJWKNotFound
+	}
+	c := *j
+	return &c, nil
+}
+
+// InsertJWK adds a JWK in pending state
+func (m *MemoryKeyStore) InsertJWK(ctx context.Context, j *JWK) error {
+	if err := j.initPending(time.Now()); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.keys[j.KID]; ok {
+		return fmt.Errorf("failed to insert jwks: jwk %q already exists", j.KID)
+	}
+	c := *j
+	m.keys[j.KID] = &c
+	return nil
+}
+
+// UpdateJWKState moves the key to active, retiring or revoked
+func (m *MemoryKeyStore) UpdateJWKState(ctx context.Context, kid string, state KeyState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := transitionKeys(m.keys, kid, state, time.Now())
+	return err
+}
+
+// PurgeJWK deletes a retiring or revoked key
+func (m *MemoryKeyStore) PurgeJWK(ctx context.Context, kid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.keys[kid]
+	if !ok {
+		return ErrJWKNotFound
+	}
+	if err := checkTransition(kid, j.State, purgeableKeyStates); err != nil {
+		return err
+	}
+	delete(m.keys, kid)
+	return nil
+}
+
+// sortJWKS orders the keys as GetJWKS: the latest expiration first
+func sortJWKS(jwks []*JWK) {
+	sort.Slice(jwks, func(i, k int) bool {
+		if jwks[i].ExpiresAt != jwks[k].ExpiresAt {
+			return jwks[i].ExpiresAt > jwks[k].ExpiresAt
+		}
+		return jwks[i].KID < jwks[k].KID
+	})
+}
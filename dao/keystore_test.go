@@ -0,0 +1,108 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestKeyStores returns an empty key store of every backend
+func newTestKeyStores(t *testing.T) map[string]KeyStore {
+	t.Helper()
+
+	dir, err := NewDirKeyStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]KeyStore{
+		"sqlite": newTestDAO(t),
+		"dir":    dir,
+		"memory": NewMemoryKeyStore(),
+	}
+}
+
+// insertStoreJWK adds a new pending ES256 key, cheaper to generate than RSA
+func insertStoreJWK(t *testing.T, keys KeyStore) *JWK {
+	t.Helper()
+
+	jwk, err := NewJWK(KeySpec{Algorithm: AlgES256}, time.Now().Add(JWKExpiration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.InsertJWK(context.Background(), jwk); err != nil {
+		t.Fatal(err)
+	}
+	return jwk
+}
+
+// storeStates returns the state of every key in the store by key ID
+func storeStates(t *testing.T, keys KeyStore) map[string]KeyState {
+	t.Helper()
+
+	jwks, err := keys.GetJWKS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]KeyState{}
+	for _, j := range jwks {
+		states[j.KID] = j.State
+	}
+	return states
+}
+
+func TestKeyStores(t *testing.T) {
+	ctx := context.Background()
+	for name, keys := range newTestKeyStores(t) {
+		t.Run(name, func(t *testing.T) {
+			first := insertStoreJWK(t, keys)
+			if err := keys.InsertJWK(ctx, first); err == nil {
+				t.Fatal("got the same key inserted twice")
+			}
+			if err := keys.UpdateJWKState(ctx, first.KID, KeyStateActive); err != nil {
+				t.Fatal(err)
+			}
+			next := insertStoreJWK(t, keys)
+
+			got, err := keys.GetJWK(ctx, next.KID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.State != KeyStatePending || got.Algorithm != AlgES256 || got.CreatedAt == 0 {
+				t.Fatalf("got key %+v, want a pending ES256 key", got)
+			}
+			if _, err := got.GetPrivateKey(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := keys.GetJWK(ctx, "unknown"); err != ErrJWKNotFound {
+				t.Fatalf("got %v for an unknown key, want %v", err, ErrJWKNotFound)
+			}
+
+			// activating a key retires the active one
+			if err := keys.UpdateJWKState(ctx, next.KID, KeyStateActive); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]KeyState{first.KID: KeyStateRetiring, next.KID: KeyStateActive}
+			if states := storeStates(t, keys); len(states) != 2 || states[first.KID] != want[first.KID] || states[next.KID] != want[next.KID] {
+				t.Fatalf("got states %v, want %v", states, want)
+			}
+			if err := keys.UpdateJWKState(ctx, first.KID, KeyStateActive); !errors.Is(err, ErrInvalidKeyTransition) {
+				t.Fatalf("got %v activating a retiring key, want %v", err, ErrInvalidKeyTransition)
+			}
+			if err := keys.UpdateJWKState(ctx, first.KID, KeyStatePending); !errors.Is(err, ErrInvalidKeyTransition) {
+				t.Fatalf("got %v moving a key back to pending, want %v", err, ErrInvalidKeyTransition)
+			}
+
+			// only retiring and revoked keys are purged
+			if err := keys.PurgeJWK(ctx, next.KID); !errors.Is(err, ErrInvalidKeyTransition) {
+				t.Fatalf("got %v purging the active key, want %v", err, ErrInvalidKeyTransition)
+			}
+			if err := keys.PurgeJWK(ctx, first.KID); err != nil {
+				t.Fatal(err)
+			}
+			if states := storeStates(t, keys); len(states) != 1 || states[next.KID] != KeyStateActive {
+				t.Fatalf("got states %v, want only %s active", states, next.KID)
+			}
+		})
+	}
+}
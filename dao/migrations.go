@@ -0,0 +1,342 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	createMigrationsTableSQL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version integer not null primary key,
+	name text not null,
+	appliedAt integer not null);`
+
+	selectMigrationVersionsSQL = "SELECT version FROM schema_migrations"
+	insertMigrationSQL         = "INSERT INTO schema_migrations(version, name, appliedat) VALUES($1, $2, $3)"
+
+	createJWKSTableSQL = `CREATE TABLE IF NOT EXISTS jwks (
+	kid text not null primary key,
+	privatekey text,
+	publickey text,
+	expiresAt integer,
+	state text not null,
+	createdAt integer not null default 0,
+	activatedAt integer not null default 0,
+	retiredAt integer not null default 0,
+	revokedAt integer not null default 0);`
+
+	// the jwks table before the migrations only had the private and public keys and the expiration
+	selectJWKSColumnsSQL  = "SELECT name FROM pragma_table_info('jwks')"
+	renameBaselineJWKSSQL = "ALTER TABLE jwks RENAME TO jwks_baseline"
+	selectBaselineJWKSSQL = "SELECT privatekey, publickey, expiresat FROM jwks_baseline ORDER BY expiresat DESC"
+	insertBaselineJWKSQL  = `INSERT OR IGNORE INTO jwks(kid, privatekey, publickey, expiresat, state, createdat, activatedat, retiredat)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8)`
+	dropBaselineJWKSSQL = "DROP TABLE jwks_baseline"
+)
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+	// migrate runs after sql, for the changes SQL alone can't make
+	migrate func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations are applied in order, only once, and must never change once released:
+// add a new migration with the next version instead
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create user and jwks tables",
+		// the tables may exist from before the migrations, the keys are kept, see migrateBaselineJWKS
+		sql: `CREATE TABLE IF NOT EXISTS user (
+	id integer not null primary key,
+	email text,
+	name text,
+	location text,
+	password text);
+
+` + createJWKSTableSQL,
+		migrate: migrateBaselineJWKS,
+	},
+	{
+		version: 2,
+		name:    "unique normalized user emails",
+		sql: `UPDATE user SET email = lower(trim(email));
+CREATE UNIQUE INDEX IF NOT EXISTS user_email_idx ON user(email);`,
+	},
+	{
+		version: 3,
+		name:    "create refresh_tokens table",
+		sql: `CREATE TABLE refresh_tokens (
+	hash text not null primary key,
+	familyID text not null,
+	userID integer not null,
+	expiresAt integer not null,
+	createdAt integer not null,
+	rotatedAt integer not null default 0,
+	revokedAt integer not null default 0);
+CREATE INDEX refresh_tokens_family_idx ON refresh_tokens(familyID);`,
+	},
+	{
+		version: 4,
+		name:    "create revoked_tokens table",
+		sql: `CREATE TABLE revoked_tokens (
+	jti text not null primary key,
+	expiresAt integer not null);
+CREATE INDEX revoked_tokens_expires_idx ON revoked_tokens(expiresAt);`,
+	},
+	{
+		version: 5,
+		name:    "create client table",
+		sql: `CREATE TABLE client (
+	id text not null primary key,
+	secret text not null default '',
+	name text,
+	firstParty integer not null default 0,
+	createdAt integer not null);`,
+	},
+	{
+		version: 6,
+		name:    "create client_redirect_uris and auth_codes tables",
+		sql: `CREATE TABLE client_redirect_uris (
+	clientID text not null,
+	uri text not null,
+	primary key (clientID, uri));
+
+CREATE TABLE auth_codes (
+	hash text not null primary key,
+	clientID text not null,
+	userID integer not null,
+	redirectURI text not null,
+	codeChallenge text not null,
+	scope text not null default '',
+	nonce text not null default '',
+	expiresAt integer not null,
+	usedAt integer not null default 0);
+
+ALTER TABLE refresh_tokens ADD COLUMN clientID text not null default '';
+ALTER TABLE refresh_tokens ADD COLUMN scope text not null default '';`,
+	},
+	{
+		version: 7,
+		name:    "add client scope and publicKey columns",
+		sql: `ALTER TABLE client ADD COLUMN scope text not null default '';
+ALTER TABLE client ADD COLUMN publicKey text not null default '';`,
+	},
+	{
+		version: 8,
+		name:    "create client_assertions table",
+		// the jti of an assertion is only unique for its client
+		sql: `CREATE TABLE client_assertions (
+	clientID text not null,
+	jti text not null,
+	expiresAt integer not null,
+	primary key (clientID, jti));
+CREATE INDEX client_assertions_expires_idx ON client_assertions(expiresAt);`,
+	},
+	{
+		version: 9,
+		name:    "add client audience column",
+		sql:     `ALTER TABLE client ADD COLUMN audience text not null default '';`,
+	},
+	{
+		version: 10,
+		name:    "create roles, permissions, role_permissions and user_roles tables",
+		sql: `CREATE TABLE roles (
+	name text not null primary key,
+	description text not null default '');
+
+CREATE TABLE permissions (
+	name text not null primary key,
+	description text not null default '');
+
+CREATE TABLE role_permissions (
+	role text not null,
+	permission text not null,
+	primary key (role, permission));
+
+CREATE TABLE user_roles (
+	userID integer not null,
+	role text not null,
+	primary key (userID, role));
+
+INSERT INTO roles(name, description) VALUES
+	('admin', 'Manages users and their roles'),
+	('vet', 'Veterinarian attending appointments');
+
+INSERT INTO permissions(name, description) VALUES
+	('users:read', 'Read user profiles'),
+	('users:write', 'Change user profiles'),
+	('roles:read', 'Read roles and role assignments'),
+	('roles:write', 'Assign roles to users'),
+	('appointments:read', 'Read appointments'),
+	('appointments:write', 'Book and change appointments');
+
+INSERT INTO role_permissions(role, permission) VALUES
+	('admin', 'users:read'),
+	('admin', 'users:write'),
+	('admin', 'roles:read'),
+	('admin', 'roles:write'),
+	('vet', 'users:read'),
+	('vet', 'appointments:read'),
+	('vet', 'appointments:write');`,
+	},
+	{
+		version: 11,
+		name:    "add jwks alg column",
+		// every key was RSA before
+		sql: `ALTER TABLE jwks ADD COLUMN alg text not null default 'RS256';`,
+	},
+	{
+		version: 12,
+		name:    "add client encryptionKey column",
+		sql:     `ALTER TABLE client ADD COLUMN encryptionKey text not null default '';`,
+	},
+	{
+		version: 13,
+		name:    "create encrypted_tokens table",
+		// we can't decrypt the tokens encrypted to a client audience, they're found by hash
+		sql: `CREATE TABLE encrypted_tokens (
+	hash text not null primary key,
+	jti text not null,
+	kid text not null,
+	claims text not null,
+	expiresAt integer not null);
+CREATE INDEX encrypted_tokens_expires_idx ON encrypted_tokens(expiresAt);`,
+	},
+}
+
+// Migrate applies the pending schema migrations, each one in its own transaction,
+// then encrypts the plaintext private keys when there is a KEK
+func (d *DAO) Migrate(ctx context.Context) error {
+	if _, err := d.db.ExecContext(ctx, createMigrationsTableSQL); err != nil {
+		return fmt.Errorf("failed to create table schema_migrations: %w", err)
+	}
+
+	applied, err := d.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if err := d.applyMigration(ctx, m); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d: %s", m.version, m.name)
+	}
+	return d.EncryptJWKs(ctx)
+}
+
+func (d *DAO) appliedMigrations(ctx context.Context) (map[int]bool, error) {
+	rows, err := d.db.QueryContext(ctx, selectMigrationVersionsSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("failed to scan migration: %w", err)
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+func (d *DAO) applyMigration(ctx context.Context, m migration) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return fmt.Errorf("failed to apply migration %d: %w", m.version, err)
+	}
+	if m.migrate != nil {
+		if err := m.migrate(ctx, tx); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", m.version, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, insertMigrationSQL, m.version, m.name, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to record migration %d: %w", m.version, err)
+	}
+	return tx.Commit()
+}
+
+// migrateBaselineJWKS moves the keys of a jwks table created before the migrations, without
+// key IDs and states, to a new table with them. The key IDs are the thumbprints of the keys, the newest
+// key, the one that was signing, stays active and the others retire so they still verify
+func migrateBaselineJWKS(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, selectJWKSColumnsSQL)
+	if err != nil {
+		return fmt.Errorf("failed to select jwks columns: %w", err)
+	}
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan jwks column: %w", err)
+		}
+		columns[strings.ToLower(name)] = true
+	}
+	rows.Close()
+	if columns["state"] {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, renameBaselineJWKSSQL); err != nil {
+		return fmt.Errorf("failed to rename table jwks: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, createJWKSTableSQL); err != nil {
+		return fmt.Errorf("failed to create table jwks: %w", err)
+	}
+
+	var jwks []*JWK
+	rows, err = tx.QueryContext(ctx, selectBaselineJWKSSQL)
+	if err != nil {
+		return fmt.Errorf("failed to select baseline jwks: %w", err)
+	}
+	for rows.Next() {
+		// every key was RSA before the migrations
+		j := &JWK{Algorithm: AlgRS256}
+		if err := rows.Scan(&j.PrivateKey, &j.PublicKey, &j.ExpiresAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan baseline jwk: %w", err)
+		}
+		jwks = append(jwks, j)
+	}
+	rows.Close()
+
+	now := time.Now().Unix()
+	for i, j := range jwks {
+		if j.KID, err = j.Thumbprint(); err != nil {
+			return err
+		}
+		j.State, j.CreatedAt, j.ActivatedAt = KeyStateActive, now, now
+		if i > 0 {
+			j.State, j.RetiredAt = KeyStateRetiring, now
+		}
+		_, err := tx.ExecContext(ctx, insertBaselineJWKSQL, j.KID, j.PrivateKey, j.PublicKey, j.ExpiresAt,
+			j.State, j.CreatedAt, j.ActivatedAt, j.RetiredAt)
+		if err != nil {
+			return fmt.Errorf("failed to copy baseline jwk: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, dropBaselineJWKSSQL); err != nil {
+		return fmt.Errorf("failed to drop table jwks_baseline: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package dao
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// baselineSchemaSQL is the schema the server created on every start before the migrations
+const baselineSchemaSQL = `CREATE TABLE IF NOT EXISTS user (
+	id integer not null primary key,
+	email text,
+	name text,
+	location text,
+	password text);
+CREATE TABLE IF NOT EXISTS jwks (
+	privatekey text,
+	publickey text,
+	expiresAt integer);`
+
+func TestMigrateBaselineDB(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewDAO(filepath.Join(t.TempDir(), "baseline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if _, err := d.db.ExecContext(ctx, baselineSchemaSQL); err != nil {
+		t.Fatal(err)
+	}
+	privateKey, publicKey, err := GeneratePrivatePublicKeyPair(DefaultRSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(JWKExpiration).Unix()
+	_, err = d.db.ExecContext(ctx, "INSERT INTO jwks(privatekey, publickey, expiresat) VALUES($1, $2, $3)", privateKey, publicKey, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{ID: 1, Email: "admin@airvet.com", Name: "Admin", Location: "somewhere", PasswordHash: "hash"}
+	if err := d.InsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := d.GetJWKS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks) != 1 {
+		t.Fatalf("got %d keys after the migration, want the baseline key", len(jwks))
+	}
+	kid, err := jwks[0].Thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jwks[0].KID != kid || jwks[0].PrivateKey != privateKey || jwks[0].ExpiresAt != expiresAt || jwks[0].State != KeyStateActive {
+		t.Fatalf("got key %s %q expiring at %d, want the baseline key %s active expiring at %d",
+			jwks[0].KID, jwks[0].State, jwks[0].ExpiresAt, kid, expiresAt)
+	}
+	if _, err := d.GetUserByEmail(ctx, user.Email); err != nil {
+		t.Fatalf("got %v getting the baseline user", err)
+	}
+
+	// a second run has nothing to apply
+	versions, err := d.appliedMigrations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := d.GetJWKS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	again, err := d.GetJWKS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, before) {
+		t.Fatalf("got keys %+v after a second migration, want %+v", again[0], before[0])
+	}
+	if againVersions, err := d.appliedMigrations(ctx); err != nil || !reflect.DeepEqual(againVersions, versions) {
+		t.Fatalf("got migrations %v after a second migration, want %v: %v", againVersions, versions, err)
+	}
+}
@@ -0,0 +1,318 @@
+package dao
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	argon2idID = "argon2id"
+	bcryptID   = "2a"
+	scryptID   = "scrypt"
+	pbkdf2ID   = "pbkdf2-sha256"
+)
+
+var (
+	errUnknownPasswordHash = errors.New("unknown password hash format")
+
+	// PHC strings use standard base64 without padding
+	phcEncoding = base64.RawStdEncoding
+)
+
+// PasswordHasher hashes passwords into self-describing PHC strings
+// and verifies passwords against them in constant time
+type PasswordHasher interface {
+	// Hash returns the PHC string of a new salted hash of the password
+	Hash(password string) (string, error)
+	// Verify reports whether the password matches the encoded hash
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash reports whether the encoded hash wasn't made by this hasher with its current parameters
+	NeedsRehash(encoded string) bool
+}
+
+// DefaultPasswordHasher returns the hasher used for new passwords, argon2id
+// with the parameters recommended by OWASP
+func DefaultPasswordHasher() PasswordHasher {
+	return &Argon2idHasher{Time: 2, Memory: 19 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+}
+
+// verifyPassword checks the password with the hasher matching the encoded hash algorithm
+func verifyPassword(password, encoded string) (bool, error) {
+	var h PasswordHasher
+	switch phcID(encoded) {
+	case argon2idID:
+		h = new(Argon2idHasher)
+	case bcryptID, "2b", "2y":
+		h = new(BcryptHasher)
+	case scryptID:
+		h = new(ScryptHasher)
+	case pbkdf2ID:
+		h = new(PBKDF2Hasher)
+	default:
+		h = legacySHA256Hasher{}
+	}
+	return h.Verify(password, encoded)
+}
+
+func phcID(encoded string) string {
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return ""
+	}
+	return parts[1]
+}
+
+// Argon2idHasher hashes passwords with argon2id, Memory is in KiB
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	SaltLen int
+	KeyLen  uint32
+}
+
+// Hash implements PasswordHasher
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := newSalt(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2idID, argon2.Version,
+		h.Memory, h.Time, h.Threads, phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+// Verify implements PasswordHasher
+func (h *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash implements PasswordHasher
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return p.Time != h.Time || p.Memory != h.Memory || p.Threads != h.Threads ||
+		len(salt) != h.SaltLen || uint32(len(key)) != h.KeyLen
+}
+
+// decode parses $argon2id$v=19$m=65536,t=1,p=4$salt$key
+func (h *Argon2idHasher) decode(encoded string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != argon2idID {
+		return nil, nil, nil, errUnknownPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version: %q", parts[2])
+	}
+	p := new(Argon2idHasher)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	salt, key, err := decodeSaltKey(parts[4], parts[5])
+	return p, salt, key, err
+}
+
+// BcryptHasher hashes passwords with bcrypt, its modular crypt format is PHC compatible
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash implements PasswordHasher
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify implements PasswordHasher
+func (h *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	switch {
+	case err == bcrypt.ErrMismatchedHashAndPassword:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// NeedsRehash implements PasswordHasher
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// ScryptHasher hashes passwords with scrypt, the CPU/memory cost is 2^LogN
+type ScryptHasher struct {
+	LogN    uint8
+	R       int
+	P       int
+	SaltLen int
+	KeyLen  int
+}
+
+// Hash implements PasswordHasher
+func (h *ScryptHasher) Hash(password string) (string, error) {
+	salt, err := newSalt(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.LogN, h.R, h.P, h.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$%s$ln=%d,r=%d,p=%d$%s$%s", scryptID, h.LogN, h.R, h.P,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+// Verify implements PasswordHasher
+func (h *ScryptHasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash implements PasswordHasher
+func (h *ScryptHasher) NeedsRehash(encoded string) bool {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return p.LogN != h.LogN || p.R != h.R || p.P != h.P || len(salt) != h.SaltLen || len(key) != h.KeyLen
+}
+
+// decode parses $scrypt$ln=15,r=8,p=1$salt$key
+func (h *ScryptHasher) decode(encoded string) (*ScryptHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != scryptID {
+		return nil, nil, nil, errUnknownPasswordHash
+	}
+	p := new(ScryptHasher)
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid scrypt parameters: %w", err)
+	}
+	salt, key, err := decodeSaltKey(parts[3], parts[4])
+	return p, salt, key, err
+}
+
+// PBKDF2Hasher hashes passwords with PBKDF2-HMAC-SHA256
+type PBKDF2Hasher struct {
+	Iterations int
+	SaltLen    int
+	KeyLen     int
+}
+
+// Hash implements PasswordHasher
+func (h *PBKDF2Hasher) Hash(password string) (string, error) {
+	salt, err := newSalt(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, h.Iterations, h.KeyLen, sha256.New)
+	return fmt.Sprintf("$%s$i=%d$%s$%s", pbkdf2ID, h.Iterations,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+// Verify implements PasswordHasher
+func (h *PBKDF2Hasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := pbkdf2.Key([]byte(password), salt, p.Iterations, len(key), sha256.New)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash implements PasswordHasher
+func (h *PBKDF2Hasher) NeedsRehash(encoded string) bool {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return p.Iterations != h.Iterations || len(salt) != h.SaltLen || len(key) != h.KeyLen
+}
+
+// decode parses $pbkdf2-sha256$i=600000$salt$key
+func (h *PBKDF2Hasher) decode(encoded string) (*PBKDF2Hasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[1] != pbkdf2ID {
+		return nil, nil, nil, errUnknownPasswordHash
+	}
+	p := new(PBKDF2Hasher)
+	if _, err := fmt.Sscanf(parts[2], "i=%d", &p.Iterations); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid pbkdf2 parameters: %w", err)
+	}
+	salt, key, err := decodeSaltKey(parts[3], parts[4])
+	return p, salt, key, err
+}
+
+// legacySHA256Hasher verifies the unsalted hex SHA-256 hashes stored before PHC strings,
+// it's only used to migrate them to the default hasher on login
+type legacySHA256Hasher struct{}
+
+// Hash always fails, new passwords must never be stored as unsalted SHA-256
+func (legacySHA256Hasher) Hash(password string) (string, error) {
+	return "", errors.New("legacy sha256 password hashes are verify only")
+}
+
+// Verify compares the SHA-256 of the password with the hex encoded hash in constant time
+func (legacySHA256Hasher) Verify(password, encoded string) (bool, error) {
+	key, err := hex.DecodeString(encoded)
+	if err != nil || len(key) != sha256.Size {
+		return false, errUnknownPasswordHash
+	}
+	other := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(key, other[:]) == 1, nil
+}
+
+// NeedsRehash is always true, unsalted hashes are replaced as soon as the password is known
+func (legacySHA256Hasher) NeedsRehash(encoded string) bool {
+	return true
+}
+
+func newSalt(size int) ([]byte, error) {
+	salt := make([]byte, size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return salt, nil
+}
+
+func decodeSaltKey(encodedSalt, encodedKey string) ([]byte, []byte, error) {
+	salt, err := phcEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	key, err := phcEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) == 0 {
+		return nil, nil, fmt.Errorf("invalid hash: %v", err)
+	}
+	return salt, key, nil
+}
@@ -0,0 +1,150 @@
+package dao
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// testHashers are cheap enough to run on every test
+func testHashers() map[string]PasswordHasher {
+	return map[string]PasswordHasher{
+		argon2idID: &Argon2idHasher{Time: 1, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 32},
+		bcryptID:   &BcryptHasher{Cost: 4},
+		scryptID:   &ScryptHasher{LogN: 4, R: 8, P: 1, SaltLen: 16, KeyLen: 32},
+		pbkdf2ID:   &PBKDF2Hasher{Iterations: 10, SaltLen: 16, KeyLen: 32},
+	}
+}
+
+func TestPasswordHashers(t *testing.T) {
+	for id, h := range testHashers() {
+		t.Run(id, func(t *testing.T) {
+			encoded, err := h.Hash("s3cret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(encoded, "$"+id+"$") {
+				t.Fatalf("got hash %q, want a PHC string with id %q", encoded, id)
+			}
+			if other, _ := h.Hash("s3cret"); other == encoded {
+				t.Fatal("got the same hash twice, want a random salt")
+			}
+
+			for password, want := range map[string]bool{"s3cret": true, "S3cret": false, "": false} {
+				ok, err := verifyPassword(password, encoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok != want {
+					t.Fatalf("got %v verifying %q, want %v", ok, password, want)
+				}
+			}
+			if h.NeedsRehash(encoded) {
+				t.Fatal("got a rehash of a hash made with the current parameters")
+			}
+		})
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	hashers := testHashers()
+	stronger := map[string]PasswordHasher{
+		argon2idID: &Argon2idHasher{Time: 2, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 32},
+		bcryptID:   &BcryptHasher{Cost: 5},
+		scryptID:   &ScryptHasher{LogN: 5, R: 8, P: 1, SaltLen: 16, KeyLen: 32},
+		pbkdf2ID:   &PBKDF2Hasher{Iterations: 20, SaltLen: 16, KeyLen: 32},
+	}
+	for id, h := range hashers {
+		encoded, err := h.Hash("s3cret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stronger[id].NeedsRehash(encoded) {
+			t.Errorf("%s: got no rehash after changing the parameters", id)
+		}
+		for otherID, other := range hashers {
+			if otherID != id && !other.NeedsRehash(encoded) {
+				t.Errorf("%s: got no rehash by the %s hasher", id, otherID)
+			}
+		}
+	}
+}
+
+func TestLegacySHA256Password(t *testing.T) {
+	const encoded = "a9f4edc6c0f72ed3156a540dab48828f196066b32f9e41469b61069dcf62b80b" // "Admin-pass"
+
+	ok, err := verifyPassword("Admin-pass", encoded)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v verifying the legacy hash, want a match", ok, err)
+	}
+	if ok, _ := verifyPassword("admin-pass", encoded); ok {
+		t.Fatal("got a match with the wrong password")
+	}
+	if _, err := verifyPassword("Admin-pass", "not a hash"); err != errUnknownPasswordHash {
+		t.Fatalf("got %v verifying an unknown format, want %v", err, errUnknownPasswordHash)
+	}
+	if _, err := (legacySHA256Hasher{}).Hash("Admin-pass"); err == nil {
+		t.Fatal("got a new legacy hash, want an error")
+	}
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+	hashers := testHashers()
+	d.SetPasswordHasher(hashers[bcryptID])
+
+	user := &User{ID: 1, Email: "admin@airvet.com", Name: "Admin", Location: "somewhere",
+		PasswordHash: "a9f4edc6c0f72ed3156a540dab48828f196066b32f9e41469b61069dcf62b80b"} // "Admin-pass"
+	if err := d.InsertUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.GetUserByEmailPasswd(ctx, user.Email, "wrong"); err != ErrUserNotFound {
+		t.Fatalf("got %v with the wrong password, want %v", err, ErrUserNotFound)
+	}
+	if hash := storedPasswordHash(t, d, user.ID); hash != user.PasswordHash {
+		t.Fatalf("got hash %q after a failed login, want it untouched", hash)
+	}
+
+	// the legacy hash is upgraded to the current hasher
+	if _, err := d.GetUserByEmailPasswd(ctx, user.Email, "Admin-pass"); err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash := storedPasswordHash(t, d, user.ID)
+	if phcID(bcryptHash) != bcryptID {
+		t.Fatalf("got hash %q after login, want a bcrypt hash", bcryptHash)
+	}
+
+	// and again when the hasher changes
+	d.SetPasswordHasher(hashers[argon2idID])
+	if _, err := d.GetUserByEmailPasswd(ctx, user.Email, "Admin-pass"); err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash := storedPasswordHash(t, d, user.ID)
+	if phcID(argon2Hash) != argon2idID {
+		t.Fatalf("got hash %q after changing the hasher, want an argon2id hash", argon2Hash)
+	}
+
+	// an up to date hash is left alone
+	if _, err := d.GetUserByEmailPasswd(ctx, user.Email, "Admin-pass"); err != nil {
+		t.Fatal(err)
+	}
+	if hash := storedPasswordHash(t, d, user.ID); hash != argon2Hash {
+		t.Fatalf("got hash %q, want the current hash %q untouched", hash, argon2Hash)
+	}
+
+	if _, err := d.GetUserByEmailPasswd(ctx, "nobody@airvet.com", "Admin-pass"); err != ErrUserNotFound {
+		t.Fatalf("got %v for an unknown user, want %v", err, ErrUserNotFound)
+	}
+}
+
+func storedPasswordHash(t *testing.T, d *DAO, id int) string {
+	t.Helper()
+
+	var hash string
+	if err := d.db.QueryRow("SELECT password FROM user WHERE id=?", id).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
@@ -0,0 +1,188 @@
+package dao
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	refreshTokenSize = 32
+
+	insertRefreshTokenSQL = `INSERT INTO refresh_tokens(hash, familyid, userid, clientid, scope, expiresat, createdat)
+	VALUES($1, $2, $3, $4, $5, $6, $7)`
+	selectRefreshTokenSQL = `SELECT hash, familyid, userid, clientid, scope, expiresat, createdat, rotatedat, revokedat
+	FROM refresh_tokens WHERE hash=?`
+	rotateRefreshTokenSQL       = "UPDATE refresh_tokens SET rotatedat=? WHERE hash=? AND rotatedat=0"
+	revokeRefreshTokenFamilySQL = "UPDATE refresh_tokens SET revokedat=? WHERE familyid=? AND revokedat=0"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired or revoked refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+	// ErrRefreshTokenReused is returned when an already rotated refresh token is used again,
+	// its whole family gets revoked
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// RefreshToken represents a stored refresh token, only its hash is kept
+type RefreshToken struct {
+	Hash string
+	// FamilyID is shared by all the tokens rotated from the same login
+	FamilyID string
+	UserID   int
+	// ClientID is the client the token was issued to, empty for first party logins
+	ClientID  string
+	Scope     string
+	ExpiresAt int64
+	CreatedAt int64
+	RotatedAt int64
+	RevokedAt int64
+}
+
+// IssueRefreshToken creates a refresh token for the user, client and scope of grant
+// starting a new family, it returns the opaque token that is handed to the client
+func (d *DAO) IssueRefreshToken(ctx context.Context, grant *RefreshToken, expiresAt time.Time) (string, error) {
+	familyID, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	family := *grant
+	family.FamilyID = familyID
+
+	token, rt, err := newRefreshToken(&family, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	if _, err := d.db.ExecContext(ctx, insertRefreshTokenSQL, rt.Hash, rt.FamilyID, rt.UserID, rt.ClientID, rt.Scope,
+		rt.ExpiresAt, rt.CreatedAt); err != nil {
+		return "", fmt.Errorf("failed to insert refresh token: %w", err)
+	}
+	return token, nil
+}
+
+// RotateRefreshToken exchanges a refresh token issued to clientID for a new one in the same family,
+// using a token that was already rotated revokes the family and returns ErrRefreshTokenReused
+func (d *DAO) RotateRefreshToken(ctx context.Context, token, clientID string, expiresAt time.Time) (string, *RefreshToken, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rt := new(RefreshToken)
+	err = tx.QueryRowContext(ctx, selectRefreshTokenSQL, HashToken(token)).Scan(&rt.Hash, &rt.FamilyID, &rt.UserID,
+		&rt.ClientID, &rt.Scope, &rt.ExpiresAt, &rt.CreatedAt, &rt.RotatedAt, &rt.RevokedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", nil, ErrInvalidRefreshToken
+	case err != nil:
+		return "", nil, fmt.Errorf("select refresh token error: %w", err)
+	}
+
+	now := time.Now()
+	if rt.RevokedAt != 0 || rt.ExpiresAt <= now.Unix() || rt.ClientID != clientID {
+		return "", nil, ErrInvalidRefreshToken
+	}
+
+	result, err := tx.ExecContext(ctx, rotateRefreshTokenSQL, now.Unix(), rt.Hash)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	if countRows, _ := result.RowsAffected(); countRows != 1 {
+		// someone already exchanged this token: either the client or an attacker holds a stolen copy
+		if _, err := tx.ExecContext(ctx, revokeRefreshTokenFamilySQL, now.Unix(), rt.FamilyID); err != nil {
+			return "", nil, fmt.Errorf("failed to revoke refresh token family: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return "", nil, err
+		}
+		return "", nil, ErrRefreshTokenReused
+	}
+
+	newToken, next, err := newRefreshToken(rt, expiresAt)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := tx.ExecContext(ctx, insertRefreshTokenSQL, next.Hash, next.FamilyID, next.UserID, next.ClientID, next.Scope,
+		next.ExpiresAt, next.CreatedAt); err != nil {
+		return "", nil, fmt.Errorf("failed to insert refresh token: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", nil, err
+	}
+	return newToken, next, nil
+}
+
+// FindRefreshToken fetchs a stored refresh token, even if it can't be exchanged anymore
+func (d *DAO) FindRefreshToken(ctx context.Context, token string) (*RefreshToken, error) {
+	rt := new(RefreshToken)
+	err := d.db.QueryRowContext(ctx, selectRefreshTokenSQL, HashToken(token)).Scan(&rt.Hash, &rt.FamilyID, &rt.UserID,
+		&rt.ClientID, &rt.Scope, &rt.ExpiresAt, &rt.CreatedAt, &rt.RotatedAt, &rt.RevokedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrInvalidRefreshToken
+	case err != nil:
+		return nil, fmt.Errorf("select refresh token error: %w", err)
+	}
+	return rt, nil
+}
+
+// GetRefreshToken fetchs a refresh token that can still be exchanged
+func (d *DAO) GetRefreshToken(ctx context.Context, token string) (*RefreshToken, error) {
+	rt, err := d.FindRefreshToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if rt.RotatedAt != 0 || rt.RevokedAt != 0 || rt.ExpiresAt <= time.Now().Unix() {
+		return nil, ErrInvalidRefreshToken
+	}
+	return rt, nil
+}
+
+// RevokeRefreshTokenFamily revokes every token rotated from the same login
+func (d *DAO) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	if _, err := d.db.ExecContext(ctx, revokeRefreshTokenFamilySQL, time.Now().Unix(), familyID); err != nil {
+		return fmt.Errorf("failed to revoke refresh token family: %w", err)
+	}
+	return nil
+}
+
+// HashToken returns the hash opaque tokens, like refresh tokens and authorization codes,
+// are stored with, a plain SHA-256 is enough since the tokens are random
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// newRefreshToken returns a new token in the family of prev, for the same user, client and scope
+func newRefreshToken(prev *RefreshToken, expiresAt time.Time) (string, *RefreshToken, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &RefreshToken{
+		Hash:      HashToken(token),
+		FamilyID:  prev.FamilyID,
+		UserID:    prev.UserID,
+		ClientID:  prev.ClientID,
+		Scope:     prev.Scope,
+		ExpiresAt: expiresAt.Unix(),
+		CreatedAt: time.Now().Unix(),
+	}, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, refreshTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,94 @@
+package dao
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+	expiresAt := time.Now().Add(time.Hour)
+
+	first, err := d.IssueRefreshToken(ctx, &RefreshToken{UserID: 7}, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, rt, err := d.RotateRefreshToken(ctx, first, "", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || rt.UserID != 7 || rt.Hash != HashToken(second) {
+		t.Fatalf("got rotated token %+v, want a new token for user 7", rt)
+	}
+	third, next, err := d.RotateRefreshToken(ctx, second, "", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.FamilyID != rt.FamilyID {
+		t.Fatalf("got family %q after rotating, want %q", next.FamilyID, rt.FamilyID)
+	}
+
+	// the first token leaked: using it again revokes every token of the family
+	if _, _, err := d.RotateRefreshToken(ctx, first, "", expiresAt); err != ErrRefreshTokenReused {
+		t.Fatalf("got %v reusing a rotated token, want %v", err, ErrRefreshTokenReused)
+	}
+	if _, _, err := d.RotateRefreshToken(ctx, third, "", expiresAt); err != ErrInvalidRefreshToken {
+		t.Fatalf("got %v with the latest token of a revoked family, want %v", err, ErrInvalidRefreshToken)
+	}
+
+	// other families aren't affected
+	other, err := d.IssueRefreshToken(ctx, &RefreshToken{UserID: 7}, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.RotateRefreshToken(ctx, other, "", expiresAt); err != nil {
+		t.Fatalf("got %v rotating a token of another family", err)
+	}
+}
+
+func TestRotateInvalidRefreshToken(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+
+	expired, err := d.IssueRefreshToken(ctx, &RefreshToken{UserID: 7}, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{"expired": expired, "unknown": "not-a-token"} {
+		if _, _, err := d.RotateRefreshToken(ctx, token, "", time.Now().Add(time.Hour)); err != ErrInvalidRefreshToken {
+			t.Errorf("%s: got %v, want %v", name, err, ErrInvalidRefreshToken)
+		}
+	}
+}
+
+func TestRevokeRefreshTokenFamily(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+	expiresAt := time.Now().Add(time.Hour)
+
+	first, err := d.IssueRefreshToken(ctx, &RefreshToken{UserID: 7}, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := d.RotateRefreshToken(ctx, first, "", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rotated token is still found, so it can revoke its family
+	rt, err := d.FindRefreshToken(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RevokeRefreshTokenFamily(ctx, rt.FamilyID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.RotateRefreshToken(ctx, second, "", expiresAt); err != ErrInvalidRefreshToken {
+		t.Fatalf("got %v rotating a token of a revoked family, want %v", err, ErrInvalidRefreshToken)
+	}
+	if _, err := d.FindRefreshToken(ctx, "not-a-token"); err != ErrInvalidRefreshToken {
+		t.Fatalf("got %v finding an unknown token, want %v", err, ErrInvalidRefreshToken)
+	}
+}
@@ -0,0 +1,45 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	insertRevokedTokenSQL  = "INSERT OR IGNORE INTO revoked_tokens(jti, expiresat) VALUES($1, $2)"
+	selectRevokedTokenSQL  = "SELECT 1 FROM revoked_tokens WHERE jti=?"
+	deleteRevokedTokensSQL = "DELETE FROM revoked_tokens WHERE expiresat<=?"
+)
+
+// RevokeJTI adds a token ID to the denylist until the token expires,
+// the entries of already expired tokens are pruned at the same time
+func (d *DAO) RevokeJTI(ctx context.Context, jti string, expiresAt time.Time) error {
+	if _, err := d.db.ExecContext(ctx, insertRevokedTokenSQL, jti, expiresAt.Unix()); err != nil {
+		return fmt.Errorf("failed to insert revoked token: %w", err)
+	}
+	return d.PruneRevokedTokens(ctx, time.Now())
+}
+
+// IsJTIRevoked reports whether the token ID is in the denylist
+func (d *DAO) IsJTIRevoked(ctx context.Context, jti string) (bool, error) {
+	var found int
+	err := d.db.QueryRowContext(ctx, selectRevokedTokenSQL, jti).Scan(&found)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("select revoked token error: %w", err)
+	}
+	return true, nil
+}
+
+// PruneRevokedTokens deletes the denylist entries of tokens expired before now,
+// they are rejected anyway
+func (d *DAO) PruneRevokedTokens(ctx context.Context, now time.Time) error {
+	if _, err := d.db.ExecContext(ctx, deleteRevokedTokensSQL, now.Unix()); err != nil {
+		return fmt.Errorf("failed to prune revoked tokens: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package dao
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRevokeJTI(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+
+	if err := d.RevokeJTI(ctx, "live", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// revoking twice is fine
+	if err := d.RevokeJTI(ctx, "live", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for jti, want := range map[string]bool{"live": true, "other": false} {
+		revoked, err := d.IsJTIRevoked(ctx, jti)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revoked != want {
+			t.Errorf("got revoked %v for %q, want %v", revoked, jti, want)
+		}
+	}
+}
+
+func TestPruneRevokedTokens(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+
+	now := time.Now()
+	for jti, expiresAt := range map[string]time.Time{"expired": now.Add(-time.Minute), "live": now.Add(time.Hour)} {
+		if _, err := d.db.ExecContext(ctx, insertRevokedTokenSQL, jti, expiresAt.Unix()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.PruneRevokedTokens(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	for jti, want := range map[string]bool{"expired": false, "live": true} {
+		revoked, err := d.IsJTIRevoked(ctx, jti)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revoked != want {
+			t.Errorf("got revoked %v for %q after pruning, want %v", revoked, jti, want)
+		}
+	}
+
+	// revoking prunes the expired entries too
+	if _, err := d.db.ExecContext(ctx, insertRevokedTokenSQL, "expired", now.Add(-time.Minute).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RevokeJTI(ctx, "new", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := d.IsJTIRevoked(ctx, "expired"); err != nil || revoked {
+		t.Fatalf("got revoked %v, %v for an expired entry after revoking, want it pruned", revoked, err)
+	}
+}
@@ -0,0 +1,129 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+const (
+	selectRolesSQL           = "SELECT name, description FROM roles ORDER BY name"
+	selectRoleExistsSQL      = "SELECT 1 FROM roles WHERE name=?"
+	selectRolePermissionsSQL = "SELECT role, permission FROM role_permissions ORDER BY role, permission"
+	selectUserRolesSQL       = "SELECT role FROM user_roles WHERE userid=? ORDER BY role"
+	selectUserPermissionsSQL = `SELECT DISTINCT rp.permission FROM user_roles ur
+	JOIN role_permissions rp ON rp.role=ur.role
+	WHERE ur.userid=? ORDER BY rp.permission`
+	insertUserRoleSQL = "INSERT OR IGNORE INTO user_roles(userid, role) VALUES($1, $2)"
+	deleteUserRoleSQL = "DELETE FROM user_roles WHERE userid=? AND role=?"
+)
+
+// ErrRoleNotFound is a flag error to indicate a not found role
+var ErrRoleNotFound = errors.New("role not found")
+
+// Role groups the permissions granted to the users it's assigned to
+type Role struct {
+	Name        string
+	Description string
+	Permissions []string
+}
+
+// GetRoles returns every role with its permissions
+func (d *DAO) GetRoles(ctx context.Context) ([]*Role, error) {
+	rows, err := d.db.QueryContext(ctx, selectRolesSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select roles: %w", err)
+	}
+	defer rows.Close()
+
+	var roles []*Role
+	byName := map[string]*Role{}
+	for rows.Next() {
+		r := new(Role)
+		if err := rows.Scan(&r.Name, &r.Description); err != nil {
+			return nil, fmt.Errorf("failed to scan role: %w", err)
+		}
+		roles = append(roles, r)
+		byName[r.Name] = r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	permRows, err := d.db.QueryContext(ctx, selectRolePermissionsSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select role permissions: %w", err)
+	}
+	defer permRows.Close()
+
+	for permRows.Next() {
+		var role, permission string
+		if err := permRows.Scan(&role, &permission); err != nil {
+			return nil, fmt.Errorf("failed to scan role permission: %w", err)
+		}
+		if r, ok := byName[role]; ok {
+			r.Permissions = append(r.Permissions, permission)
+		}
+	}
+	return roles, permRows.Err()
+}
+
+// GetUserRoles returns the names of the roles assigned to the user
+func (d *DAO) GetUserRoles(ctx context.Context, userID int) ([]string, error) {
+	return d.selectStrings(ctx, selectUserRolesSQL, userID)
+}
+
+// GetUserPermissions returns the permissions granted by all the roles of the user
+func (d *DAO) GetUserPermissions(ctx context.Context, userID int) ([]string, error) {
+	return d.selectStrings(ctx, selectUserPermissionsSQL, userID)
+}
+
+// AssignRole grants the role to the user, assigning it again does nothing
+func (d *DAO) AssignRole(ctx context.Context, userID int, role string) error {
+	if _, err := d.GetUserByID(ctx, userID); err != nil {
+		return err
+	}
+
+	var found int
+	err := d.db.QueryRowContext(ctx, selectRoleExistsSQL, role).Scan(&found)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrRoleNotFound
+	case err != nil:
+		return fmt.Errorf("select role error: %w", err)
+	}
+
+	if _, err := d.db.ExecContext(ctx, insertUserRoleSQL, userID, role); err != nil {
+		return fmt.Errorf("failed to insert user role: %w", err)
+	}
+	return nil
+}
+
+// UnassignRole takes the role away from the user, reports whether the user had it
+func (d *DAO) UnassignRole(ctx context.Context, userID int, role string) (bool, error) {
+	result, err := d.db.ExecContext(ctx, deleteUserRoleSQL, userID, role)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete user role: %w", err)
+	}
+	countRows, _ := result.RowsAffected()
+	return countRows == 1, nil
+}
+
+func (d *DAO) selectStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select: %w", err)
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("failed to scan: %w", err)
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
@@ -10,16 +10,24 @@ import (
 )
 
 const (
-	keySize = 2048
+	// DefaultRSAKeySize is the modulus size of new RSA keys
+	DefaultRSAKeySize = 2048
+	minRSAKeySize     = 2048
 
 	rsaPrivateKeyType = "RSA PRIVATE KEY"
-	rsaPublicKeyType  = "PUBLIC KEY"
+	publicKeyType     = "PUBLIC KEY"
 )
 
-// GeneratePrivatePublicKeyPair returns a private and public key pair
+// GeneratePrivatePublicKeyPair returns a RSA private and public key pair of 2048, 3072 or 4096 bits
 // TODO: move this function to its own pkg
-func GeneratePrivatePublicKeyPair() (string, string, error) {
-	privatekey, err := rsa.GenerateKey(rand.Reader, keySize)
+func GeneratePrivatePublicKeyPair(bits int) (string, string, error) {
+	switch bits {
+	case 2048, 3072, 4096:
+	default:
+		return "", "", fmt.Errorf("%w: %d bits", ErrUnsupportedKeySize, bits)
+	}
+
+	privatekey, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
 		return "", "", err
 	}
@@ -45,7 +53,7 @@ func GeneratePrivatePublicKeyPair() (string, string, error) {
 			return "", "", err
 		}
 		publicKeyBlock := &pem.Block{
-			Type:  rsaPublicKeyType,
+			Type:  publicKeyType,
 			Bytes: publicKeyBytes,
 		}
 
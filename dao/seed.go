@@ -0,0 +1,111 @@
+package dao
+
+import (
+	"context"
+	"log"
+)
+
+// Seed adds the demo users and clients, the ones that already exist are left untouched.
+// The users get IDs assigned by the DB as they may come after users who signed up
+func (d *DAO) Seed(ctx context.Context) error {
+	users := []struct {
+		*User
+		password string
+		roles    []string
+	}{
+		{
+			User: &User{
+				Email:    "admin@airvet.com",
+				Name:     "Admin",
+				Location: "somewhere",
+			},
+			password: "Admin-pass",
+			roles:    []string{"admin"},
+		},
+		{
+			User: &User{
+				Email:    "coolvet@airvet.com",
+				Name:     "Cool Vet",
+				Location: "Best Pet Veterinary Clinic",
+			},
+			password: "Cool_pass123",
+			roles:    []string{"vet"},
+		},
+	}
+	for _, u := range users {
+		_, err := d.GetUserByEmail(ctx, u.Email)
+		if err == nil {
+			continue
+		}
+		if err != ErrUserNotFound {
+			return err
+		}
+		if u.PasswordHash, err = d.HashPassword(u.password); err != nil {
+			return err
+		}
+		if err := d.InsertUser(ctx, u.User); err != nil {
+			return err
+		}
+		for _, role := range u.roles {
+			if err := d.AssignRole(ctx, u.ID, role); err != nil {
+				return err
+			}
+		}
+		log.Printf("Seeded user %q with roles %v", u.Email, u.roles)
+	}
+
+	clients := []struct {
+		*Client
+		secret string
+	}{
+		{
+			Client: &Client{
+				ID:         "airvet-app",
+				Name:       "Airvet App",
+				FirstParty: true,
+			},
+			secret: "App-secret",
+		},
+		{
+			Client: &Client{
+				ID:   "resource-server",
+				Name: "Resource Server",
+			},
+			secret: "Resource-secret",
+		},
+		{
+			Client: &Client{
+				ID:           "clinic-integration",
+				Name:         "Clinic Integration",
+				RedirectURIs: []string{"http://localhost:3000/callback"},
+			},
+			secret: "Clinic-secret",
+		},
+		{
+			Client: &Client{
+				ID:       "reports-service",
+				Name:     "Reports Service",
+				Scopes:   []string{"users:read", "appointments:read"},
+				Audience: "https://reports.airvet.com",
+			},
+			secret: "Reports-secret",
+		},
+	}
+	for _, c := range clients {
+		_, err := d.GetClient(ctx, c.ID)
+		if err == nil {
+			continue
+		}
+		if err != ErrClientNotFound {
+			return err
+		}
+		if c.SecretHash, err = d.HashPassword(c.secret); err != nil {
+			return err
+		}
+		if err := d.InsertClient(ctx, c.Client); err != nil {
+			return err
+		}
+		log.Printf("Seeded client %q", c.ID)
+	}
+	return nil
+}
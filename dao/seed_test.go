@@ -0,0 +1,34 @@
+package dao
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSeedAfterSignup(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDAO(t)
+
+	// the first user signs up before the demo users are seeded, getting the first ID
+	signup := &User{Email: "owner@example.com", Name: "Pet Owner", PasswordHash: "hash"}
+	if err := d.InsertUser(ctx, signup); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := d.Seed(ctx); err != nil {
+			t.Fatalf("seed %d: %v", i+1, err)
+		}
+	}
+
+	admin, err := d.GetUserByEmail(ctx, "admin@airvet.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.ID == signup.ID {
+		t.Fatalf("the admin got the ID %d of the user who signed up", admin.ID)
+	}
+	if _, err := d.GetUserByEmailPasswd(ctx, "coolvet@airvet.com", "Cool_pass123"); err != nil {
+		t.Fatalf("got %v logging in as a seeded user", err)
+	}
+}
@@ -2,16 +2,24 @@ package dao
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 const (
-	insertUserSQL        = "INSERT INTO user(id, email, name, location, password) VALUES($1, $2, $3, $4, $5)"
-	selectUserSQL        = "SELECT id, email, name, location FROM user WHERE email=? AND password=?"
-	selectUserByEmailSQL = "SELECT id, email, name, location FROM user WHERE email=?"
+	insertUserSQL             = "INSERT INTO user(email, name, location, password) VALUES($1, $2, $3, $4)"
+	selectUserWithPasswordSQL = "SELECT id, email, name, location, password FROM user WHERE email=?"
+	selectUserByEmailSQL      = "SELECT id, email, name, location FROM user WHERE email=?"
+	selectUserByIDSQL         = "SELECT id, email, name, location FROM user WHERE id=?"
+	updateUserPasswordSQL     = "UPDATE user SET password=? WHERE id=? AND password=?"
+
+	// verified against when the user doesn't exist, so it takes as long as a real login
+	dummyPasswordHash = "$argon2id$v=19$m=19456,t=2,p=1$c29tZXNhbHRzb21lc2FsdA$qJ2VRCNV+mmkA0jhBKbmcvn7kOo9AKnzS1q5KH03Yfk"
 )
 
 var (
@@ -19,6 +27,9 @@ var (
 
 	// ErrUserNotFound is a flag error to indicate a not found user error
 	ErrUserNotFound = errors.New("user not found")
+
+	// ErrUserExists is a flag error to indicate the email is already registered
+	ErrUserExists = errors.New("user already exists")
 )
 
 // User represents a user record
@@ -30,12 +41,17 @@ type User struct {
 	PasswordHash string `json:"-"`
 }
 
-// InsertUser creates a new user
+// InsertUser creates a new user, the ID is assigned by the DB
 func (d *DAO) InsertUser(ctx context.Context, u *User) error {
 	if u == nil {
 		return errEmptyUser
 	}
-	result, err := d.db.ExecContext(ctx, insertUserSQL, u.ID, u.Email, u.Name, u.Location, u.PasswordHash)
+	u.Email = NormalizeEmail(u.Email)
+
+	result, err := d.db.ExecContext(ctx, insertUserSQL, u.Email, u.Name, u.Location, u.PasswordHash)
+	if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrUserExists
+	}
 	if err != nil {
 		return fmt.Errorf("failed to insert user: %w", err)
 	}
@@ -44,30 +60,84 @@ func (d *DAO) InsertUser(ctx context.Context, u *User) error {
 	if countRows != 1 {
 		return fmt.Errorf("unexpected error inserting user: %+v", *u)
 	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get new user id: %w", err)
+	}
+	u.ID = int(id)
 	return nil
 }
 
-// GetUserByEmailPasswd fetchs a user by email and password
-func (d *DAO) GetUserByEmailPasswd(ctx context.Context, email, textPasswd string) (*User, error) {
-	h := sha256.New()
-	h.Write([]byte(textPasswd))
-	hashPasswd := fmt.Sprintf("%x", h.Sum(nil))
+// NormalizeEmail returns the email as it's stored, trimmed and lower case
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
 
+// GetUserByEmailPasswd fetchs a user by email and password,
+// the password is re-hashed when its stored hash is outdated
+func (d *DAO) GetUserByEmailPasswd(ctx context.Context, email, textPasswd string) (*User, error) {
 	u := new(User)
-	err := d.db.QueryRowContext(ctx, selectUserSQL, email, hashPasswd).Scan(&u.ID, &u.Email, &u.Name, &u.Location)
+	err := d.db.QueryRowContext(ctx, selectUserWithPasswordSQL, NormalizeEmail(email)).Scan(&u.ID, &u.Email, &u.Name, &u.Location, &u.PasswordHash)
 	switch {
 	case err == sql.ErrNoRows:
+		verifyPassword(textPasswd, dummyPasswordHash)
 		return nil, ErrUserNotFound
 	case err != nil:
 		return nil, fmt.Errorf("select user error: %w", err)
 	}
+
+	ok, err := verifyPassword(textPasswd, u.PasswordHash)
+	if err != nil {
+		return nil, fmt.Errorf("verify password error: %w", err)
+	}
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	if d.hasher.NeedsRehash(u.PasswordHash) {
+		if err := d.rehashPassword(ctx, u, textPasswd); err != nil {
+			// the login is still valid, we'll try again next time
+			log.Printf("Error re-hashing password of user %d: %v", u.ID, err)
+		}
+	}
 	return u, nil
 }
 
+// HashPassword returns the hash to store for a text password
+func (d *DAO) HashPassword(textPasswd string) (string, error) {
+	return d.hasher.Hash(textPasswd)
+}
+
+func (d *DAO) rehashPassword(ctx context.Context, u *User, textPasswd string) error {
+	hash, err := d.hasher.Hash(textPasswd)
+	if err != nil {
+		return err
+	}
+	// only replace the hash we verified, in case it changed meanwhile
+	if _, err := d.db.ExecContext(ctx, updateUserPasswordSQL, hash, u.ID, u.PasswordHash); err != nil {
+		return fmt.Errorf("failed to update user password: %w", err)
+	}
+	u.PasswordHash = hash
+	return nil
+}
+
 // GetUserByEmail fetchs a user by email
 func (d *DAO) GetUserByEmail(ctx context.Context, email string) (*User, error) {
 	u := new(User)
-	err := d.db.QueryRowContext(ctx, selectUserByEmailSQL, email).Scan(&u.ID, &u.Email, &u.Name, &u.Location)
+	err := d.db.QueryRowContext(ctx, selectUserByEmailSQL, NormalizeEmail(email)).Scan(&u.ID, &u.Email, &u.Name, &u.Location)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrUserNotFound
+	case err != nil:
+		return nil, fmt.Errorf("select user error: %w", err)
+	}
+	return u, nil
+}
+
+// GetUserByID fetchs a user by ID
+func (d *DAO) GetUserByID(ctx context.Context, id int) (*User, error) {
+	u := new(User)
+	err := d.db.QueryRowContext(ctx, selectUserByIDSQL, id).Scan(&u.ID, &u.Email, &u.Name, &u.Location)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, ErrUserNotFound
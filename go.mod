@@ -5,4 +5,5 @@ go 1.16
 require (
 	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/square/go-jose/v3 v3.0.0-20200630053402-0a67ce9b0693
+	golang.org/x/crypto v0.0.0-20190911031432-227b76d455e7
 )
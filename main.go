@@ -2,14 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/yanpozka/airvet-jwt/api"
+	"github.com/yanpozka/airvet-jwt/auth"
 	"github.com/yanpozka/airvet-jwt/dao"
+	"github.com/yanpozka/airvet-jwt/rotation"
+	"github.com/yanpozka/airvet-jwt/signer"
 )
 
 const (
@@ -19,23 +28,114 @@ const (
 	readTimeout       = 10 * time.Second
 	readHeaderTimeout = 5 * time.Second
 	writeTimeout      = 15 * time.Second
+
+	defaultRotationLeadTime   = 30 * 24 * time.Hour
+	defaultRotationPrepublish = 7 * 24 * time.Hour
+	defaultRotationInterval   = time.Hour
+
+	defaultJWTLeeway = time.Minute
+
+	// defaultJWKSMaxAge bounds how long a revoked key stays in the caches of relying parties
+	defaultJWKSMaxAge = time.Hour
+
+	keyStoreSQLite = "sqlite"
+	keyStoreDir    = "dir"
+	keyStoreMemory = "memory"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	seed := flag.Bool("seed", false, "add the demo users")
+	flag.Parse()
+
 	d, err := dao.NewDAO(dbPath)
 	if err != nil {
 		log.Panic(err)
 	}
-	err = d.InitDB(context.Background())
+	kek, err := dao.LoadKEK(os.Getenv("JWK_KEK"), os.Getenv("JWK_KEK_FILE"))
+	if err != nil {
+		log.Panic(err)
+	}
+	d.SetKEK(kek)
+
+	if err := d.Migrate(context.Background()); err != nil {
+		log.Panic(err)
+	}
+	if *seed {
+		if err := d.Seed(context.Background()); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	rotationInterval := getEnvDuration("ROTATION_INTERVAL", defaultRotationInterval)
+	if rotationInterval <= 0 {
+		log.Panicf("Invalid ROTATION_INTERVAL %v, it must be positive", rotationInterval)
+	}
+
+	keys, err := newKeyStore(d, kek)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	jwtLeeway := getEnvDuration("JWT_LEEWAY", defaultJWTLeeway)
+	signerBackend, err := newSignerBackend()
 	if err != nil {
 		log.Panic(err)
 	}
+	// the signer follows the state changes of its keys
+	keys = signer.NewKeyStore(keys, signerBackend)
 
-	a := api.NewAPI(d)
+	prepublish := getEnvDuration("ROTATION_PREPUBLISH", defaultRotationPrepublish)
+	keyCacheTTL := getEnvDuration("KEY_CACHE_TTL", api.DefaultKeyCacheTTL)
 
-	addr := ":" + getEnvStr("PORT", "8080")
+	var encryptionKey crypto.Signer
+	if path := os.Getenv("TOKEN_ENCRYPTION_KEY_FILE"); path != "" {
+		if encryptionKey, err = auth.LoadEncryptionKey(path); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	port := getEnvStr("PORT", "8080")
+	a := api.NewAPI(d, keys, api.Config{
+		Issuer:      getEnvStr("ISSUER", "http://localhost:"+port),
+		Audience:    getEnvStr("AUDIENCE", ""),
+		Leeway:      jwtLeeway,
+		Signer:      signerBackend,
+		KeyCacheTTL: keyCacheTTL,
+		JWKSMaxAge:  jwksMaxAge(getEnvDuration("JWKS_MAX_AGE", defaultJWKSMaxAge), prepublish, keyCacheTTL),
+		// first party access tokens are encrypted when it's set
+		EncryptionKey: encryptionKey,
+	})
+
+	rotator := rotation.NewRotator(keys, rotation.Config{
+		LeadTime:         getEnvDuration("ROTATION_LEAD_TIME", defaultRotationLeadTime),
+		PrepublishPeriod: prepublish,
+		TokenTTL:         api.JWTExpiration,
+		Leeway:           jwtLeeway,
+		KeyCacheTTL:      keyCacheTTL,
+		Interval:         rotationInterval,
+		KeySpec: dao.KeySpec{
+			Algorithm:  getEnvStr("JWT_ALG", dao.DefaultAlgorithm),
+			RSAKeySize: getEnvInt("JWT_RSA_KEY_SIZE", dao.DefaultRSAKeySize),
+		},
+		Signer:   signerBackend,
+		OnChange: a.InvalidateKeys,
+	})
+	// make sure we have an active key before serving
+	if err := rotator.Rotate(context.Background()); err != nil {
+		log.Panic(err)
+	}
+
+	rotationCtx, stopRotation := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rotator.Run(rotationCtx)
+	}()
+
+	addr := ":" + port
 	srv := &http.Server{
 		Addr:    addr,
 		Handler: a.GetRoutes(),
@@ -61,16 +161,72 @@ func main() {
 		log.Printf("Got OS signal: '%v', shuting down the server with timeout: %v", osSignal, shutdownTimeout)
 	}
 
-	log.Println("Closing db ...")
-	d.Close()
-
 	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 	srv.SetKeepAlivesEnabled(false)
 
+	// the in-flight requests and the last rotation still use the db
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Failed to shutdown the server: %v", err)
+		log.Printf("Failed to shutdown the server: %v", err)
 	}
+	stopRotation()
+	wg.Wait()
+
+	log.Println("Closing db ...")
+	d.Close()
+}
+
+// newKeyStore returns the key store selected by KEYSTORE: sqlite (default), dir or memory
+func newKeyStore(d *dao.DAO, kek *dao.KEK) (dao.KeyStore, error) {
+	backend := getEnvStr("KEYSTORE", keyStoreSQLite)
+	if kek == nil && backend != keyStoreMemory {
+		log.Println("No JWK_KEK or JWK_KEK_FILE set, the private keys are stored in plaintext")
+	}
+
+	switch backend {
+	case keyStoreSQLite:
+		return d, nil
+	case keyStoreDir:
+		dir := os.Getenv("KEYSTORE_DIR")
+		if dir == "" {
+			return nil, errors.New("KEYSTORE_DIR is required by the dir key store")
+		}
+		log.Printf("Using the keys in the directory %q", dir)
+		return dao.NewDirKeyStore(dir, kek)
+	case keyStoreMemory:
+		log.Println("Using an in-memory key store, the keys and their tokens won't survive a restart")
+		return dao.NewMemoryKeyStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown KEYSTORE %q, expected %s, %s or %s", backend, keyStoreSQLite, keyStoreDir, keyStoreMemory)
+	}
+}
+
+// jwksMaxAge limits maxAge so a cached JWKS never outlives the pre-publication of a new key:
+// it's published prepublish before signing but other replicas may take keyCacheTTL to serve it
+func jwksMaxAge(maxAge, prepublish, keyCacheTTL time.Duration) time.Duration {
+	limit := prepublish - keyCacheTTL
+	if limit < 0 {
+		limit = 0
+	}
+	if maxAge > limit {
+		log.Printf("Limiting the JWKS max-age to %v, the pre-publication period minus the key cache TTL", limit)
+		return limit
+	}
+	return maxAge
+}
+
+// newSignerBackend returns the client of the signer daemon at SIGNER_URL, nil when it isn't set
+func newSignerBackend() (signer.Backend, error) {
+	signerURL := os.Getenv("SIGNER_URL")
+	if signerURL == "" {
+		return nil, nil
+	}
+	client, err := signer.NewClient(signerURL, os.Getenv("SIGNER_TOKEN"), getEnvDuration("SIGNER_TIMEOUT", signer.DefaultTimeout))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("New keys are held by the signer at %q", signerURL)
+	return client, nil
 }
 
 func getEnvStr(name, defaultVal string) string {
@@ -80,3 +236,27 @@ func getEnvStr(name, defaultVal string) string {
 	}
 	return envVal
 }
+
+func getEnvDuration(name string, defaultVal time.Duration) time.Duration {
+	envVal := os.Getenv(name)
+	if envVal == "" {
+		return defaultVal
+	}
+	d, err := time.ParseDuration(envVal)
+	if err != nil {
+		log.Panicf("Invalid duration %q for %s: %v", envVal, name, err)
+	}
+	return d
+}
+
+func getEnvInt(name string, defaultVal int) int {
+	envVal := os.Getenv(name)
+	if envVal == "" {
+		return defaultVal
+	}
+	i, err := strconv.Atoi(envVal)
+	if err != nil {
+		log.Panicf("Invalid integer %q for %s: %v", envVal, name, err)
+	}
+	return i
+}
@@ -1,11 +1,18 @@
+//go:build ignore
+// +build ignore
+
 package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
+	"os"
 	"time"
 
 	"github.com/yanpozka/airvet-jwt/dao"
+	"github.com/yanpozka/airvet-jwt/signer"
 )
 
 const dbPath = "users.db"
@@ -13,24 +20,106 @@ const dbPath = "users.db"
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	prepublish := flag.Bool("prepublish", false, "only publish the new key, it won't sign until activated")
+	alg := flag.String("alg", dao.DefaultAlgorithm, "signing algorithm of the new key: RS256/384/512, PS256/384/512, ES256, ES384 or EdDSA")
+	bits := flag.Int("bits", dao.DefaultRSAKeySize, "modulus size of new RSA keys: 2048, 3072 or 4096")
+	activate := flag.String("activate", "", "activate a pending key by kid, instead of adding a new one")
+	retire := flag.String("retire", "", "retire an active key by kid, instead of adding a new one")
+	revoke := flag.String("revoke", "", "revoke a key by kid, instead of adding a new one")
+	rewrapKEKFile := flag.String("rewrap-kek-file", "", "re-wrap the private keys with the key-encryption key in this file, instead of adding a new key")
+	keyStoreDir := flag.String("keystore-dir", "", "manage the keys in this directory instead of the database, as KEYSTORE=dir")
+	flag.Parse()
+
 	d, err := dao.NewDAO(dbPath)
 	if err != nil {
 		log.Panic(err)
 	}
+	defer d.Close()
 
-	privatekey, publickey, err := dao.GeneratePrivatePublicKeyPair()
+	kek, err := dao.LoadKEK(os.Getenv("JWK_KEK"), os.Getenv("JWK_KEK_FILE"))
 	if err != nil {
 		log.Panic(err)
 	}
-	expTime := time.Now().Add(dao.JWKExpiration)
-	jwk := &dao.JWK{
-		PrivateKey: privatekey,
-		PublicKey:  publickey,
-		ExpiresAt:  expTime.Unix(),
+	d.SetKEK(kek)
+
+	ctx := context.Background()
+	if err := d.Migrate(ctx); err != nil {
+		log.Panic(err)
+	}
+
+	var backend signer.Backend
+	if signerURL := os.Getenv("SIGNER_URL"); signerURL != "" {
+		if backend, err = signer.NewClient(signerURL, os.Getenv("SIGNER_TOKEN"), 0); err != nil {
+			log.Panic(err)
+		}
 	}
-	if err := d.InsertJWK(context.Background(), jwk); err != nil {
+
+	var keys dao.KeyStore = d
+	if *keyStoreDir != "" {
+		if keys, err = dao.NewDirKeyStore(*keyStoreDir, kek); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	// the signer follows the state changes of its keys, it has no key to re-wrap
+	signed := signer.NewKeyStore(keys, backend)
+	switch {
+	case *activate != "":
+		err = signed.UpdateJWKState(ctx, *activate, dao.KeyStateActive)
+	case *retire != "":
+		err = signed.UpdateJWKState(ctx, *retire, dao.KeyStateRetiring)
+	case *revoke != "":
+		err = signed.UpdateJWKState(ctx, *revoke, dao.KeyStateRevoked)
+	case *rewrapKEKFile != "":
+		err = rewrap(ctx, keys, *rewrapKEKFile)
+	default:
+		err = addJWK(ctx, signed, backend, dao.KeySpec{Algorithm: *alg, RSAKeySize: *bits}, *prepublish)
+	}
+	if err != nil {
 		log.Panic(err)
 	}
+}
 
-	log.Printf("Added a new JWK, will expire at: %v", expTime)
+func addJWK(ctx context.Context, keys dao.KeyStore, backend signer.Backend, spec dao.KeySpec, prepublish bool) error {
+	expTime := time.Now().Add(dao.JWKExpiration)
+	// the key pair is generated by the signer daemon when SIGNER_URL is set
+	jwk, err := signer.NewJWK(ctx, backend, spec, expTime)
+	if err != nil {
+		return err
+	}
+	if err := keys.InsertJWK(ctx, jwk); err != nil {
+		return err
+	}
+
+	if prepublish {
+		log.Printf("Published a new pending %s JWK with kid %q, will expire at: %v", jwk.Algorithm, jwk.KID, expTime)
+		return nil
+	}
+	if err := keys.UpdateJWKState(ctx, jwk.KID, dao.KeyStateActive); err != nil {
+		return err
+	}
+
+	log.Printf("Added a new %s JWK with kid %q, will expire at: %v", jwk.Algorithm, jwk.KID, expTime)
+	return nil
+}
+
+// rewrapper is a key store encrypting the private keys with a KEK
+type rewrapper interface {
+	RewrapJWKs(ctx context.Context, newKEK *dao.KEK) error
+}
+
+func rewrap(ctx context.Context, keys dao.KeyStore, kekFile string) error {
+	r, ok := keys.(rewrapper)
+	if !ok {
+		return errors.New("the key store doesn't encrypt the private keys")
+	}
+	newKEK, err := dao.LoadKEK("", kekFile)
+	if err != nil {
+		return err
+	}
+	if err := r.RewrapJWKs(ctx, newKEK); err != nil {
+		return err
+	}
+	log.Printf("Re-wrapped the private keys with the key-encryption key %s, set it in JWK_KEK_FILE", newKEK.ID)
+	return nil
 }
@@ -0,0 +1,157 @@
+package rotation
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+	"github.com/yanpozka/airvet-jwt/signer"
+)
+
+// Config defines when keys are generated, activated and purged
+type Config struct {
+	// LeadTime is how long before the active key expires a new pending key is generated
+	LeadTime time.Duration
+	// PrepublishPeriod is how long a pending key is published before it starts signing
+	PrepublishPeriod time.Duration
+	// TokenTTL is the lifetime of the longest lived token signed by a key,
+	// retiring keys are purged once it has elapsed since they stopped signing
+	TokenTTL time.Duration
+	// Leeway is the clock skew allowed validating the tokens, it delays the purge as much
+	Leeway time.Duration
+	// KeyCacheTTL is how long the servers cache the key set, they may still sign with
+	// a retiring key until their cache expires so it delays the purge as much
+	KeyCacheTTL time.Duration
+	// Interval is how often the key set is checked
+	Interval time.Duration
+	// KeySpec is the algorithm and size of the new keys, an active key generated
+	// with another spec is rotated as if it was about to expire
+	KeySpec dao.KeySpec
+	// Signer generates the new keys, holding their private keys, when set. Active keys
+	// with a local private key are then rotated as if they were about to expire
+	Signer signer.Backend
+	// OnChange is called after a key is added, activated or purged, to invalidate key caches
+	OnChange func()
+}
+
+// Rotator rotates the JWKs in the background
+type Rotator struct {
+	keys dao.KeyStore
+	cfg  Config
+}
+
+// NewRotator creates a new Rotator of the keys in the key store
+func NewRotator(keys dao.KeyStore, cfg Config) *Rotator {
+	return &Rotator{
+		keys: keys,
+		cfg:  cfg,
+	}
+}
+
+// Run rotates the keys every interval until the context is done
+func (r *Rotator) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Stopping key rotation")
+			return
+		case <-ticker.C:
+			if err := r.Rotate(ctx); err != nil {
+				log.Printf("Error rotating keys: %v", err)
+			}
+		}
+	}
+}
+
+// Rotate makes a single pass over the key set: it makes sure there is an active key,
+// pre-publishes its successor ahead of expiration, activates the successor once
+// it has been published long enough and purges the keys without valid tokens.
+// Without an active key a key is activated in the same pass, skipping the pre-publication
+func (r *Rotator) Rotate(ctx context.Context) error {
+	jwks, err := r.keys.GetJWKS(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	var active, pending *dao.JWK
+	for _, jwk := range jwks {
+		switch {
+		case jwk.State == dao.KeyStateActive && active == nil:
+			active = jwk
+		case jwk.State == dao.KeyStatePending && pending == nil:
+			pending = jwk
+		case jwk.State == dao.KeyStateRetiring && now.After(time.Unix(jwk.RetiredAt, 0).Add(r.purgeDelay())):
+			if err := r.keys.PurgeJWK(ctx, jwk.KID); err != nil {
+				return err
+			}
+			log.Printf("Purged retired JWK %q", jwk.KID)
+			r.changed()
+		}
+	}
+
+	if active == nil {
+		// nothing is signing, there is no reason to wait for the pre-publication
+		if pending == nil {
+			if pending, err = r.addPendingJWK(ctx, now); err != nil {
+				return err
+			}
+		}
+		return r.activate(ctx, pending)
+	}
+
+	expiresAt := time.Unix(active.ExpiresAt, 0)
+	if pending == nil && (!now.Before(expiresAt.Add(-r.cfg.LeadTime)) || !r.matches(active)) {
+		if pending, err = r.addPendingJWK(ctx, now); err != nil {
+			return err
+		}
+	}
+	if pending != nil && (!now.Before(time.Unix(pending.CreatedAt, 0).Add(r.cfg.PrepublishPeriod)) || !now.Before(expiresAt)) {
+		return r.activate(ctx, pending)
+	}
+	return nil
+}
+
+// matches reports whether the key follows the spec and is held where new keys are generated
+func (r *Rotator) matches(jwk *dao.JWK) bool {
+	return jwk.Matches(r.cfg.KeySpec) && (r.cfg.Signer == nil || jwk.IsExternal())
+}
+
+func (r *Rotator) addPendingJWK(ctx context.Context, now time.Time) (*dao.JWK, error) {
+	jwk, err := signer.NewJWK(ctx, r.cfg.Signer, r.cfg.KeySpec, now.Add(dao.JWKExpiration))
+	if err != nil {
+		return nil, err
+	}
+	// published as of this pass, generating the key takes a while
+	jwk.CreatedAt = now.Unix()
+	if err := r.keys.InsertJWK(ctx, jwk); err != nil {
+		return nil, err
+	}
+	log.Printf("Published a new pending %s JWK %q", jwk.Algorithm, jwk.KID)
+	r.changed()
+	return jwk, nil
+}
+
+func (r *Rotator) activate(ctx context.Context, jwk *dao.JWK) error {
+	if err := r.keys.UpdateJWKState(ctx, jwk.KID, dao.KeyStateActive); err != nil {
+		return err
+	}
+	log.Printf("Activated JWK %q, will expire at: %v", jwk.KID, time.Unix(jwk.ExpiresAt, 0))
+	r.changed()
+	return nil
+}
+
+// purgeDelay is how long a retiring key can still verify tokens after it stopped signing everywhere
+func (r *Rotator) purgeDelay() time.Duration {
+	return r.cfg.TokenTTL + r.cfg.Leeway + r.cfg.KeyCacheTTL
+}
+
+func (r *Rotator) changed() {
+	if r.cfg.OnChange != nil {
+		r.cfg.OnChange()
+	}
+}
@@ -0,0 +1,207 @@
+package rotation
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+	"github.com/yanpozka/airvet-jwt/signer"
+)
+
+// newTestRotator returns a rotator over a fresh migrated database without keys
+func newTestRotator(t *testing.T, cfg Config) (*Rotator, *dao.DAO) {
+	t.Helper()
+
+	d, err := dao.NewDAO(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	if err := d.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return NewRotator(d, cfg), d
+}
+
+// rotate makes a rotation pass and returns the key IDs in each state
+func rotate(t *testing.T, r *Rotator) map[dao.KeyState][]string {
+	t.Helper()
+
+	if err := r.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := r.keys.GetJWKS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[dao.KeyState][]string{}
+	for _, j := range jwks {
+		keys[j.State] = append(keys[j.State], j.KID)
+	}
+	return keys
+}
+
+func TestRotateWithoutActiveKey(t *testing.T) {
+	r, d := newTestRotator(t, Config{PrepublishPeriod: time.Hour, TokenTTL: time.Hour})
+
+	// nothing can sign, the first key is activated without the pre-publication
+	keys := rotate(t, r)
+	if len(keys[dao.KeyStateActive]) != 1 || len(keys[dao.KeyStatePending]) != 0 {
+		t.Fatalf("got keys %v, want one active key", keys)
+	}
+	revoked := keys[dao.KeyStateActive][0]
+	if err := d.RevokeJWK(context.Background(), revoked); err != nil {
+		t.Fatal(err)
+	}
+
+	keys = rotate(t, r)
+	if len(keys[dao.KeyStateActive]) != 1 || keys[dao.KeyStateActive][0] == revoked || len(keys[dao.KeyStatePending]) != 0 {
+		t.Fatalf("got keys %v, want a new active key after %s was revoked", keys, revoked)
+	}
+}
+
+func TestRotatePrepublishesSuccessor(t *testing.T) {
+	r, _ := newTestRotator(t, Config{PrepublishPeriod: time.Hour, TokenTTL: time.Hour})
+	active := rotate(t, r)[dao.KeyStateActive][0]
+
+	// the active key is within the lead time of its expiration
+	r.cfg.LeadTime = dao.JWKExpiration
+	keys := rotate(t, r)
+	if len(keys[dao.KeyStatePending]) != 1 || keys[dao.KeyStateActive][0] != active {
+		t.Fatalf("got keys %v, want a pending successor of %s", keys, active)
+	}
+	pending := keys[dao.KeyStatePending][0]
+
+	// still within the pre-publication period
+	keys = rotate(t, r)
+	if len(keys[dao.KeyStatePending]) != 1 || keys[dao.KeyStatePending][0] != pending || keys[dao.KeyStateActive][0] != active {
+		t.Fatalf("got keys %v, want %s still pending", keys, pending)
+	}
+
+	r.cfg.PrepublishPeriod = 0
+	keys = rotate(t, r)
+	if keys[dao.KeyStateActive][0] != pending || len(keys[dao.KeyStateRetiring]) != 1 || keys[dao.KeyStateRetiring][0] != active {
+		t.Fatalf("got keys %v, want %s active and %s retiring", keys, pending, active)
+	}
+}
+
+func TestRotatePurgesRetiredKeys(t *testing.T) {
+	r, _ := newTestRotator(t, Config{TokenTTL: time.Hour})
+	retiring := rotate(t, r)[dao.KeyStateActive][0]
+
+	// the successor is activated right away, the first key retires
+	r.cfg.LeadTime = dao.JWKExpiration
+	keys := rotate(t, r)
+	if len(keys[dao.KeyStateRetiring]) != 1 || keys[dao.KeyStateRetiring][0] != retiring {
+		t.Fatalf("got keys %v, want %s retiring", keys, retiring)
+	}
+
+	// its tokens may still be valid
+	r.cfg.LeadTime = 0
+	if keys = rotate(t, r); len(keys[dao.KeyStateRetiring]) != 1 {
+		t.Fatalf("got keys %v, want %s kept until its tokens expire", keys, retiring)
+	}
+
+	// nor once they expire, within the leeway
+	r.cfg.TokenTTL, r.cfg.Leeway = -time.Second, time.Hour
+	if keys = rotate(t, r); len(keys[dao.KeyStateRetiring]) != 1 {
+		t.Fatalf("got keys %v, want %s kept within the leeway", keys, retiring)
+	}
+
+	// nor while other servers may still sign with it from their key cache
+	r.cfg.Leeway, r.cfg.KeyCacheTTL = 0, time.Hour
+	if keys = rotate(t, r); len(keys[dao.KeyStateRetiring]) != 1 {
+		t.Fatalf("got keys %v, want %s kept within the key cache TTL", keys, retiring)
+	}
+
+	r.cfg.KeyCacheTTL = 0
+	if keys = rotate(t, r); len(keys[dao.KeyStateRetiring]) != 0 {
+		t.Fatalf("got retiring keys %v, want %s purged", keys[dao.KeyStateRetiring], retiring)
+	}
+}
+
+func TestRotateOnAlgorithmChange(t *testing.T) {
+	r, d := newTestRotator(t, Config{PrepublishPeriod: time.Hour, TokenTTL: time.Hour})
+	active := rotate(t, r)[dao.KeyStateActive][0]
+
+	// the active key is far from expiring, but signs with another algorithm
+	r.cfg.KeySpec.Algorithm = dao.AlgES256
+	keys := rotate(t, r)
+	if len(keys[dao.KeyStatePending]) != 1 || keys[dao.KeyStateActive][0] != active {
+		t.Fatalf("got keys %v, want a pending successor of %s", keys, active)
+	}
+	jwks, err := d.GetJWKS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range jwks {
+		if j.KID == keys[dao.KeyStatePending][0] && j.Algorithm != dao.AlgES256 {
+			t.Fatalf("got a pending %s key, want %s", j.Algorithm, dao.AlgES256)
+		}
+	}
+
+	// the successor keeps signing while the algorithm doesn't change
+	r.cfg.PrepublishPeriod = 0
+	keys = rotate(t, r)
+	successor := keys[dao.KeyStateActive][0]
+	if successor == active || len(keys[dao.KeyStatePending]) != 0 {
+		t.Fatalf("got keys %v, want the ES256 key active", keys)
+	}
+	if keys = rotate(t, r); keys[dao.KeyStateActive][0] != successor || len(keys[dao.KeyStatePending]) != 0 {
+		t.Fatalf("got keys %v, want %s still active without a successor", keys, successor)
+	}
+}
+
+func TestRotateOnKeySizeChange(t *testing.T) {
+	r, _ := newTestRotator(t, Config{PrepublishPeriod: time.Hour, TokenTTL: time.Hour})
+	active := rotate(t, r)[dao.KeyStateActive][0]
+
+	r.cfg.KeySpec.RSAKeySize = 3072
+	keys := rotate(t, r)
+	if len(keys[dao.KeyStatePending]) != 1 || keys[dao.KeyStateActive][0] != active {
+		t.Fatalf("got keys %v, want a pending 3072 bits successor of %s", keys, active)
+	}
+}
+
+func TestRotateToExternalSigner(t *testing.T) {
+	ctx := context.Background()
+	r, d := newTestRotator(t, Config{TokenTTL: time.Hour})
+	local := rotate(t, r)[dao.KeyStateActive][0]
+
+	// the active key holding its private key is rotated right away
+	fake := signer.NewFake()
+	r = NewRotator(signer.NewKeyStore(d, fake), Config{TokenTTL: time.Hour, Signer: fake})
+	keys := rotate(t, r)
+	if len(keys[dao.KeyStateActive]) != 1 || keys[dao.KeyStateRetiring][0] != local {
+		t.Fatalf("got keys %v, want %s retiring", keys, local)
+	}
+	active, err := d.GetJWK(ctx, keys[dao.KeyStateActive][0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !active.IsExternal() {
+		t.Fatal("got the private key of the new key stored, want it held by the signer")
+	}
+	if keys = rotate(t, r); keys[dao.KeyStateActive][0] != active.KID {
+		t.Fatalf("got keys %v, want %s still active", keys, active.KID)
+	}
+
+	// the signer only signs with the keys the rotator activated
+	s, err := signer.ForJWK(ctx, fake, active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Sign(nil, make([]byte, 32), crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.keys.UpdateJWKState(ctx, active.KID, dao.KeyStateRevoked); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Sign(nil, make([]byte, 32), crypto.SHA256); !errors.Is(err, signer.ErrKeyNotUsable) {
+		t.Fatalf("got %v signing with the revoked key, want %v", err, signer.ErrKeyNotUsable)
+	}
+}
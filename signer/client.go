@@ -0,0 +1,186 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+const (
+	// DefaultTimeout limits every request to the signer daemon
+	DefaultTimeout = 5 * time.Second
+
+	keysPath  = "/keys"
+	signPath  = "/sign"
+	statePath = "/keys/state"
+	purgePath = "/keys/purge"
+
+	unixScheme = "unix"
+)
+
+type generateKeyIn struct {
+	Algorithm  string `json:"alg"`
+	RSAKeySize int    `json:"rsa_key_size,omitempty"`
+}
+
+type generateKeyOut struct {
+	KID       string `json:"kid"`
+	Algorithm string `json:"alg"`
+	PublicKey string `json:"public_key"`
+}
+
+type signIn struct {
+	KID    string `json:"kid"`
+	Digest []byte `json:"digest"`
+	// Hash is the crypto.Hash name of the digest, empty when the message isn't hashed
+	Hash string `json:"hash,omitempty"`
+	// PSS selects RSA-PSS instead of PKCS #1 v1.5 for RSA keys
+	PSS bool `json:"pss,omitempty"`
+}
+
+type signOut struct {
+	Signature []byte `json:"signature"`
+}
+
+type keyStateIn struct {
+	KID   string       `json:"kid"`
+	State dao.KeyState `json:"state"`
+}
+
+type purgeKeyIn struct {
+	KID string `json:"kid"`
+}
+
+var _ Backend = (*Client)(nil)
+
+// Client is the Backend of the signer daemon, reached over HTTP or a Unix socket
+type Client struct {
+	baseURL string
+	token   string
+	timeout time.Duration
+	http    *http.Client
+}
+
+// NewClient creates a client of the daemon at rawURL: http(s)://host:port or unix:///path/to.sock.
+// The token is sent as bearer token when it's not empty. Every request is bounded by timeout,
+// DefaultTimeout when zero
+func NewClient(rawURL, token string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer URL: %w", err)
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	c := &Client{token: token, timeout: timeout, http: &http.Client{}}
+	switch u.Scheme {
+	case "http", "https":
+		c.baseURL = strings.TrimSuffix(u.String(), "/")
+	case unixScheme:
+		socket := u.Path
+		if socket == "" {
+			socket = u.Opaque
+		}
+		dialer := net.Dialer{}
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, unixScheme, socket)
+			},
+		}
+		// the host is ignored, every connection goes to the socket
+		c.baseURL = "http://signer"
+	default:
+		return nil, fmt.Errorf("invalid signer URL %q, expected http, https or unix scheme", rawURL)
+	}
+	return c, nil
+}
+
+// GenerateKey creates a key pair in the daemon
+func (c *Client) GenerateKey(ctx context.Context, spec dao.KeySpec) (*dao.JWK, error) {
+	var out generateKeyOut
+	in := generateKeyIn{Algorithm: spec.Algorithm, RSAKeySize: spec.RSAKeySize}
+	if err := c.post(ctx, keysPath, in, &out); err != nil {
+		return nil, err
+	}
+	return &dao.JWK{KID: out.KID, Algorithm: out.Algorithm, PublicKey: out.PublicKey}, nil
+}
+
+// Sign signs the digest with the key in the daemon
+func (c *Client) Sign(ctx context.Context, kid string, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	in := signIn{KID: kid, Digest: digest}
+	if hash := opts.HashFunc(); hash != 0 {
+		in.Hash = hash.String()
+	}
+	_, in.PSS = opts.(*rsa.PSSOptions)
+
+	var out signOut
+	if err := c.post(ctx, signPath, in, &out); err != nil {
+		return nil, err
+	}
+	return out.Signature, nil
+}
+
+// UpdateKeyState moves the key to the state in the daemon
+func (c *Client) UpdateKeyState(ctx context.Context, kid string, state dao.KeyState) error {
+	return c.post(ctx, statePath, keyStateIn{KID: kid, State: state}, nil)
+}
+
+// PurgeKey deletes the key in the daemon
+func (c *Client) PurgeKey(ctx context.Context, kid string) error {
+	return c.post(ctx, purgePath, purgeKeyIn{KID: kid}, nil)
+}
+
+// post sends the request, bounded by the client timeout, and decodes the response into out when it's not nil
+func (c *Client) post(ctx context.Context, path string, in, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create signer request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("signer request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return dao.ErrJWKNotFound
+	case http.StatusForbidden:
+		return ErrKeyNotUsable
+	case http.StatusConflict:
+		return dao.ErrInvalidKeyTransition
+	default:
+		return fmt.Errorf("unexpected signer response status: %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode signer response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package signer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+const testToken = "signer-secret"
+
+// newTestClient returns a client of a signer daemon keeping its keys in memory
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+
+	srv := httptest.NewServer(NewHandler(dao.NewMemoryKeyStore(), testToken))
+	t.Cleanup(srv.Close)
+	c, err := NewClient(srv.URL, testToken, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	// RSA-PSS and ECDSA signatures go through the daemon
+	for _, alg := range []string{dao.AlgPS256, dao.AlgES384} {
+		jwk := generateKey(t, c, alg, dao.KeyStatePending)
+		s, err := ForJWK(ctx, c, jwk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := signJWS(t, s, jwk.KID, alg); !errors.Is(err, ErrKeyNotUsable) {
+			t.Fatalf("got %v signing with a pending key, want %v", err, ErrKeyNotUsable)
+		}
+		if err := c.UpdateKeyState(ctx, jwk.KID, dao.KeyStateActive); err != nil {
+			t.Fatal(err)
+		}
+		if err := signJWS(t, s, jwk.KID, alg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jwk := generateKey(t, c, dao.AlgEdDSA, dao.KeyStateActive)
+	// the state changes can be sent again
+	if err := c.UpdateKeyState(ctx, jwk.KID, dao.KeyStateActive); err != nil {
+		t.Fatalf("got %v activating the key again", err)
+	}
+	if err := c.UpdateKeyState(ctx, jwk.KID, dao.KeyStatePending); !errors.Is(err, dao.ErrInvalidKeyTransition) {
+		t.Fatalf("got %v moving the key back to pending, want %v", err, dao.ErrInvalidKeyTransition)
+	}
+	// the active key is purged when the key store purged it anyway
+	if err := c.PurgeKey(ctx, jwk.KID); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PurgeKey(ctx, jwk.KID); !errors.Is(err, dao.ErrJWKNotFound) {
+		t.Fatalf("got %v purging the key again, want %v", err, dao.ErrJWKNotFound)
+	}
+	if _, err := c.GenerateKey(ctx, dao.KeySpec{Algorithm: "HS256"}); err == nil {
+		t.Fatal("got a HS256 key, want an error")
+	}
+
+	unauthorized, err := NewClient(c.baseURL, "wrong", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unauthorized.GenerateKey(ctx, dao.KeySpec{Algorithm: dao.AlgES256}); err == nil {
+		t.Fatal("got a key with the wrong token, want an error")
+	}
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "signer.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: NewHandler(dao.NewMemoryKeyStore(), "")}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	c, err := NewClient("unix://"+socket, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := generateKey(t, c, dao.AlgES256, dao.KeyStateActive)
+	s, err := ForJWK(context.Background(), c, jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signJWS(t, s, jwk.KID, dao.AlgES256); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewClient("ftp://signer", "", 0); err == nil {
+		t.Fatal("got a client of a ftp URL, want an error")
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	// the handler must return before the server is closed
+	t.Cleanup(func() { close(release) })
+
+	c, err := NewClient(srv.URL, "", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := c.GenerateKey(context.Background(), dao.KeySpec{Algorithm: dao.AlgES256}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("got the error after %v, want it after the timeout", elapsed)
+	}
+}
+
+func TestKeySignsWithTheRequestContext(t *testing.T) {
+	c := newTestClient(t)
+	jwk := generateKey(t, c, dao.AlgES256, dao.KeyStateActive)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s, err := ForJWK(ctx, c, jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signJWS(t, s, jwk.KID, dao.AlgES256); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v signing for a cancelled request, want %v", err, context.Canceled)
+	}
+
+	// a signer built once signs with the context of the next request
+	if err := signJWS(t, WithContext(context.Background(), s), jwk.KID, dao.AlgES256); err != nil {
+		t.Fatal(err)
+	}
+}
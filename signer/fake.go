@@ -0,0 +1,84 @@
+package signer
+
+import (
+	"context"
+	"crypto"
+	"sync"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+var _ Backend = (*Fake)(nil)
+
+// Fake is an in-process Backend for tests, its keys live in memory. It's safe for concurrent use
+type Fake struct {
+	k *keyring
+
+	mu         sync.Mutex
+	err        error
+	signatures int
+}
+
+// NewFake creates a Fake without keys
+func NewFake() *Fake {
+	return &Fake{k: newKeyring(dao.NewMemoryKeyStore())}
+}
+
+// SetErr makes every call return err, nil restores them
+func (f *Fake) SetErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Signatures returns the number of signatures made
+func (f *Fake) Signatures() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.signatures
+}
+
+// GenerateKey creates a pending key pair in memory
+func (f *Fake) GenerateKey(ctx context.Context, spec dao.KeySpec) (*dao.JWK, error) {
+	if err := f.getErr(); err != nil {
+		return nil, err
+	}
+	return f.k.generateKey(ctx, spec)
+}
+
+// Sign signs the digest with the key in memory, as the daemon only when it's active or retiring
+func (f *Fake) Sign(ctx context.Context, kid string, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := f.getErr(); err != nil {
+		return nil, err
+	}
+	signature, err := f.k.sign(ctx, kid, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.signatures++
+	f.mu.Unlock()
+	return signature, nil
+}
+
+// UpdateKeyState moves the key to the state
+func (f *Fake) UpdateKeyState(ctx context.Context, kid string, state dao.KeyState) error {
+	if err := f.getErr(); err != nil {
+		return err
+	}
+	return f.k.updateKeyState(ctx, kid, state)
+}
+
+// PurgeKey deletes the key
+func (f *Fake) PurgeKey(ctx context.Context, kid string) error {
+	if err := f.getErr(); err != nil {
+		return err
+	}
+	return f.k.purgeKey(ctx, kid)
+}
+
+func (f *Fake) getErr() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
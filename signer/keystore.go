@@ -0,0 +1,53 @@
+package signer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+// keyStore forwards the state changes of the keys held by the backend to it before storing them,
+// a key revoked in the key store can't sign anymore even if storing the state fails
+type keyStore struct {
+	dao.KeyStore
+	backend Backend
+}
+
+// NewKeyStore returns the key store keeping the backend in sync with the lifecycle of its keys,
+// keys is returned as is when the backend is nil
+func NewKeyStore(keys dao.KeyStore, b Backend) dao.KeyStore {
+	if b == nil {
+		return keys
+	}
+	return &keyStore{KeyStore: keys, backend: b}
+}
+
+// UpdateJWKState moves the key to state in the backend, when it holds the key, and in the key store
+func (s *keyStore) UpdateJWKState(ctx context.Context, kid string, state dao.KeyState) error {
+	jwk, err := s.KeyStore.GetJWK(ctx, kid)
+	if err != nil {
+		return err
+	}
+	if jwk.IsExternal() {
+		if err := s.backend.UpdateKeyState(ctx, kid, state); err != nil {
+			return fmt.Errorf("failed to update the state of jwk %q in the signer: %w", kid, err)
+		}
+	}
+	return s.KeyStore.UpdateJWKState(ctx, kid, state)
+}
+
+// PurgeJWK deletes the key in the backend, when it holds the key, and in the key store.
+// Only the retiring and revoked keys are deleted in the backend, as in the key store
+func (s *keyStore) PurgeJWK(ctx context.Context, kid string) error {
+	jwk, err := s.KeyStore.GetJWK(ctx, kid)
+	if err != nil {
+		return err
+	}
+	if jwk.IsExternal() && (jwk.State == dao.KeyStateRetiring || jwk.State == dao.KeyStateRevoked) {
+		if err := s.backend.PurgeKey(ctx, kid); err != nil {
+			return fmt.Errorf("failed to purge jwk %q in the signer: %w", kid, err)
+		}
+	}
+	return s.KeyStore.PurgeJWK(ctx, kid)
+}
@@ -0,0 +1,227 @@
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+var hashesByName = map[string]crypto.Hash{
+	crypto.SHA256.String(): crypto.SHA256,
+	crypto.SHA384.String(): crypto.SHA384,
+	crypto.SHA512.String(): crypto.SHA512,
+}
+
+// keyring generates and signs with the keys of a key store, the parsed keys are cached
+type keyring struct {
+	keys dao.KeyStore
+
+	mu      sync.Mutex
+	signers map[string]crypto.Signer
+}
+
+func newKeyring(keys dao.KeyStore) *keyring {
+	return &keyring{keys: keys, signers: map[string]crypto.Signer{}}
+}
+
+func (k *keyring) generateKey(ctx context.Context, spec dao.KeySpec) (*dao.JWK, error) {
+	jwk, err := dao.NewJWK(spec, time.Now().Add(dao.JWKExpiration))
+	if err != nil {
+		return nil, err
+	}
+	if err := k.keys.InsertJWK(ctx, jwk); err != nil {
+		return nil, err
+	}
+	return &dao.JWK{KID: jwk.KID, Algorithm: jwk.Algorithm, PublicKey: jwk.PublicKey}, nil
+}
+
+// sign signs with the key, only when it's active or retiring
+func (k *keyring) sign(ctx context.Context, kid string, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	// the state is read every time, it's changed by the key store owner
+	jwk, err := k.keys.GetJWK(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+	if !jwk.CanVerify() {
+		return nil, fmt.Errorf("jwk %q is %s: %w", kid, jwk.State, ErrKeyNotUsable)
+	}
+	s, err := k.signer(jwk)
+	if err != nil {
+		return nil, err
+	}
+	return s.Sign(rand.Reader, digest, opts)
+}
+
+func (k *keyring) signer(jwk *dao.JWK) (crypto.Signer, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if s, ok := k.signers[jwk.KID]; ok {
+		return s, nil
+	}
+	s, err := jwk.GetPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	k.signers[jwk.KID] = s
+	return s, nil
+}
+
+// updateKeyState moves the key to state, it's done when the key is already in it
+func (k *keyring) updateKeyState(ctx context.Context, kid string, state dao.KeyState) error {
+	jwk, err := k.keys.GetJWK(ctx, kid)
+	if err != nil {
+		return err
+	}
+	if jwk.State == state {
+		return nil
+	}
+	return k.keys.UpdateJWKState(ctx, kid, state)
+}
+
+// purgeKey deletes the key, revoking it first when it can't be purged in its state
+func (k *keyring) purgeKey(ctx context.Context, kid string) error {
+	jwk, err := k.keys.GetJWK(ctx, kid)
+	if err != nil {
+		return err
+	}
+	if jwk.State != dao.KeyStateRetiring && jwk.State != dao.KeyStateRevoked {
+		if err := k.keys.UpdateJWKState(ctx, kid, dao.KeyStateRevoked); err != nil {
+			return err
+		}
+	}
+	if err := k.keys.PurgeJWK(ctx, kid); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	delete(k.signers, kid)
+	k.mu.Unlock()
+	return nil
+}
+
+// NewHandler returns the HTTP handler of the signer daemon, the private keys are kept
+// in the key store and never leave it. Requests need the bearer token when it's not empty
+func NewHandler(keys dao.KeyStore, token string) http.Handler {
+	k := newKeyring(keys)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(keysPath, func(w http.ResponseWriter, req *http.Request) {
+		var in generateKeyIn
+		if !readRequest(w, req, token, &in) {
+			return
+		}
+		jwk, err := k.generateKey(req.Context(), dao.KeySpec{Algorithm: in.Algorithm, RSAKeySize: in.RSAKeySize})
+		switch {
+		case errors.Is(err, dao.ErrUnsupportedAlgorithm) || errors.Is(err, dao.ErrUnsupportedKeySize):
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("Error generating key: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Generated a new %s key %q", jwk.Algorithm, jwk.KID)
+		writeResponse(w, generateKeyOut{KID: jwk.KID, Algorithm: jwk.Algorithm, PublicKey: jwk.PublicKey})
+	})
+	mux.HandleFunc(signPath, func(w http.ResponseWriter, req *http.Request) {
+		var in signIn
+		if !readRequest(w, req, token, &in) {
+			return
+		}
+		var opts crypto.SignerOpts = crypto.Hash(0)
+		if in.Hash != "" {
+			hash, ok := hashesByName[in.Hash]
+			if !ok || len(in.Digest) != hash.Size() {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			opts = hash
+			if in.PSS {
+				opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+			}
+		}
+
+		signature, err := k.sign(req.Context(), in.KID, in.Digest, opts)
+		if err != nil {
+			writeError(w, in.KID, err)
+			return
+		}
+		writeResponse(w, signOut{Signature: signature})
+	})
+	mux.HandleFunc(statePath, func(w http.ResponseWriter, req *http.Request) {
+		var in keyStateIn
+		if !readRequest(w, req, token, &in) {
+			return
+		}
+		if err := k.updateKeyState(req.Context(), in.KID, in.State); err != nil {
+			writeError(w, in.KID, err)
+			return
+		}
+		log.Printf("Key %q is %s", in.KID, in.State)
+		writeResponse(w, struct{}{})
+	})
+	mux.HandleFunc(purgePath, func(w http.ResponseWriter, req *http.Request) {
+		var in purgeKeyIn
+		if !readRequest(w, req, token, &in) {
+			return
+		}
+		if err := k.purgeKey(req.Context(), in.KID); err != nil {
+			writeError(w, in.KID, err)
+			return
+		}
+		log.Printf("Purged key %q", in.KID)
+		writeResponse(w, struct{}{})
+	})
+	return mux
+}
+
+// writeError writes the response status of the error, unexpected errors are logged
+func writeError(w http.ResponseWriter, kid string, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, dao.ErrJWKNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrKeyNotUsable):
+		status = http.StatusForbidden
+	case errors.Is(err, dao.ErrInvalidKeyTransition):
+		status = http.StatusConflict
+	default:
+		log.Printf("Error with key %q: %v", kid, err)
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// readRequest checks the method and the token and decodes the JSON body into in,
+// it writes the error response and returns false when the request is rejected
+func readRequest(w http.ResponseWriter, req *http.Request, token string, in interface{}) bool {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	if token != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	if err := json.NewDecoder(req.Body).Decode(in); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
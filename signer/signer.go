@@ -0,0 +1,198 @@
+// Package signer signs tokens through crypto.Signer, so the private keys can be held by
+// an external signer, as the signer daemon or a PKCS#11 or KMS service, and never be loaded
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers the hashes of the JWS algorithms
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/square/go-jose/v3"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+var (
+	// ErrNoBackend is returned signing with a key held by an external signer when none is configured
+	ErrNoBackend = errors.New("the private key is held by an external signer and none is configured")
+
+	// ErrKeyNotUsable is returned signing with a key that isn't active or retiring in the backend
+	ErrKeyNotUsable = errors.New("the key can't sign in its state")
+)
+
+// Backend holds private keys and signs with them, they never leave it. The backend follows
+// the lifecycle of its keys, it only signs with the active and retiring ones
+type Backend interface {
+	// GenerateKey creates a pending key pair following the spec and returns its public JWK,
+	// the private key stays in the backend
+	GenerateKey(ctx context.Context, spec dao.KeySpec) (*dao.JWK, error)
+	// Sign signs the digest with the key as crypto.Signer.Sign does,
+	// opts is the crypto.Hash of the digest or *rsa.PSSOptions
+	Sign(ctx context.Context, kid string, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+	// UpdateKeyState moves the key to the state it has in the key store
+	UpdateKeyState(ctx context.Context, kid string, state dao.KeyState) error
+	// PurgeKey deletes the key, in any state
+	PurgeKey(ctx context.Context, kid string) error
+}
+
+// NewJWK generates a key pair in the backend, or locally when the backend is nil,
+// that should stop signing at expiresAt
+func NewJWK(ctx context.Context, b Backend, spec dao.KeySpec, expiresAt time.Time) (*dao.JWK, error) {
+	if b == nil {
+		return dao.NewJWK(spec, expiresAt)
+	}
+	jwk, err := b.GenerateKey(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	if !jwk.IsExternal() {
+		return nil, fmt.Errorf("the signer returned the private key of jwk %q", jwk.KID)
+	}
+	if _, err := jwk.GetPublicKey(); err != nil {
+		return nil, err
+	}
+	jwk.ExpiresAt = expiresAt.Unix()
+	return jwk, nil
+}
+
+// ForJWK returns the crypto.Signer of the key: the parsed private key, or a Key
+// signing in the backend when the private key is held by an external signer, ctx
+// bounds its signatures
+func ForJWK(ctx context.Context, b Backend, jwk *dao.JWK) (crypto.Signer, error) {
+	if !jwk.IsExternal() {
+		return jwk.GetPrivateKey()
+	}
+	if b == nil {
+		return nil, fmt.Errorf("jwk %q: %w", jwk.KID, ErrNoBackend)
+	}
+	publicKey, err := jwk.GetPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return &Key{ctx: ctx, backend: b, kid: jwk.KID, publicKey: publicKey}, nil
+}
+
+// Key is a crypto.Signer whose private key is held by a Backend. crypto.Signer.Sign
+// has no context, the one of the request signing is kept instead
+type Key struct {
+	ctx       context.Context
+	backend   Backend
+	kid       string
+	publicKey crypto.PublicKey
+}
+
+// WithContext returns s bound to ctx when it's a Key, so a signer built once signs
+// with the context of each request, other signers are returned as is
+func WithContext(ctx context.Context, s crypto.Signer) crypto.Signer {
+	k, ok := s.(*Key)
+	if !ok {
+		return s
+	}
+	c := *k
+	c.ctx = ctx
+	return &c
+}
+
+// Public returns the public key
+func (k *Key) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+// Sign signs the digest in the backend, the backend provides its own randomness
+func (k *Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.backend.Sign(k.ctx, k.kid, digest, opts)
+}
+
+// opaqueSigner signs JWS payloads with a crypto.Signer
+type opaqueSigner struct {
+	kid    string
+	alg    jose.SignatureAlgorithm
+	signer crypto.Signer
+}
+
+// NewOpaqueSigner returns a jose.OpaqueSigner signing with s, the key ID is set as `kid` header
+func NewOpaqueSigner(kid, alg string, s crypto.Signer) jose.OpaqueSigner {
+	return &opaqueSigner{kid: kid, alg: jose.SignatureAlgorithm(alg), signer: s}
+}
+
+func (o *opaqueSigner) Public() *jose.JSONWebKey {
+	return &jose.JSONWebKey{Key: o.signer.Public(), KeyID: o.kid, Algorithm: string(o.alg), Use: "sig"}
+}
+
+func (o *opaqueSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{o.alg}
+}
+
+// SignPayload hashes the payload as the algorithm requires and signs it,
+// ECDSA signatures are converted from ASN.1 to the JWS R || S format
+func (o *opaqueSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	opts, err := signerOpts(string(alg))
+	if err != nil {
+		return nil, err
+	}
+	digest := payload
+	if hash := opts.HashFunc(); hash != 0 {
+		h := hash.New()
+		h.Write(payload)
+		digest = h.Sum(nil)
+	}
+
+	signature, err := o.signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with jwk %q: %w", o.kid, err)
+	}
+	if publicKey, ok := o.signer.Public().(*ecdsa.PublicKey); ok {
+		return rawECDSASignature(signature, publicKey)
+	}
+	return signature, nil
+}
+
+// signerOpts returns the crypto.Signer options of the JWS algorithm
+func signerOpts(alg string) (crypto.SignerOpts, error) {
+	switch alg {
+	case dao.AlgRS256, dao.AlgES256:
+		return crypto.SHA256, nil
+	case dao.AlgRS384, dao.AlgES384:
+		return crypto.SHA384, nil
+	case dao.AlgRS512:
+		return crypto.SHA512, nil
+	case dao.AlgPS256:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}, nil
+	case dao.AlgPS384:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA384}, nil
+	case dao.AlgPS512:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA512}, nil
+	case dao.AlgEdDSA:
+		// Ed25519 signs the message itself
+		return crypto.Hash(0), nil
+	}
+	return nil, fmt.Errorf("%w: %q", dao.ErrUnsupportedAlgorithm, alg)
+}
+
+// rawECDSASignature converts an ASN.1 ECDSA signature to the fixed size R || S of RFC 7518
+func rawECDSASignature(signature []byte, publicKey *ecdsa.PublicKey) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(signature, &sig)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("malformed ECDSA signature")
+	}
+	size := (publicKey.Curve.Params().BitSize + 7) / 8
+	if sig.R.BitLen() > size*8 || sig.S.BitLen() > size*8 {
+		return nil, errors.New("malformed ECDSA signature")
+	}
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return raw, nil
+}
@@ -0,0 +1,200 @@
+package signer
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose/v3"
+	"github.com/yanpozka/airvet-jwt/dao"
+)
+
+// generateKey creates a key in the backend with the state in the backend
+func generateKey(t *testing.T, b Backend, alg string, state dao.KeyState) *dao.JWK {
+	t.Helper()
+
+	ctx := context.Background()
+	jwk, err := NewJWK(ctx, b, dao.KeySpec{Algorithm: alg, RSAKeySize: dao.DefaultRSAKeySize}, time.Now().Add(dao.JWKExpiration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != dao.KeyStatePending {
+		if err := b.UpdateKeyState(ctx, jwk.KID, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return jwk
+}
+
+// signJWS signs a payload with s as JWS with the algorithm, checking the signature with the public key
+func signJWS(t *testing.T, s crypto.Signer, kid, alg string) error {
+	t.Helper()
+
+	jwsSigner, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.SignatureAlgorithm(alg), Key: NewOpaqueSigner(kid, alg, s)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := jwsSigner.Sign([]byte("payload"))
+	if err != nil {
+		return err
+	}
+	compact, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := jose.ParseSigned(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := parsed.Signatures[0].Header; header.KeyID != kid || header.Algorithm != alg {
+		t.Fatalf("got header %+v, want kid %s and alg %s", header, kid, alg)
+	}
+	if _, err := parsed.Verify(s.Public()); err != nil {
+		t.Fatalf("got %v verifying the %s signature", err, alg)
+	}
+	return nil
+}
+
+func TestOpaqueSignerAlgorithms(t *testing.T) {
+	ctx := context.Background()
+	algs := []string{dao.AlgRS256, dao.AlgPS384, dao.AlgES256, dao.AlgES384, dao.AlgEdDSA}
+	fake := NewFake()
+	for _, alg := range algs {
+		jwk := generateKey(t, fake, alg, dao.KeyStateActive)
+		if !jwk.IsExternal() || jwk.Algorithm != alg {
+			t.Fatalf("got key %+v, want an external %s key", jwk, alg)
+		}
+		s, err := ForJWK(ctx, fake, jwk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := signJWS(t, s, jwk.KID, alg); err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+	}
+	if fake.Signatures() != len(algs) {
+		t.Fatalf("got %d signatures, want %d", fake.Signatures(), len(algs))
+	}
+
+	// the local keys sign with their private key
+	local, err := dao.NewJWK(dao.KeySpec{Algorithm: dao.AlgES256}, time.Now().Add(dao.JWKExpiration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ForJWK(ctx, nil, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signJWS(t, s, local.KID, dao.AlgES256); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForJWKWithoutBackend(t *testing.T) {
+	jwk := generateKey(t, NewFake(), dao.AlgES256, dao.KeyStateActive)
+	if _, err := ForJWK(context.Background(), nil, jwk); !errors.Is(err, ErrNoBackend) {
+		t.Fatalf("got %v, want %v", err, ErrNoBackend)
+	}
+}
+
+func TestFakeErr(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake()
+	jwk := generateKey(t, fake, dao.AlgES256, dao.KeyStateActive)
+	s, err := ForJWK(ctx, fake, jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := errors.New("signer down")
+	fake.SetErr(want)
+	if err := signJWS(t, s, jwk.KID, dao.AlgES256); !errors.Is(err, want) {
+		t.Fatalf("got %v, want %v", err, want)
+	}
+	if _, err := fake.GenerateKey(ctx, dao.KeySpec{Algorithm: dao.AlgES256}); !errors.Is(err, want) {
+		t.Fatalf("got %v generating a key, want %v", err, want)
+	}
+	fake.SetErr(nil)
+	if err := signJWS(t, s, jwk.KID, dao.AlgES256); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyStoreFollowsKeyStates(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake()
+	keys := NewKeyStore(dao.NewMemoryKeyStore(), fake)
+
+	// signs only while the key is active or retiring in the key store
+	canSign := func(jwk *dao.JWK) error {
+		t.Helper()
+
+		s, err := ForJWK(ctx, fake, jwk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signJWS(t, s, jwk.KID, dao.AlgES256)
+	}
+	insert := func() *dao.JWK {
+		t.Helper()
+
+		jwk := generateKey(t, fake, dao.AlgES256, dao.KeyStatePending)
+		if err := keys.InsertJWK(ctx, jwk); err != nil {
+			t.Fatal(err)
+		}
+		return jwk
+	}
+
+	first := insert()
+	if err := canSign(first); !errors.Is(err, ErrKeyNotUsable) {
+		t.Fatalf("got %v signing with a pending key, want %v", err, ErrKeyNotUsable)
+	}
+	if err := keys.UpdateJWKState(ctx, first.KID, dao.KeyStateActive); err != nil {
+		t.Fatal(err)
+	}
+	if err := canSign(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// the retiring key still signs, the revoked one doesn't
+	next := insert()
+	if err := keys.UpdateJWKState(ctx, next.KID, dao.KeyStateActive); err != nil {
+		t.Fatal(err)
+	}
+	if err := canSign(first); err != nil {
+		t.Fatalf("got %v signing with the retiring key", err)
+	}
+	if err := keys.PurgeJWK(ctx, next.KID); !errors.Is(err, dao.ErrInvalidKeyTransition) {
+		t.Fatalf("got %v purging the active key, want %v", err, dao.ErrInvalidKeyTransition)
+	}
+	if err := canSign(next); err != nil {
+		t.Fatalf("got %v signing with the active key after the purge was rejected", err)
+	}
+	if err := keys.UpdateJWKState(ctx, first.KID, dao.KeyStateRevoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := canSign(first); !errors.Is(err, ErrKeyNotUsable) {
+		t.Fatalf("got %v signing with a revoked key, want %v", err, ErrKeyNotUsable)
+	}
+
+	if err := keys.PurgeJWK(ctx, first.KID); err != nil {
+		t.Fatal(err)
+	}
+	if err := canSign(first); !errors.Is(err, dao.ErrJWKNotFound) {
+		t.Fatalf("got %v signing with a purged key, want %v", err, dao.ErrJWKNotFound)
+	}
+
+	// the local keys aren't sent to the backend
+	local, err := dao.NewJWK(dao.KeySpec{Algorithm: dao.AlgES256}, time.Now().Add(dao.JWKExpiration))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.InsertJWK(ctx, local); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.UpdateJWKState(ctx, local.KID, dao.KeyStateActive); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,110 @@
+//go:build ignore
+// +build ignore
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/yanpozka/airvet-jwt/dao"
+	"github.com/yanpozka/airvet-jwt/signer"
+)
+
+const (
+	signerDBPath = "signer.db"
+	unixPrefix   = "unix:"
+
+	shutdownTimeout = 5 * time.Second
+
+	readTimeout  = 5 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	listen := flag.String("listen", "127.0.0.1:9090", "address to listen on, host:port or unix:/path/to.sock")
+	keyStoreDir := flag.String("keystore-dir", "", "keep the private keys in this directory instead of "+signerDBPath)
+	flag.Parse()
+
+	kek, err := dao.LoadKEK(os.Getenv("JWK_KEK"), os.Getenv("JWK_KEK_FILE"))
+	if err != nil {
+		log.Panic(err)
+	}
+	if kek == nil {
+		log.Println("No JWK_KEK or JWK_KEK_FILE set, the private keys are stored in plaintext")
+	}
+
+	var keys dao.KeyStore
+	if *keyStoreDir != "" {
+		dir, err := dao.NewDirKeyStore(*keyStoreDir, kek)
+		if err != nil {
+			log.Panic(err)
+		}
+		keys = dir
+	} else {
+		d, err := dao.NewDAO(signerDBPath)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer d.Close()
+
+		d.SetKEK(kek)
+		if err := d.Migrate(context.Background()); err != nil {
+			log.Panic(err)
+		}
+		keys = d
+	}
+
+	token := os.Getenv("SIGNER_TOKEN")
+	if token == "" {
+		log.Println("No SIGNER_TOKEN set, anyone reaching the daemon can sign")
+	}
+
+	network, addr := "tcp", *listen
+	if strings.HasPrefix(addr, unixPrefix) {
+		network, addr = "unix", strings.TrimPrefix(strings.TrimPrefix(addr, unixPrefix), "//")
+		// a socket left by a previous run makes Listen fail
+		os.Remove(addr)
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		log.Panic(err)
+	}
+	if network == "unix" {
+		// only the owner of the daemon can connect to the socket
+		if err := os.Chmod(addr, 0600); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	srv := &http.Server{
+		Handler:      signer.NewHandler(keys, token),
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+	}
+	go func() {
+		log.Printf("Signer listening on %s %q ...", network, addr)
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	log.Printf("Got OS signal: '%v', shutting down the signer", <-ch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatalf("Failed to shutdown the signer: %v", err)
+	}
+}
@@ -0,0 +1,336 @@
+// Package verifier verifies the access tokens of the airvet server in relying services,
+// using the public keys of its JWKS endpoint
+package verifier
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/go-jose/v3"
+	"github.com/square/go-jose/v3/jwt"
+	"github.com/yanpozka/airvet-jwt/auth"
+)
+
+const (
+	// DefaultCacheTTL is how long the keys are cached when the JWKS response has no max-age
+	DefaultCacheTTL = 5 * time.Minute
+
+	// DefaultMinRefreshInterval is the minimum time between two JWKS requests
+	DefaultMinRefreshInterval = 30 * time.Second
+
+	// DefaultFetchTimeout bounds a JWKS request
+	DefaultFetchTimeout = 10 * time.Second
+
+	jwksPath = "/.well-known/jwks.json"
+)
+
+var (
+	errNoKeys   = errors.New("the JWKS has no keys")
+	errNoIssuer = errors.New("the issuer is required, it's checked in every token")
+)
+
+// Config holds the verifier settings
+type Config struct {
+	// JWKSURL is the URL of the key set, Issuer + "/.well-known/jwks.json" when empty
+	JWKSURL string
+	// Issuer is the expected `iss` claim, it's required
+	Issuer string
+	// Audience is the expected `aud` claim, any audience is accepted when empty
+	Audience string
+	// Leeway is the clock skew allowed validating `exp`, `nbf` and `iat`, jwt.DefaultLeeway when zero
+	Leeway time.Duration
+	// DecryptionKey is the private key of the audience encryption key, it decrypts the tokens
+	// encrypted to it. Encrypted tokens are rejected when nil
+	DecryptionKey crypto.Signer
+
+	// HTTPClient fetches the key set, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// FetchTimeout bounds a JWKS request, DefaultFetchTimeout when zero
+	FetchTimeout time.Duration
+	// CacheTTL is used when the JWKS response has no Cache-Control max-age, DefaultCacheTTL when zero
+	CacheTTL time.Duration
+	// MinRefreshInterval limits the JWKS requests caused by unknown key IDs, short max-age
+	// or a failing issuer, DefaultMinRefreshInterval when zero
+	MinRefreshInterval time.Duration
+}
+
+// Verifier verifies signed JWTs against a remote JWKS, it's safe for concurrent use
+// and implements auth.TokenVerifier. Revoked tokens can only be detected with introspection
+type Verifier struct {
+	cfg Config
+
+	// mu guards the cached key set, it's never held during a JWKS request
+	mu        sync.Mutex
+	keys      []jose.JSONWebKey
+	etag      string
+	expiresAt time.Time
+	// fetchedAt is when the last JWKS request finished and fetchErr how it failed
+	fetchedAt time.Time
+	fetchErr  error
+	// inflight is the JWKS request in progress, nil when there is none
+	inflight *fetch
+}
+
+// fetch is a JWKS request shared by the verifications waiting for it, done is closed once err is set
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+// New creates a verifier, the key set is fetched on the first verification
+func New(cfg Config) (*Verifier, error) {
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if cfg.Issuer == "" {
+		return nil, errNoIssuer
+	}
+	if cfg.JWKSURL == "" {
+		cfg.JWKSURL = cfg.Issuer + jwksPath
+	}
+	if cfg.Leeway == 0 {
+		cfg.Leeway = jwt.DefaultLeeway
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	if cfg.FetchTimeout == 0 {
+		cfg.FetchTimeout = DefaultFetchTimeout
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = DefaultCacheTTL
+	}
+	if cfg.MinRefreshInterval == 0 {
+		cfg.MinRefreshInterval = DefaultMinRefreshInterval
+	}
+	return &Verifier{cfg: cfg}, nil
+}
+
+// VerifyToken implements auth.TokenVerifier, auth.ErrInvalidToken means the token must be rejected,
+// other errors mean the key set couldn't be fetched
+func (v *Verifier) VerifyToken(ctx context.Context, token string) (*auth.Claims, error) {
+	claims := new(auth.Claims)
+	if err := v.Verify(ctx, token, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Verify checks the signature and the registered claims of the token, decrypting it first
+// when it's encrypted, then decodes its claims into out, a struct embedding jwt.Claims
+func (v *Verifier) Verify(ctx context.Context, token string, out interface{}) error {
+	token, err := auth.DecryptToken(token, v.cfg.DecryptionKey)
+	if err != nil {
+		return auth.ErrInvalidToken
+	}
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil || len(parsed.Headers) != 1 {
+		return auth.ErrInvalidToken
+	}
+
+	header := parsed.Headers[0]
+	keys, err := v.verificationKeys(ctx, header.KeyID)
+	if err != nil {
+		return err
+	}
+
+	registered := new(jwt.Claims)
+	verified := false
+	for _, key := range keys {
+		// never let the token choose how its signature is checked
+		if header.Algorithm != key.Algorithm {
+			continue
+		}
+		if err := parsed.Claims(key.Key, registered, out); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return auth.ErrInvalidToken
+	}
+
+	expected := jwt.Expected{Issuer: v.cfg.Issuer, Time: time.Now()}
+	if v.cfg.Audience != "" {
+		expected.Audience = jwt.Audience{v.cfg.Audience}
+	}
+	if err := registered.ValidateWithLeeway(expected, v.cfg.Leeway); err != nil {
+		return auth.ErrInvalidToken
+	}
+	return nil
+}
+
+// verificationKeys returns the signing keys matching kid, or all of them when kid is empty.
+// The key set is fetched again when there is none, the cache expired or kid is unknown, but
+// never more often than MinRefreshInterval. Only one request fetches it at a time, the
+// verification starting it waits for it and so do the ones without a key matching kid,
+// the others keep using the cached keys meanwhile
+func (v *Verifier) verificationKeys(ctx context.Context, kid string) ([]jose.JSONWebKey, error) {
+	v.mu.Lock()
+	keys := matchingKeys(v.keys, kid)
+	f := v.inflight
+	switch {
+	case f == nil && v.refreshDue(len(keys) > 0, time.Now()):
+		f = v.startFetch()
+	case f == nil || len(keys) > 0:
+		fetchErr := v.fetchErr
+		v.mu.Unlock()
+		return cachedKeys(keys, fetchErr)
+	}
+	v.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	v.mu.Lock()
+	keys = matchingKeys(v.keys, kid)
+	v.mu.Unlock()
+	if f.err != nil && len(keys) > 0 {
+		// a stale key set is better than rejecting every token while the issuer is down
+		log.Printf("Error refreshing JWKS, using the cached keys: %v", f.err)
+	}
+	return cachedKeys(keys, f.err)
+}
+
+// refreshDue reports whether the key set must be fetched: there is none, it expired or no key
+// matched, and MinRefreshInterval passed since the last request. v.mu must be held
+func (v *Verifier) refreshDue(matched bool, now time.Time) bool {
+	if !v.fetchedAt.IsZero() && now.Sub(v.fetchedAt) < v.cfg.MinRefreshInterval {
+		return false
+	}
+	return len(v.keys) == 0 || now.After(v.expiresAt) || !matched
+}
+
+// startFetch requests the key set in the background. The request isn't bound to the verification
+// starting it, the others wait for it too, it has its own timeout instead. v.mu must be held
+func (v *Verifier) startFetch() *fetch {
+	f := &fetch{done: make(chan struct{})}
+	v.inflight = f
+	etag := v.etag
+	if len(v.keys) == 0 {
+		etag = ""
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), v.cfg.FetchTimeout)
+		defer cancel()
+		f.err = v.fetchJWKS(ctx, etag)
+
+		v.mu.Lock()
+		v.inflight = nil
+		v.fetchedAt = time.Now()
+		v.fetchErr = f.err
+		v.mu.Unlock()
+		close(f.done)
+	}()
+	return f
+}
+
+// cachedKeys returns the keys, when there are none the JWKS request error or auth.ErrInvalidToken
+func cachedKeys(keys []jose.JSONWebKey, fetchErr error) ([]jose.JSONWebKey, error) {
+	switch {
+	case len(keys) > 0:
+		return keys, nil
+	case fetchErr != nil:
+		return nil, fetchErr
+	}
+	return nil, auth.ErrInvalidToken
+}
+
+// fetchJWKS requests the key set, revalidating the cached one with its ETag, and caches it
+func (v *Verifier) fetchJWKS(ctx context.Context, etag string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.cfg.JWKSURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create JWKS request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := v.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		v.mu.Lock()
+		v.expiresAt = time.Now().Add(v.cacheTTL(resp.Header))
+		v.mu.Unlock()
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("unexpected JWKS response status: %s", resp.Status)
+	}
+
+	jwks := new(jose.JSONWebKeySet)
+	if err := json.NewDecoder(resp.Body).Decode(jwks); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	var keys []jose.JSONWebKey
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if !key.IsPublic() || !key.Valid() {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return errNoKeys
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.etag = resp.Header.Get("ETag")
+	v.expiresAt = time.Now().Add(v.cacheTTL(resp.Header))
+	v.mu.Unlock()
+	return nil
+}
+
+// cacheTTL returns how long the response can be cached following its Cache-Control header
+func (v *Verifier) cacheTTL(header http.Header) time.Duration {
+	cacheControl := header.Get("Cache-Control")
+	if cacheControl == "" {
+		return v.cfg.CacheTTL
+	}
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(directive, "max-age="), `"`))
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return v.cfg.CacheTTL
+}
+
+func matchingKeys(keys []jose.JSONWebKey, kid string) []jose.JSONWebKey {
+	var matching []jose.JSONWebKey
+	for _, key := range keys {
+		if kid == "" || key.KeyID == kid {
+			matching = append(matching, key)
+		}
+	}
+	return matching
+}
@@ -0,0 +1,580 @@
+package verifier
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/go-jose/v3"
+	"github.com/square/go-jose/v3/jwt"
+	"github.com/yanpozka/airvet-jwt/api"
+	"github.com/yanpozka/airvet-jwt/auth"
+	"github.com/yanpozka/airvet-jwt/dao"
+	"github.com/yanpozka/airvet-jwt/rotation"
+)
+
+// testServer runs the API over a fresh database. It counts the JWKS requests and the
+// 304 responses, records the ETags and can hold or fail the requests
+type testServer struct {
+	*httptest.Server
+	db     *dao.DAO
+	api    *api.API
+	routes http.Handler
+
+	mu          sync.Mutex
+	requests    int
+	notModified int
+	ifNoneMatch string
+	etag        string
+	down        bool
+	gate        chan struct{}
+}
+
+// statusWriter records the response status
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// newTestServer returns a server whose JWKS must be revalidated every time
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	return newTestServerWithMaxAge(t, 0)
+}
+
+// newTestServerWithMaxAge returns a server whose JWKS can be cached for maxAge
+func newTestServerWithMaxAge(t *testing.T, maxAge time.Duration) *testServer {
+	t.Helper()
+
+	d, err := dao.NewDAO(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	if err := d.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := d.HashPassword("Reports-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &dao.Client{ID: "reports-service", SecretHash: hash, Scopes: []string{"users:read"}}
+	if err := d.InsertClient(context.Background(), client); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{db: d}
+	s.rotate(t)
+	s.Server = httptest.NewServer(s)
+	t.Cleanup(s.Close)
+	s.api = api.NewAPI(d, d, api.Config{Issuer: s.URL, JWKSMaxAge: maxAge})
+	s.routes = s.api.GetRoutes()
+	return s
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != jwksPath {
+		s.routes.ServeHTTP(w, req)
+		return
+	}
+
+	s.mu.Lock()
+	s.requests++
+	s.ifNoneMatch = req.Header.Get("If-None-Match")
+	gate, down := s.gate, s.down
+	s.mu.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+	if down {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	s.routes.ServeHTTP(sw, req)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.etag = w.Header().Get("ETag")
+	if sw.status == http.StatusNotModified {
+		s.notModified++
+	}
+}
+
+// rotate activates a new key right away, the active one retires
+func (s *testServer) rotate(t *testing.T) {
+	t.Helper()
+
+	cfg := rotation.Config{LeadTime: dao.JWKExpiration}
+	if s.api != nil {
+		cfg.OnChange = s.api.InvalidateKeys
+	}
+	rotator := rotation.NewRotator(s.db, cfg)
+	if err := rotator.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// token gets a client_credentials token of the reports-service client
+func (s *testServer) token(t *testing.T) string {
+	t.Helper()
+
+	return s.clientToken(t, "reports-service", "Reports-secret")
+}
+
+// clientToken gets a client_credentials token of the client
+func (s *testServer) clientToken(t *testing.T, clientID, secret string) string {
+	t.Helper()
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || out.AccessToken == "" {
+		t.Fatalf("got status %d and error %v getting a token", resp.StatusCode, err)
+	}
+	return out.AccessToken
+}
+
+// setDown makes the JWKS requests fail
+func (s *testServer) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.down = down
+}
+
+// hold makes the next JWKS requests wait until the returned function is called
+func (s *testServer) hold() func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gate = make(chan struct{})
+	return func() { close(s.gate) }
+}
+
+func (s *testServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests
+}
+
+func (s *testServer) verifier(t *testing.T, minRefreshInterval time.Duration) *Verifier {
+	t.Helper()
+
+	v, err := New(Config{Issuer: s.URL, Audience: s.URL, MinRefreshInterval: minRefreshInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// signToken signs a token for the server with the key
+func (s *testServer) signToken(t *testing.T, key interface{}, alg jose.SignatureAlgorithm, kid string) string {
+	t.Helper()
+
+	opts := (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(auth.Claims{
+		Claims: jwt.Claims{
+			Issuer:   s.URL,
+			Subject:  "reports-service",
+			Audience: jwt.Audience{s.URL},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		ClientID: "reports-service",
+	}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestNewRequiresIssuer(t *testing.T) {
+	if _, err := New(Config{JWKSURL: "https://auth.airvet.test" + jwksPath}); err != errNoIssuer {
+		t.Fatalf("got %v without an issuer, want %v", err, errNoIssuer)
+	}
+	v, err := New(Config{Issuer: "https://auth.airvet.test/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.cfg.JWKSURL != "https://auth.airvet.test"+jwksPath {
+		t.Fatalf("got JWKS URL %q, want it under the issuer", v.cfg.JWKSURL)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+
+	// the published key set is what the verifier relies on
+	resp, err := http.Get(s.URL + jwksPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	jwks := new(jose.JSONWebKeySet)
+	if err := json.NewDecoder(resp.Body).Decode(jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("got %d keys, want the active one", len(jwks.Keys))
+	}
+	for _, key := range jwks.Keys {
+		if key.KeyID == "" || key.Algorithm != string(jose.RS256) || key.Use != "sig" || !key.IsPublic() {
+			t.Fatalf("got key %+v, want a public RS256 signing key with a kid", key)
+		}
+	}
+
+	token := s.token(t)
+	claims, err := s.verifier(t, 0).VerifyToken(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "reports-service" || claims.ClientID != "reports-service" || claims.Scope != "users:read" {
+		t.Fatalf("got claims %+v, want the reports-service client token", claims)
+	}
+
+	for name, cfg := range map[string]Config{
+		"other audience": {Issuer: s.URL, Audience: "https://reports.airvet.test"},
+		"other issuer":   {Issuer: "https://other.airvet.test", JWKSURL: s.URL + jwksPath},
+	} {
+		v, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := v.VerifyToken(ctx, token); err != auth.ErrInvalidToken {
+			t.Errorf("%s: got %v, want %v", name, err, auth.ErrInvalidToken)
+		}
+	}
+}
+
+func TestVerifyEncryptedToken(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+
+	// the tokens of the billing audience are encrypted to its key
+	decryptionKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(decryptionKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := s.db.HashPassword("Billing-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const audience = "https://billing.airvet.test"
+	if err := s.db.InsertClient(ctx, &dao.Client{
+		ID:            "billing-service",
+		SecretHash:    hash,
+		Scopes:        []string{"users:read"},
+		Audience:      audience,
+		EncryptionKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	token := s.clientToken(t, "billing-service", "Billing-secret")
+
+	v, err := New(Config{Issuer: s.URL, Audience: audience, DecryptionKey: decryptionKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := v.VerifyToken(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.ClientID != "billing-service" {
+		t.Fatalf("got claims %+v, want the billing-service client token", claims)
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string]crypto.Signer{"no decryption key": nil, "other decryption key": otherKey} {
+		v, err := New(Config{Issuer: s.URL, Audience: audience, DecryptionKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := v.VerifyToken(ctx, token); err != auth.ErrInvalidToken {
+			t.Errorf("%s: got %v, want %v", name, err, auth.ErrInvalidToken)
+		}
+	}
+}
+
+func TestVerifyAcrossKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	v := s.verifier(t, time.Millisecond)
+
+	oldToken := s.token(t)
+	if _, err := v.VerifyToken(ctx, oldToken); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new key signs before the cached key set expires
+	s.rotate(t)
+	time.Sleep(2 * time.Millisecond)
+	if _, err := v.VerifyToken(ctx, s.token(t)); err != nil {
+		t.Fatalf("got %v verifying a token of the new key", err)
+	}
+	if got := s.requestCount(); got != 2 {
+		t.Fatalf("got %d JWKS requests, want the unknown kid to fetch it again", got)
+	}
+
+	// the retiring key is still published
+	if _, err := v.VerifyToken(ctx, oldToken); err != nil {
+		t.Fatalf("got %v verifying a token of the old key", err)
+	}
+	if got := s.requestCount(); got != 2 {
+		t.Fatalf("got %d JWKS requests, want the cached key set used", got)
+	}
+}
+
+func TestVerifyUnknownKIDRateLimited(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	v := s.verifier(t, time.Hour)
+
+	if _, err := v.VerifyToken(ctx, s.token(t)); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := v.VerifyToken(ctx, s.signToken(t, key, jose.ES256, "unknown")); err != auth.ErrInvalidToken {
+			t.Fatalf("got %v verifying a token of an unknown key, want %v", err, auth.ErrInvalidToken)
+		}
+	}
+	if got := s.requestCount(); got != 1 {
+		t.Fatalf("got %d JWKS requests, want 1 within the minimum refresh interval", got)
+	}
+}
+
+func TestVerifyRejectsWrongAlg(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	v := s.verifier(t, 0)
+
+	jwks, err := s.db.GetJWKS(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := jwks[0].GetPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.VerifyToken(ctx, s.signToken(t, privateKey, jose.RS256, jwks[0].KID)); err != nil {
+		t.Fatal(err)
+	}
+	// the signature is valid for the key, but the key only signs RS256
+	if _, err := v.VerifyToken(ctx, s.signToken(t, privateKey, jose.PS256, jwks[0].KID)); err != auth.ErrInvalidToken {
+		t.Fatalf("got %v verifying a PS256 token of a RS256 key, want %v", err, auth.ErrInvalidToken)
+	}
+}
+
+func TestVerifyMaxAge(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServerWithMaxAge(t, time.Hour)
+	v := s.verifier(t, time.Millisecond)
+	token := s.token(t)
+
+	// max-age keeps the key set
+	for i := 0; i < 2; i++ {
+		time.Sleep(2 * time.Millisecond)
+		if _, err := v.VerifyToken(ctx, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.requestCount(); got != 1 {
+		t.Fatalf("got %d JWKS requests, want the key set cached for its max-age", got)
+	}
+}
+
+func TestVerifyRevalidatesWithETag(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	v := s.verifier(t, time.Millisecond)
+	token := s.token(t)
+
+	// no-cache revalidates the key set every time with its ETag
+	for i := 0; i < 3; i++ {
+		time.Sleep(2 * time.Millisecond)
+		if _, err := v.VerifyToken(ctx, token); err != nil {
+			t.Fatalf("got %v verifying after a 304 response", err)
+		}
+	}
+	s.mu.Lock()
+	requests, notModified, ifNoneMatch, etag := s.requests, s.notModified, s.ifNoneMatch, s.etag
+	s.mu.Unlock()
+	if requests != 3 || notModified != 2 {
+		t.Fatalf("got %d JWKS requests and %d 304 responses, want every verification to revalidate", requests, notModified)
+	}
+	if etag == "" || ifNoneMatch != etag {
+		t.Fatalf("got If-None-Match %q, want the ETag %q of the cached key set", ifNoneMatch, etag)
+	}
+
+	// a rotation changes the ETag, the new key set is fetched
+	s.rotate(t)
+	time.Sleep(2 * time.Millisecond)
+	if _, err := v.VerifyToken(ctx, s.token(t)); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.notModified != 2 || s.etag == etag {
+		t.Fatalf("got %d 304 responses and ETag %q, want the rotated key set with a new ETag", s.notModified, s.etag)
+	}
+}
+
+func TestVerifyDuringSlowRefresh(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.setDown(false)
+	v := s.verifier(t, time.Millisecond)
+
+	token := s.token(t)
+	if _, err := v.VerifyToken(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next request fetching the expired key set hangs
+	release := s.hold()
+	time.Sleep(2 * time.Millisecond)
+	refreshed := make(chan error, 1)
+	go func() {
+		_, err := v.VerifyToken(ctx, token)
+		refreshed <- err
+	}()
+	for s.requestCount() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	verified := make(chan error, 1)
+	go func() {
+		_, err := v.VerifyToken(ctx, token)
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Fatalf("got %v verifying with the cached keys", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the verification waited for the JWKS request")
+	}
+
+	release()
+	if err := <-refreshed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyCancelledDuringFetch(t *testing.T) {
+	s := newTestServer(t)
+	v := s.verifier(t, time.Hour)
+	token := s.token(t)
+
+	// the first verification starts the fetch and gives up, the second one waits for it
+	release := s.hold()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := v.VerifyToken(ctx, token)
+		cancelled <- err
+	}()
+	for s.requestCount() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := v.VerifyToken(context.Background(), token)
+		waiting <- err
+	}()
+
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Fatalf("got %v from the cancelled verification, want %v", err, context.Canceled)
+	}
+	release()
+	if err := <-waiting; err != nil {
+		t.Fatalf("got %v from the verification waiting for the fetch", err)
+	}
+	if _, err := v.VerifyToken(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.requestCount(); got != 1 {
+		t.Fatalf("got %d JWKS requests, want the one shared fetch", got)
+	}
+}
+
+func TestVerifyIssuerDown(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServer(t)
+	s.setDown(true)
+	token := s.token(t)
+
+	// without keys the failing issuer is still asked at most every MinRefreshInterval
+	v := s.verifier(t, time.Hour)
+	for i := 0; i < 3; i++ {
+		if _, err := v.VerifyToken(ctx, token); err == nil || err == auth.ErrInvalidToken {
+			t.Fatalf("got %v while the issuer is down, want the JWKS request error", err)
+		}
+	}
+	if got := s.requestCount(); got != 1 {
+		t.Fatalf("got %d JWKS requests, want 1 within the minimum refresh interval", got)
+	}
+
+	// a stale key set is used while the issuer is down
+	s.setDown(false)
+	v = s.verifier(t, time.Millisecond)
+	if _, err := v.VerifyToken(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	s.setDown(true)
+	time.Sleep(2 * time.Millisecond)
+	if _, err := v.VerifyToken(ctx, token); err != nil {
+		t.Fatalf("got %v verifying with the stale keys while the issuer is down", err)
+	}
+}